@@ -0,0 +1,421 @@
+// Package acl implements Redis access control, AUTH and the ACL command, on
+// top of redhub. An ACL is installed on a RedHub with Plug, ahead of the
+// other plugins so that it checks the commands they serve too:
+//
+//	a := acl.New(acl.Options{Mux: mux})
+//	if err := a.SetUser("default", "resetpass", ">secret"); err != nil {
+//		log.Fatal(err)
+//	}
+//	rh := redhub.NewRedHub(onOpened, onClosed, mux.ServeRESP, tickFreq, reclaimMemAfter)
+//	rh.Plug(a)
+//	rh.Plug(broker)
+//
+// With transactions, the ACL replies to the commands it refuses through the
+// tx.Tx, plugged after it, so that EXEC aborts:
+//
+//	t := tx.New(tx.Options{Mux: mux})
+//	a := acl.New(acl.Options{Mux: mux, Reject: t.Reject})
+//	rh.Plug(a)
+//	rh.Plug(t)
+//
+// Users have passwords, stored as SHA-256 hashes, command rules by name and
+// category, key patterns and pub/sub channel patterns, set with the rules
+// of ACL SETUSER. Every command is checked against the rules of the
+// connection's user before it reaches the handler, and refused with the
+// NOAUTH and NOPERM errors of Redis.
+package acl
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/IceFireDB/redhub"
+	"github.com/IceFireDB/redhub/pkg/resp"
+)
+
+// Options configures an ACL.
+type Options struct {
+	// Mux provides the command metadata rules are checked against: the
+	// ACL categories of commands and the positions of their keys. Commands
+	// the Mux doesn't know, or every command when Mux is nil, are only
+	// allowed by rules naming them and by +@all. Commands served by plugins
+	// should be registered on the Mux with their specs.
+	Mux *redhub.Mux
+
+	// Reject, when set, replies to the commands the ACL refuses in place of
+	// writing the error itself. Set it to the Reject method of a tx.Tx so
+	// that a refused command makes the open transaction abort, as in Redis.
+	Reject func(c redhub.Conn, msg string)
+}
+
+// ACL authenticates connections and checks their commands against the
+// rules of their user. The "default" user, which new connections are
+// authenticated as, has no password and may run every command until it is
+// configured otherwise.
+type ACL struct {
+	opts Options
+	// own routes AUTH and ACL, which the ACL serves itself.
+	own *redhub.Mux
+
+	// mu guards users and serializes rule changes.
+	mu    sync.RWMutex
+	users map[string]*user
+
+	// sessions holds a *session for every connection that ran a command.
+	sessions sync.Map
+
+	// info caches the names and categories of commands by spec.
+	info sync.Map
+
+	log aclLog
+}
+
+// session is the authentication state of a connection.
+type session struct {
+	// user is the user the connection is authenticated as, nil when it
+	// isn't authenticated. It is only accessed by the connection's
+	// processing goroutine.
+	user *user
+}
+
+// commandInfo is what the rules need to know about a command.
+type commandInfo struct {
+	// name is the full name of the command, "parent|sub" for subcommands,
+	// and parent the name of its container.
+	name, parent string
+	cats         []string
+}
+
+// New creates a new ACL with the default user.
+func New(opts Options) *ACL {
+	a := &ACL{
+		opts:  opts,
+		users: make(map[string]*user),
+	}
+	a.own = redhub.NewMux()
+	a.own.Handle(a.Commands()...)
+	if err := a.SetUser("default", "reset", "on", "nopass", "~*", "&*", "+@all"); err != nil {
+		panic(err)
+	}
+	return a
+}
+
+// SetUser creates the user name, when it doesn't exist, and applies the rules
+// ops to it as ACL SETUSER does. Either every rule is applied or, when one
+// is invalid, none is.
+func (a *ACL) SetUser(name string, ops ...string) error {
+	if strings.ContainsAny(name, " \x00") {
+		return fmt.Errorf("Usernames can't contain spaces or null characters")
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	u := a.users[name]
+	var r *rules
+	if u != nil {
+		r = u.load().clone()
+	} else {
+		r = &rules{}
+	}
+	for _, op := range ops {
+		if err := r.apply(a.opts.Mux, op); err != nil {
+			return fmt.Errorf("Error in ACL SETUSER modifier '%s': %s", op, err)
+		}
+	}
+	if u == nil {
+		u = newUser(name)
+		a.users[name] = u
+	}
+	u.rules.Store(r)
+	return nil
+}
+
+// DelUser deletes the users names and reports how many existed. The
+// connections authenticated as them are closed on their next command. The
+// default user can't be deleted.
+func (a *ACL) DelUser(names ...string) (int, error) {
+	for _, name := range names {
+		if name == "default" {
+			return 0, fmt.Errorf("The 'default' user cannot be removed")
+		}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var n int
+	for _, name := range names {
+		if u := a.users[name]; u != nil {
+			atomic.StoreInt32(&u.deleted, 1)
+			delete(a.users, name)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (a *ACL) user(name string) *user {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.users[name]
+}
+
+// Wrap implements redhub.Plugin. It serves AUTH and ACL, authenticates
+// HELLO AUTH, and refuses the commands the connection's user may not run.
+func (a *ACL) Wrap(next redhub.HandlerFunc) redhub.HandlerFunc {
+	return func(c redhub.Conn, cmd resp.Command) redhub.Action {
+		var buf [16]byte
+		name := resp.AppendLower(buf[:0], cmd.Args[0])
+		s := a.session(c)
+		if s.user != nil && s.user.isDeleted() {
+			return redhub.Close
+		}
+
+		switch string(name) {
+		case "auth":
+			return a.own.ServeRESP(c, cmd)
+		case "hello":
+			return a.hello(c, cmd, s, next)
+		case "quit":
+			return next(c, cmd)
+		case "reset":
+			a.Closed(c)
+			c.SetUser("default")
+			return next(c, cmd)
+		}
+
+		m := a.opts.Mux
+		if string(name) == "acl" {
+			m = a.own
+		}
+		var spec *redhub.CommandSpec
+		var err error
+		if m != nil {
+			if err = m.Validate(cmd.Args); err == nil {
+				spec = m.Lookup(cmd.Args)
+			}
+		}
+
+		if s.user == nil && (spec == nil || spec.Flags&redhub.FlagNoAuth == 0) {
+			if err != nil {
+				a.reject(c, err.Error())
+				return redhub.None
+			}
+			a.reject(c, "NOAUTH Authentication required.")
+			return redhub.None
+		}
+		if s.user == nil {
+			return next(c, cmd)
+		}
+
+		r := s.user.load()
+		if spec == nil {
+			// An unknown command, or one with a wrong number of arguments:
+			// only rules naming it allow it, and the Mux error is replied
+			// otherwise.
+			if !r.allows(string(name), "", nil) {
+				if err != nil {
+					a.reject(c, err.Error())
+				} else {
+					a.deny(c, s, "command", string(name))
+				}
+				return redhub.None
+			}
+			if !a.checkChannels(c, s, r, string(name), cmd.Args) {
+				return redhub.None
+			}
+			return next(c, cmd)
+		}
+		if !a.check(c, s, r, m, spec, cmd) {
+			return redhub.None
+		}
+		if m == a.own {
+			return a.own.ServeRESP(c, cmd)
+		}
+		return next(c, cmd)
+	}
+}
+
+// Closed implements redhub.Plugin and forgets the session of c.
+func (a *ACL) Closed(c redhub.Conn) {
+	a.sessions.Delete(c)
+}
+
+// session returns the session of c, authenticated as the default user
+// when the default user needs no password.
+func (a *ACL) session(c redhub.Conn) *session {
+	if v, ok := a.sessions.Load(c); ok {
+		return v.(*session)
+	}
+	s := &session{}
+	if u := a.user("default"); u != nil {
+		if r := u.load(); r.enabled && r.nopass {
+			s.user = u
+		}
+	}
+	a.sessions.Store(c, s)
+	return s
+}
+
+// check checks cmd against the rules r and replies with the NOPERM error
+// when it isn't allowed.
+func (a *ACL) check(c redhub.Conn, s *session, r *rules, m *redhub.Mux, spec *redhub.CommandSpec, cmd resp.Command) bool {
+	info := a.commandInfo(m, spec, cmd.Args)
+	allowed, ok := r.perms.Load(spec)
+	if !ok {
+		allowed = r.allows(info.name, info.parent, info.cats)
+		r.perms.Store(spec, allowed)
+	}
+	if !allowed.(bool) {
+		a.deny(c, s, "command", info.name)
+		return false
+	}
+
+	if spec.Flags&redhub.FlagPubSub == 0 && !r.allKeys() && spec.HasKeys() {
+		// Keys of commands flagged neither write nor readonly need both.
+		read := spec.Flags&redhub.FlagWrite == 0
+		write := spec.Flags&redhub.FlagReadOnly == 0
+		for _, key := range spec.Keys(cmd.Args) {
+			if !r.allowsKey(string(key), read, write) {
+				a.deny(c, s, "key", string(key))
+				return false
+			}
+		}
+	}
+
+	return a.checkChannels(c, s, r, info.name, cmd.Args)
+}
+
+// checkChannels checks the channels the pub/sub command name accesses
+// against the rules r and replies with the NOPERM error when one isn't
+// allowed.
+func (a *ACL) checkChannels(c redhub.Conn, s *session, r *rules, name string, args [][]byte) bool {
+	if r.allChannels() {
+		return true
+	}
+	var channels [][]byte
+	var literal bool
+	if len(args) < 2 {
+		return true
+	}
+	switch name {
+	case "publish", "spublish":
+		channels = args[1:2]
+	case "subscribe", "ssubscribe":
+		channels = args[1:]
+	case "psubscribe":
+		channels, literal = args[1:], true
+	}
+	for _, ch := range channels {
+		if !r.allowsChannel(string(ch), literal) {
+			a.deny(c, s, "channel", string(ch))
+			return false
+		}
+	}
+	return true
+}
+
+// deny replies with the NOPERM error for reason, "command", "key" or
+// "channel", and logs the denial.
+func (a *ACL) deny(c redhub.Conn, s *session, reason, object string) {
+	a.log.add(c, reason, object, s.user.name)
+	switch reason {
+	case "command":
+		a.reject(c, "NOPERM User "+s.user.name+" has no permissions to run the '"+object+"' command")
+	default:
+		a.reject(c, "NOPERM No permissions to access a "+reason)
+	}
+}
+
+// reject replies with the error msg to a command the ACL refuses.
+func (a *ACL) reject(c redhub.Conn, msg string) {
+	if a.opts.Reject != nil {
+		a.opts.Reject(c, msg)
+		return
+	}
+	c.WriteError(msg)
+}
+
+// commandInfo returns the names and categories of the command spec, which
+// args invoke on m.
+func (a *ACL) commandInfo(m *redhub.Mux, spec *redhub.CommandSpec, args [][]byte) *commandInfo {
+	if v, ok := a.info.Load(spec); ok {
+		return v.(*commandInfo)
+	}
+	info := &commandInfo{
+		name: strings.ToLower(string(args[0])),
+		cats: spec.ACLCategories(),
+	}
+	if len(args) > 1 && m.Lookup(args[:1]) != spec {
+		info.parent = info.name
+		info.name += "|" + strings.ToLower(string(args[1]))
+	}
+	a.info.Store(spec, info)
+	return info
+}
+
+// authenticate authenticates the session of c as the user name with pass,
+// or replies with the WRONGPASS error.
+func (a *ACL) authenticate(c redhub.Conn, s *session, name, pass string) bool {
+	u := a.user(name)
+	if u == nil || !u.load().enabled || !u.load().checkPassword(pass) {
+		a.log.add(c, "auth", "AUTH", name)
+		c.WriteError("WRONGPASS invalid username-password pair or user is disabled.")
+		return false
+	}
+	s.user = u
+	c.SetUser(name)
+	return true
+}
+
+func (a *ACL) auth(c redhub.Conn, cmd resp.Command) redhub.Action {
+	s := a.session(c)
+	switch len(cmd.Args) {
+	case 2:
+		if r := a.user("default").load(); r.nopass {
+			c.WriteError("ERR AUTH <password> called without any password configured for the default user. " +
+				"Are you sure your configuration is correct?")
+			return redhub.None
+		}
+		if a.authenticate(c, s, "default", string(cmd.Args[1])) {
+			c.WriteString("OK")
+		}
+	case 3:
+		if a.authenticate(c, s, string(cmd.Args[1]), string(cmd.Args[2])) {
+			c.WriteString("OK")
+		}
+	default:
+		c.WriteError("ERR syntax error")
+	}
+	return redhub.None
+}
+
+// hello authenticates the AUTH option of HELLO and passes the command on
+// without it.
+func (a *ACL) hello(c redhub.Conn, cmd resp.Command, s *session, next redhub.HandlerFunc) redhub.Action {
+	for i := 2; i < len(cmd.Args); i++ {
+		switch strings.ToLower(string(cmd.Args[i])) {
+		case "auth":
+			if i+2 >= len(cmd.Args) {
+				return next(c, cmd)
+			}
+			if !a.authenticate(c, s, string(cmd.Args[i+1]), string(cmd.Args[i+2])) {
+				return redhub.None
+			}
+			args := make([][]byte, 0, len(cmd.Args)-3)
+			args = append(args, cmd.Args[:i]...)
+			args = append(args, cmd.Args[i+3:]...)
+			return next(c, resp.Command{Raw: cmd.Raw, Args: args})
+		case "setname":
+			i++
+		}
+	}
+	if s.user == nil {
+		a.reject(c, "NOAUTH HELLO must be called with the client already authenticated, otherwise the "+
+			"HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select "+
+			"the RESP protocol version at the same time")
+		return redhub.None
+	}
+	return next(c, cmd)
+}
@@ -0,0 +1,270 @@
+package acl_test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/IceFireDB/redhub"
+	"github.com/IceFireDB/redhub/acl"
+	"github.com/IceFireDB/redhub/pkg/resp"
+	"github.com/IceFireDB/redhub/redhubtest"
+	"github.com/IceFireDB/redhub/tx"
+)
+
+// store is a minimal key-value store served by a Mux.
+type store struct {
+	mu   sync.Mutex
+	data map[string]string
+}
+
+func (s *store) set(c redhub.Conn, cmd resp.Command) redhub.Action {
+	s.mu.Lock()
+	s.data[string(cmd.Args[1])] = string(cmd.Args[2])
+	s.mu.Unlock()
+	c.WriteString("OK")
+	return redhub.None
+}
+
+func (s *store) get(c redhub.Conn, cmd resp.Command) redhub.Action {
+	s.mu.Lock()
+	v, ok := s.data[string(cmd.Args[1])]
+	s.mu.Unlock()
+	if !ok {
+		c.WriteNull()
+	} else {
+		c.WriteBulkString(v)
+	}
+	return redhub.None
+}
+
+// reply stands in for the pub/sub commands, whose replies don't matter to
+// the ACL.
+func reply(c redhub.Conn, cmd resp.Command) redhub.Action {
+	c.WriteString("OK")
+	return redhub.None
+}
+
+// newServer serves a store behind a and, when tr is not nil, tr.
+func newServer(t *testing.T, a *acl.ACL, mux *redhub.Mux, tr *tx.Tx) *redhubtest.Server {
+	s := &store{data: make(map[string]string)}
+	mux.Handle(
+		redhub.CommandSpec{Name: "set", Arity: 3, Flags: redhub.FlagWrite, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Categories: []string{"string"}, Handler: s.set},
+		redhub.CommandSpec{Name: "get", Arity: 2, Flags: redhub.FlagReadOnly | redhub.FlagFast,
+			FirstKey: 1, LastKey: 1, KeyStep: 1, Categories: []string{"string"}, Handler: s.get},
+		redhub.CommandSpec{Name: "hello", Arity: -1, Flags: redhub.FlagFast | redhub.FlagNoAuth,
+			Handler: redhub.Hello},
+		redhub.CommandSpec{Name: "publish", Arity: 3, Flags: redhub.FlagPubSub, Handler: reply},
+		redhub.CommandSpec{Name: "subscribe", Arity: -2, Flags: redhub.FlagPubSub, Handler: reply},
+		redhub.CommandSpec{Name: "psubscribe", Arity: -2, Flags: redhub.FlagPubSub, Handler: reply},
+	)
+	mux.Handle(a.Commands()...)
+	rh := redhubtest.NewHub(mux.ServeRESP)
+	rh.Plug(a)
+	if tr != nil {
+		mux.Handle(tr.Commands()...)
+		rh.Plug(tr)
+	}
+	srv := redhubtest.NewPipeServer(rh, redhub.Options{})
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestDenialAbortsTransaction(t *testing.T) {
+	mux := redhub.NewMux()
+	tr := tx.New(tx.Options{Mux: mux})
+	a := acl.New(acl.Options{Mux: mux, Reject: tr.Reject})
+	if err := a.SetUser("default", "resetkeys", "~allowed*"); err != nil {
+		t.Fatal(err)
+	}
+	c := newServer(t, a, mux, tr).Client(t)
+
+	c.Expect(t, redhubtest.ExpectString("OK"), "MULTI")
+	c.Expect(t, redhubtest.ExpectString("QUEUED"), "SET", "allowedk", "v")
+	c.Expect(t, redhubtest.ExpectError("NOPERM *"), "SET", "secret", "v")
+	c.Expect(t, redhubtest.ExpectError("EXECABORT *"), "EXEC")
+	c.Expect(t, redhubtest.ExpectNull(), "GET", "allowedk")
+}
+
+// step sends args from the first client, or from a second one when other
+// is set, and checks the reply.
+type step struct {
+	other bool
+	args  []interface{}
+	check redhubtest.Check
+}
+
+func command(args ...interface{}) []interface{} { return args }
+
+var (
+	ok        = redhubtest.ExpectString("OK")
+	null      = redhubtest.ExpectNull()
+	noauth    = redhubtest.ExpectError("NOAUTH Authentication required.")
+	wrongpass = redhubtest.ExpectError("WRONGPASS invalid username-password pair or user is disabled.")
+	noKey     = redhubtest.ExpectError("NOPERM No permissions to access a key")
+	noChannel = redhubtest.ExpectError("NOPERM No permissions to access a channel")
+)
+
+// logEntry checks the fields of an ACL LOG entry.
+func logEntry(reason, object, username string) redhubtest.Check {
+	return func(tb testing.TB, r redhubtest.Reply) {
+		tb.Helper()
+		fields := make(map[string]string)
+		for i := 0; i+1 < len(r.Elems); i += 2 {
+			fields[r.Elems[i].Str] = r.Elems[i+1].Str
+		}
+		if fields["reason"] != reason || fields["object"] != object || fields["username"] != username {
+			tb.Errorf("got entry %s, want reason %q, object %q and username %q", r, reason, object, username)
+		}
+	}
+}
+
+// firstLogEntry checks the newest ACL LOG entry.
+func firstLogEntry(check redhubtest.Check) redhubtest.Check {
+	return func(tb testing.TB, r redhubtest.Reply) {
+		tb.Helper()
+		if r.Err() != nil || len(r.Elems) == 0 {
+			tb.Fatalf("got %s, want ACL LOG entries", r)
+		}
+		check(tb, r.Elems[0])
+	}
+}
+
+func TestACL(t *testing.T) {
+	tests := []struct {
+		name  string
+		users [][]string // name, then rules
+		steps []step
+	}{
+		{"default user needs no auth", nil, []step{
+			{args: command("SET", "k", "v"), check: ok},
+			{args: command("ACL", "WHOAMI"), check: redhubtest.ExpectBulk("default")},
+			{args: command("AUTH", "pass"),
+				check: redhubtest.ExpectError("ERR AUTH <password> called without any password configured*")},
+		}},
+		{"noauth", [][]string{{"default", "resetpass", ">secret"}}, []step{
+			{args: command("GET", "k"), check: noauth},
+			{args: command("NOSUCH"), check: redhubtest.ExpectError("ERR unknown command 'NOSUCH'*")},
+			{args: command("AUTH", "wrong"), check: wrongpass},
+			{args: command("GET", "k"), check: noauth},
+			{args: command("AUTH", "secret"), check: ok},
+			{args: command("GET", "k"), check: null},
+		}},
+		{"auth as user", [][]string{{"alice", "on", ">pass", "+@all", "~*"}}, []step{
+			{args: command("AUTH", "alice", "wrong"), check: wrongpass},
+			{args: command("AUTH", "nobody", "pass"), check: wrongpass},
+			{args: command("AUTH", "alice", "pass"), check: ok},
+			{args: command("ACL", "WHOAMI"), check: redhubtest.ExpectBulk("alice")},
+			{args: command("AUTH", "a", "b", "c"), check: redhubtest.ExpectError("ERR syntax error")},
+		}},
+		{"disabled user", [][]string{{"bob", "off", ">pass", "+@all"}}, []step{
+			{args: command("AUTH", "bob", "pass"), check: wrongpass},
+		}},
+		{"hello auth", [][]string{{"default", "resetpass", ">secret"}}, []step{
+			{args: command("HELLO", "3"), check: redhubtest.ExpectError("NOAUTH HELLO must be called*")},
+			{args: command("HELLO", "3", "AUTH", "default", "wrong"), check: wrongpass},
+			{args: command("GET", "k"), check: noauth},
+			{args: command("HELLO", "3", "AUTH", "default", "secret"), check: func(tb testing.TB, r redhubtest.Reply) {
+				if r.Type != resp.Map {
+					tb.Errorf("HELLO replied %s, want a map", r)
+				}
+			}},
+			{args: command("GET", "k"), check: null},
+			{args: command("HELLO", "2"), check: redhubtest.ExpectArrayLen(14)},
+		}},
+		{"noperm command", [][]string{{"default", "-set"}}, []step{
+			{args: command("SET", "k", "v"),
+				check: redhubtest.ExpectError("NOPERM User default has no permissions to run the 'set' command")},
+			{args: command("GET", "k"), check: null},
+			{args: command("ACL", "SETUSER", "default", "-@string"), check: ok},
+			{args: command("GET", "k"),
+				check: redhubtest.ExpectError("NOPERM User default has no permissions to run the 'get' command")},
+		}},
+		{"noperm subcommand", [][]string{{"default", "-acl|setuser"}}, []step{
+			{args: command("ACL", "SETUSER", "default", "+@all"),
+				check: redhubtest.ExpectError("NOPERM User default has no permissions to run the 'acl|setuser' command")},
+			{args: command("ACL", "WHOAMI"), check: redhubtest.ExpectBulk("default")},
+		}},
+		{"noperm key", [][]string{{"default", "resetkeys", "~allowed*", "%R~public*"}}, []step{
+			{args: command("SET", "allowed:1", "v"), check: ok},
+			{args: command("GET", "allowed:1"), check: redhubtest.ExpectBulk("v")},
+			{args: command("SET", "secret", "v"), check: noKey},
+			{args: command("GET", "secret"), check: noKey},
+			{args: command("GET", "public:1"), check: null},
+			{args: command("SET", "public:1", "v"), check: noKey},
+		}},
+		{"noperm channel", [][]string{{"default", "resetchannels", "&news.*"}}, []step{
+			{args: command("PUBLISH", "news.sport", "hi"), check: ok},
+			{args: command("PUBLISH", "weather", "hi"), check: noChannel},
+			{args: command("SUBSCRIBE", "news.sport", "news.tech"), check: ok},
+			{args: command("SUBSCRIBE", "news.sport", "weather"), check: noChannel},
+			{args: command("PSUBSCRIBE", "news.*"), check: ok},
+			{args: command("PSUBSCRIBE", "news.s*"), check: noChannel},
+		}},
+		{"setuser", nil, []step{
+			{args: command("ACL", "SETUSER", "carol", "on", ">pass", "+get", "~k*"), check: ok},
+			{args: command("ACL", "SETUSER", "carol", "+nosuch"),
+				check: redhubtest.ExpectError("ERR Error in ACL SETUSER modifier '+nosuch': Unknown command*")},
+			{args: command("ACL", "SETUSER", "carol", "~*", "bogus"),
+				check: redhubtest.ExpectError("ERR Error in ACL SETUSER modifier 'bogus': Syntax error")},
+			{other: true, args: command("AUTH", "carol", "pass"), check: ok},
+			{other: true, args: command("GET", "k"), check: null},
+			{other: true, args: command("GET", "other"), check: noKey},
+			{other: true, args: command("SET", "k", "v"),
+				check: redhubtest.ExpectError("NOPERM User carol has no permissions to run the 'set' command")},
+			// New rules apply to authenticated connections at once.
+			{args: command("ACL", "SETUSER", "carol", "+set"), check: ok},
+			{other: true, args: command("SET", "k", "v"), check: ok},
+		}},
+		{"log", [][]string{{"default", "-set"}}, []step{
+			{args: command("ACL", "LOG"), check: redhubtest.ExpectArrayLen(0)},
+			{args: command("SET", "k", "v"), check: redhubtest.ExpectError("NOPERM *")},
+			{args: command("ACL", "LOG"), check: firstLogEntry(logEntry("command", "set", "default"))},
+			{args: command("AUTH", "nobody", "pass"), check: wrongpass},
+			{args: command("ACL", "LOG"), check: firstLogEntry(logEntry("auth", "AUTH", "nobody"))},
+			{args: command("ACL", "LOG", "1"), check: redhubtest.ExpectArrayLen(1)},
+			{args: command("ACL", "LOG", "-1"), check: redhubtest.ExpectError("ERR value is out of range*")},
+			{args: command("ACL", "LOG", "RESET"), check: ok},
+			{args: command("ACL", "LOG"), check: redhubtest.ExpectArrayLen(0)},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux := redhub.NewMux()
+			a := acl.New(acl.Options{Mux: mux})
+			srv := newServer(t, a, mux, nil)
+			for _, u := range tt.users {
+				if err := a.SetUser(u[0], u[1:]...); err != nil {
+					t.Fatal(err)
+				}
+			}
+			c, other := srv.Client(t), srv.Client(t)
+			for _, s := range tt.steps {
+				if s.other {
+					other.Expect(t, s.check, s.args...)
+				} else {
+					c.Expect(t, s.check, s.args...)
+				}
+			}
+		})
+	}
+}
+
+func TestDelUserClosesSessions(t *testing.T) {
+	mux := redhub.NewMux()
+	a := acl.New(acl.Options{Mux: mux})
+	if err := a.SetUser("dave", "on", ">pass", "+@all", "~*"); err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer(t, a, mux, nil)
+	c, admin := srv.Client(t), srv.Client(t)
+
+	c.Expect(t, ok, "AUTH", "dave", "pass")
+	c.Expect(t, null, "GET", "k")
+	admin.Expect(t, redhubtest.ExpectError("ERR The 'default' user cannot be removed"), "ACL", "DELUSER", "default")
+	admin.Expect(t, redhubtest.ExpectInt(1), "ACL", "DELUSER", "dave", "nobody")
+	if r, err := c.Do("GET", "k"); err == nil {
+		t.Fatalf("GET by a deleted user replied %s, want the connection closed", r)
+	}
+	admin.Expect(t, wrongpass, "AUTH", "dave", "pass")
+}
@@ -0,0 +1,298 @@
+package acl
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/IceFireDB/redhub"
+	"github.com/IceFireDB/redhub/pkg/resp"
+)
+
+// Commands returns the specs of AUTH and ACL, so they can be registered on
+// a redhub.Mux and reported by COMMAND. The ACL serves them itself and
+// never passes them on to the Mux.
+func (a *ACL) Commands() []redhub.CommandSpec {
+	const flags = redhub.FlagNoScript | redhub.FlagLoading | redhub.FlagStale
+	return []redhub.CommandSpec{
+		{Name: "auth", Arity: -2, Flags: flags | redhub.FlagFast | redhub.FlagNoAuth, Handler: a.auth,
+			Categories: []string{"connection"}, Group: "connection", Since: "1.0.0",
+			Summary:    "Authenticates the connection.",
+			Complexity: "O(N) where N is the number of passwords defined for the user"},
+		{Name: "acl", Arity: -2, Flags: redhub.FlagSkipSlowlog, Group: "server", Since: "6.0.0",
+			Summary: "A container for Access List Control commands.", Complexity: "Depends on subcommand.",
+			Subcommands: []redhub.CommandSpec{
+				{Name: "cat", Arity: -2, Flags: flags, Handler: a.aclCat, Group: "server", Since: "6.0.0",
+					Summary:    "Lists the ACL categories, or the commands inside a category.",
+					Complexity: "O(1) since the categories and commands are a fixed set."},
+				{Name: "deluser", Arity: -3, Flags: flags | redhub.FlagAdmin, Handler: a.aclDelUser,
+					Group: "server", Since: "6.0.0", Summary: "Deletes ACL users, and terminates their connections.",
+					Complexity: "O(1) amortized time considering the typical user."},
+				{Name: "genpass", Arity: -2, Flags: flags, Handler: a.aclGenPass, Group: "server", Since: "6.0.0",
+					Summary:    "Generates a pseudorandom, secure password that can be used to identify ACL users.",
+					Complexity: "O(1)"},
+				{Name: "getuser", Arity: 3, Flags: flags | redhub.FlagAdmin, Handler: a.aclGetUser,
+					Group: "server", Since: "6.0.0", Summary: "Lists the ACL rules of a user.",
+					Complexity: "O(N). Where N is the number of password, command and pattern rules that the user has."},
+				{Name: "help", Arity: 2, Flags: redhub.FlagLoading | redhub.FlagStale, Handler: a.aclHelp,
+					Group: "server", Since: "6.0.0", Summary: "Returns helpful text about the different subcommands.",
+					Complexity: "O(1)"},
+				{Name: "list", Arity: 2, Flags: flags | redhub.FlagAdmin, Handler: a.aclList, Group: "server",
+					Since: "6.0.0", Summary: "Dumps the effective rules in ACL file format.",
+					Complexity: "O(N). Where N is the number of configured users."},
+				{Name: "log", Arity: -2, Flags: flags | redhub.FlagAdmin, Handler: a.aclLog, Group: "server",
+					Since: "6.0.0", Summary: "Lists recent security events generated due to ACL rules.",
+					Complexity: "O(N) with N being the number of entries shown."},
+				{Name: "setuser", Arity: -3, Flags: flags | redhub.FlagAdmin, Handler: a.aclSetUser,
+					Group: "server", Since: "6.0.0", Summary: "Creates and modifies an ACL user and its rules.",
+					Complexity: "O(N). Where N is the number of rules provided."},
+				{Name: "users", Arity: 2, Flags: flags | redhub.FlagAdmin, Handler: a.aclUsers, Group: "server",
+					Since: "6.0.0", Summary: "Lists all ACL users.",
+					Complexity: "O(N). Where N is the number of configured users."},
+				{Name: "whoami", Arity: 2, Flags: flags, Handler: a.aclWhoAmI, Group: "server", Since: "6.0.0",
+					Summary: "Returns the authenticated username of the current connection.", Complexity: "O(1)"},
+			},
+		},
+	}
+}
+
+func (a *ACL) aclCat(c redhub.Conn, cmd resp.Command) redhub.Action {
+	if len(cmd.Args) > 3 {
+		c.WriteError("ERR wrong number of arguments for 'acl|cat' command")
+		return redhub.None
+	}
+	if len(cmd.Args) == 2 {
+		c.WriteArray(len(redhub.ACLCategories))
+		for _, cat := range redhub.ACLCategories {
+			c.WriteBulkString(cat)
+		}
+		return redhub.None
+	}
+
+	cat := strings.ToLower(string(cmd.Args[2]))
+	if cat == "all" || !validCategory(cat) {
+		c.WriteError("ERR Unknown category '" + string(cmd.Args[2]) + "'")
+		return redhub.None
+	}
+	var names []string
+	for _, m := range []*redhub.Mux{a.opts.Mux, a.own} {
+		if m == nil {
+			continue
+		}
+		for _, name := range m.Names() {
+			spec := m.LookupName(name)
+			if len(spec.Subcommands) > 0 {
+				continue
+			}
+			for _, got := range spec.ACLCategories() {
+				if got == cat {
+					names = append(names, name)
+					break
+				}
+			}
+		}
+	}
+	sort.Strings(names)
+	names = dedup(names)
+	c.WriteArray(len(names))
+	for _, name := range names {
+		c.WriteBulkString(name)
+	}
+	return redhub.None
+}
+
+func (a *ACL) aclDelUser(c redhub.Conn, cmd resp.Command) redhub.Action {
+	names := make([]string, 0, len(cmd.Args)-2)
+	for _, arg := range cmd.Args[2:] {
+		names = append(names, string(arg))
+	}
+	n, err := a.DelUser(names...)
+	if err != nil {
+		c.WriteError("ERR " + err.Error())
+		return redhub.None
+	}
+	c.WriteInt(n)
+	return redhub.None
+}
+
+func (a *ACL) aclGenPass(c redhub.Conn, cmd resp.Command) redhub.Action {
+	if len(cmd.Args) > 3 {
+		c.WriteError("ERR wrong number of arguments for 'acl|genpass' command")
+		return redhub.None
+	}
+	bits := 256
+	if len(cmd.Args) == 3 {
+		n, err := strconv.Atoi(string(cmd.Args[2]))
+		if err != nil || n <= 0 || n > 4096 {
+			c.WriteError("ERR ACL GENPASS argument must be the number of bits for the output password, " +
+				"a positive number up to 4096")
+			return redhub.None
+		}
+		bits = n
+	}
+	buf := make([]byte, (bits+7)/8)
+	if _, err := rand.Read(buf); err != nil {
+		c.WriteError("ERR " + err.Error())
+		return redhub.None
+	}
+	c.WriteBulkString(hex.EncodeToString(buf)[:(bits+3)/4])
+	return redhub.None
+}
+
+func (a *ACL) aclGetUser(c redhub.Conn, cmd resp.Command) redhub.Action {
+	u := a.user(string(cmd.Args[2]))
+	if u == nil {
+		c.WriteNull()
+		return redhub.None
+	}
+	r := u.load()
+	c.WriteMap(6)
+	c.WriteBulkString("flags")
+	flags := r.flags()
+	c.WriteArray(len(flags))
+	for _, flag := range flags {
+		c.WriteBulkString(flag)
+	}
+	c.WriteBulkString("passwords")
+	c.WriteArray(len(r.passwords))
+	for _, p := range r.passwords {
+		c.WriteBulkString(p)
+	}
+	c.WriteBulkString("commands")
+	c.WriteBulkString(r.describeCommands())
+	c.WriteBulkString("keys")
+	c.WriteBulkString(r.describeKeys())
+	c.WriteBulkString("channels")
+	c.WriteBulkString(r.describeChannels())
+	c.WriteBulkString("selectors")
+	c.WriteArray(0)
+	return redhub.None
+}
+
+func (a *ACL) aclList(c redhub.Conn, cmd resp.Command) redhub.Action {
+	users := a.sortedUsers()
+	c.WriteArray(len(users))
+	for _, u := range users {
+		c.WriteBulkString(u.describe())
+	}
+	return redhub.None
+}
+
+func (a *ACL) aclLog(c redhub.Conn, cmd resp.Command) redhub.Action {
+	count := 10
+	switch len(cmd.Args) {
+	case 2:
+	case 3:
+		if strings.EqualFold(string(cmd.Args[2]), "reset") {
+			a.log.reset()
+			c.WriteString("OK")
+			return redhub.None
+		}
+		n, err := strconv.ParseInt(string(cmd.Args[2]), 10, 64)
+		if err != nil {
+			c.WriteError("ERR value is not an integer or out of range")
+			return redhub.None
+		}
+		if n < 0 {
+			c.WriteError("ERR value is out of range, must be positive")
+			return redhub.None
+		}
+		if n < maxLogEntries {
+			count = int(n)
+		} else {
+			count = maxLogEntries
+		}
+	default:
+		c.WriteError("ERR syntax error")
+		return redhub.None
+	}
+	a.log.write(c, count)
+	return redhub.None
+}
+
+func (a *ACL) aclSetUser(c redhub.Conn, cmd resp.Command) redhub.Action {
+	ops := make([]string, 0, len(cmd.Args)-3)
+	for _, arg := range cmd.Args[3:] {
+		ops = append(ops, string(arg))
+	}
+	if err := a.SetUser(string(cmd.Args[2]), ops...); err != nil {
+		c.WriteError("ERR " + err.Error())
+		return redhub.None
+	}
+	c.WriteString("OK")
+	return redhub.None
+}
+
+func (a *ACL) aclUsers(c redhub.Conn, cmd resp.Command) redhub.Action {
+	users := a.sortedUsers()
+	c.WriteArray(len(users))
+	for _, u := range users {
+		c.WriteBulkString(u.name)
+	}
+	return redhub.None
+}
+
+func (a *ACL) aclWhoAmI(c redhub.Conn, cmd resp.Command) redhub.Action {
+	c.WriteBulkString(a.session(c).user.name)
+	return redhub.None
+}
+
+func (a *ACL) aclHelp(c redhub.Conn, cmd resp.Command) redhub.Action {
+	lines := []string{
+		"ACL <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+		"CAT [<category>]",
+		"    List all commands that belong to <category>, or all command categories",
+		"    when no category is specified.",
+		"DELUSER <username> [<username> ...]",
+		"    Delete a list of users.",
+		"GETUSER <username>",
+		"    Get the user's details.",
+		"GENPASS [<bits>]",
+		"    Generate a secure 256-bit user password. The optional `bits` argument can",
+		"    be used to specify a different size.",
+		"LIST",
+		"    Show users details in config file format.",
+		"LOG [<count> | RESET]",
+		"    Show the ACL log entries.",
+		"SETUSER <username> <attribute> [<attribute> ...]",
+		"    Create or modify a user with the specified attributes.",
+		"USERS",
+		"    List all the registered usernames.",
+		"WHOAMI",
+		"    Return the current connection username.",
+		"HELP",
+		"    Print this help.",
+	}
+	c.WriteArray(len(lines))
+	for _, line := range lines {
+		c.WriteString(line)
+	}
+	return redhub.None
+}
+
+// sortedUsers returns the users ordered by name.
+func (a *ACL) sortedUsers() []*user {
+	a.mu.RLock()
+	users := make([]*user, 0, len(a.users))
+	for _, u := range a.users {
+		users = append(users, u)
+	}
+	a.mu.RUnlock()
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].name < users[j].name
+	})
+	return users
+}
+
+// dedup removes the adjacent duplicates of the sorted names.
+func dedup(names []string) []string {
+	out := names[:0]
+	for _, name := range names {
+		if len(out) == 0 || name != out[len(out)-1] {
+			out = append(out, name)
+		}
+	}
+	return out
+}
@@ -0,0 +1,113 @@
+package acl
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/IceFireDB/redhub"
+)
+
+const (
+	// maxLogEntries is the number of entries ACL LOG keeps, the default of
+	// acllog-max-len in Redis.
+	maxLogEntries = 128
+	// logGroupWindow is how long a denial is counted in an existing entry
+	// for the same reason, object and user rather than in a new one.
+	logGroupWindow = 60 * time.Second
+)
+
+// aclLog records the denied commands and failed authentications reported
+// by ACL LOG.
+type aclLog struct {
+	mu      sync.Mutex
+	entries []*logEntry // newest first
+	nextID  int64
+}
+
+type logEntry struct {
+	count      int
+	reason     string
+	object     string
+	username   string
+	clientInfo string
+	id         int64
+	created    time.Time
+	updated    time.Time
+}
+
+func (l *aclLog) add(c redhub.Conn, reason, object, username string) {
+	now := time.Now()
+	info := fmt.Sprintf("id=%d addr=%s user=%s", c.ID(), c.RemoteAddr(), c.User())
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for i, e := range l.entries {
+		if e.reason == reason && e.object == object && e.username == username &&
+			now.Sub(e.updated) < logGroupWindow {
+			e.count++
+			e.updated = now
+			e.clientInfo = info
+			copy(l.entries[1:i+1], l.entries[:i])
+			l.entries[0] = e
+			return
+		}
+	}
+	e := &logEntry{
+		count:      1,
+		reason:     reason,
+		object:     object,
+		username:   username,
+		clientInfo: info,
+		id:         l.nextID,
+		created:    now,
+		updated:    now,
+	}
+	l.nextID++
+	l.entries = append([]*logEntry{e}, l.entries...)
+	if len(l.entries) > maxLogEntries {
+		l.entries = l.entries[:maxLogEntries]
+	}
+}
+
+func (l *aclLog) reset() {
+	l.mu.Lock()
+	l.entries = nil
+	l.mu.Unlock()
+}
+
+// write writes up to count entries, newest first, as ACL LOG replies.
+func (l *aclLog) write(c redhub.Conn, count int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if count > len(l.entries) {
+		count = len(l.entries)
+	}
+	now := time.Now()
+	c.WriteArray(count)
+	for _, e := range l.entries[:count] {
+		c.WriteMap(10)
+		c.WriteBulkString("count")
+		c.WriteInt(e.count)
+		c.WriteBulkString("reason")
+		c.WriteBulkString(e.reason)
+		c.WriteBulkString("context")
+		c.WriteBulkString("toplevel")
+		c.WriteBulkString("object")
+		c.WriteBulkString(e.object)
+		c.WriteBulkString("username")
+		c.WriteBulkString(e.username)
+		c.WriteBulkString("age-seconds")
+		c.WriteDouble(now.Sub(e.created).Seconds())
+		c.WriteBulkString("client-info")
+		c.WriteBulkString(e.clientInfo)
+		c.WriteBulkString("entry-id")
+		c.WriteInt64(e.id)
+		c.WriteBulkString("timestamp-created")
+		c.WriteInt64(e.created.UnixNano() / int64(time.Millisecond))
+		c.WriteBulkString("timestamp-last-updated")
+		c.WriteInt64(e.updated.UnixNano() / int64(time.Millisecond))
+	}
+}
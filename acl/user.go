@@ -0,0 +1,423 @@
+package acl
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/IceFireDB/redhub"
+	"github.com/IceFireDB/redhub/pkg/glob"
+)
+
+// Errors reported for invalid ACL SETUSER rules, worded as in Redis.
+var (
+	errSyntax         = errors.New("Syntax error")
+	errUnknownCommand = errors.New("Unknown command or category name in ACL")
+	errBadHash        = errors.New("The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+	errNoPassword     = errors.New("The password you are trying to remove from the user does not exist")
+	errAfterAllKeys   = errors.New("Adding a pattern after the * pattern (or the 'allkeys' flag) is not valid and does not have any effect. Try 'resetkeys' to start with an empty list of patterns")
+	errAfterAllChans  = errors.New("Adding a pattern after the * pattern (or the 'allchannels' flag) is not valid and does not have any effect. Try 'resetchannels' to start with an empty list of channels")
+)
+
+// user is an ACL user. ACL SETUSER replaces its rules as a whole, so a
+// command being checked sees either the old or the new rules.
+type user struct {
+	name  string
+	rules atomic.Value // *rules
+	// deleted is set by ACL DELUSER. Connections authenticated as the user
+	// are closed on their next command.
+	deleted int32
+}
+
+func newUser(name string) *user {
+	u := &user{name: name}
+	u.rules.Store(&rules{})
+	return u
+}
+
+func (u *user) load() *rules {
+	return u.rules.Load().(*rules)
+}
+
+func (u *user) isDeleted() bool {
+	return atomic.LoadInt32(&u.deleted) == 1
+}
+
+// rules are the permissions of a user. They are never modified once stored
+// in a user.
+type rules struct {
+	enabled bool
+	nopass  bool
+	// passwords holds the SHA-256 hashes of the passwords, in hex.
+	passwords []string
+	commands  []commandRule
+	keys      []keyPattern
+	channels  []string
+
+	// perms caches the command rules' decision per *redhub.CommandSpec.
+	perms sync.Map
+}
+
+// commandRule is a +command, -command, +@category or -@category rule.
+type commandRule struct {
+	allow    bool
+	category string
+	name     string
+}
+
+// keyPattern is a ~pattern, %R~pattern or %W~pattern rule.
+type keyPattern struct {
+	pattern     string
+	read, write bool
+}
+
+// clone returns a copy of r without the cached decisions.
+func (r *rules) clone() *rules {
+	return &rules{
+		enabled:   r.enabled,
+		nopass:    r.nopass,
+		passwords: append([]string(nil), r.passwords...),
+		commands:  append([]commandRule(nil), r.commands...),
+		keys:      append([]keyPattern(nil), r.keys...),
+		channels:  append([]string(nil), r.channels...),
+	}
+}
+
+// apply applies one ACL SETUSER rule to r. m, when set, is used to reject
+// rules naming unknown commands.
+func (r *rules) apply(m *redhub.Mux, op string) error {
+	if op == "" {
+		return errSyntax
+	}
+	switch op[0] {
+	case '>':
+		r.addPassword(hashPassword(op[1:]))
+		return nil
+	case '<':
+		return r.removePassword(hashPassword(op[1:]))
+	case '#':
+		if !validHash(op[1:]) {
+			return errBadHash
+		}
+		r.addPassword(op[1:])
+		return nil
+	case '!':
+		if !validHash(op[1:]) {
+			return errBadHash
+		}
+		return r.removePassword(op[1:])
+	case '~':
+		return r.addKeys(keyPattern{pattern: op[1:], read: true, write: true})
+	case '%':
+		i := strings.IndexByte(op, '~')
+		if i < 2 {
+			return errSyntax
+		}
+		p := keyPattern{pattern: op[i+1:]}
+		for _, ch := range strings.ToUpper(op[1:i]) {
+			switch ch {
+			case 'R':
+				p.read = true
+			case 'W':
+				p.write = true
+			default:
+				return errSyntax
+			}
+		}
+		return r.addKeys(p)
+	case '&':
+		if r.allChannels() {
+			return errAfterAllChans
+		}
+		if op[1:] == "*" {
+			r.channels = nil
+		}
+		r.channels = append(r.channels, op[1:])
+		return nil
+	case '+', '-':
+		return r.addCommand(m, op[0] == '+', strings.ToLower(op[1:]))
+	}
+
+	switch strings.ToLower(op) {
+	case "on":
+		r.enabled = true
+	case "off":
+		r.enabled = false
+	case "nopass":
+		r.nopass, r.passwords = true, nil
+	case "resetpass":
+		r.nopass, r.passwords = false, nil
+	case "allkeys":
+		r.keys = []keyPattern{{pattern: "*", read: true, write: true}}
+	case "resetkeys":
+		r.keys = nil
+	case "allchannels":
+		r.channels = []string{"*"}
+	case "resetchannels":
+		r.channels = nil
+	case "allcommands":
+		return r.addCommand(m, true, "@all")
+	case "nocommands":
+		return r.addCommand(m, false, "@all")
+	case "reset":
+		r.enabled, r.nopass = false, false
+		r.passwords, r.commands, r.keys, r.channels = nil, nil, nil, nil
+	default:
+		return errSyntax
+	}
+	return nil
+}
+
+func (r *rules) addPassword(hash string) {
+	r.nopass = false
+	for _, p := range r.passwords {
+		if equalHash(p, hash) {
+			return
+		}
+	}
+	r.passwords = append(r.passwords, hash)
+}
+
+func (r *rules) removePassword(hash string) error {
+	for i, p := range r.passwords {
+		if equalHash(p, hash) {
+			r.passwords = append(r.passwords[:i], r.passwords[i+1:]...)
+			return nil
+		}
+	}
+	return errNoPassword
+}
+
+func (r *rules) addKeys(p keyPattern) error {
+	if r.allKeys() {
+		return errAfterAllKeys
+	}
+	if p.pattern == "*" && p.read && p.write {
+		r.keys = nil
+	}
+	r.keys = append(r.keys, p)
+	return nil
+}
+
+func (r *rules) addCommand(m *redhub.Mux, allow bool, name string) error {
+	rule := commandRule{allow: allow}
+	if strings.HasPrefix(name, "@") {
+		rule.category = name[1:]
+		if !validCategory(rule.category) {
+			return errUnknownCommand
+		}
+	} else {
+		if name == "" || (m != nil && m.LookupName(name) == nil) {
+			return errUnknownCommand
+		}
+		rule.name = name
+	}
+	if rule.category == "all" {
+		// +@all and -@all override every previous command rule.
+		r.commands = nil
+		if !allow {
+			return nil
+		}
+	}
+	r.commands = append(r.commands, rule)
+	return nil
+}
+
+// allKeys reports whether every key may be read and written.
+func (r *rules) allKeys() bool {
+	return len(r.keys) == 1 && r.keys[0].pattern == "*" && r.keys[0].read && r.keys[0].write
+}
+
+// allChannels reports whether every channel may be accessed.
+func (r *rules) allChannels() bool {
+	return len(r.channels) == 1 && r.channels[0] == "*"
+}
+
+// allows evaluates the command rules, in order, for a command with its full
+// name, the name of its container for subcommands, and its ACL categories.
+func (r *rules) allows(name, parent string, cats []string) bool {
+	var ok bool
+	for _, rule := range r.commands {
+		var match bool
+		switch {
+		case rule.category == "all":
+			match = true
+		case rule.category != "":
+			for _, cat := range cats {
+				if cat == rule.category {
+					match = true
+					break
+				}
+			}
+		default:
+			match = rule.name == name || rule.name == parent
+		}
+		if match {
+			ok = rule.allow
+		}
+	}
+	return ok
+}
+
+// allowsKey reports whether key may be accessed for reading, writing or
+// both.
+func (r *rules) allowsKey(key string, read, write bool) bool {
+	var canRead, canWrite bool
+	for _, p := range r.keys {
+		if (canRead || !p.read) && (canWrite || !p.write) {
+			continue
+		}
+		if glob.Match(p.pattern, key) {
+			canRead = canRead || p.read
+			canWrite = canWrite || p.write
+		}
+	}
+	return (canRead || !read) && (canWrite || !write)
+}
+
+// allowsChannel reports whether channel may be accessed. A pattern passed
+// to PSUBSCRIBE must match one of the channel patterns literally.
+func (r *rules) allowsChannel(channel string, literal bool) bool {
+	for _, p := range r.channels {
+		if p == "*" || p == channel || (!literal && glob.Match(p, channel)) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPassword reports whether pass is one of the passwords.
+func (r *rules) checkPassword(pass string) bool {
+	if r.nopass {
+		return true
+	}
+	hash := hashPassword(pass)
+	ok := false
+	for _, p := range r.passwords {
+		if equalHash(p, hash) {
+			ok = true
+		}
+	}
+	return ok
+}
+
+// equalHash compares two password hashes in constant time.
+func equalHash(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// flags returns the flags reported by ACL GETUSER.
+func (r *rules) flags() []string {
+	flags := []string{"off"}
+	if r.enabled {
+		flags[0] = "on"
+	}
+	if r.nopass {
+		flags = append(flags, "nopass")
+	}
+	return flags
+}
+
+// describeCommands returns the command rules as ACL LIST reports them.
+func (r *rules) describeCommands() string {
+	var parts []string
+	if len(r.commands) == 0 || r.commands[0].category != "all" {
+		parts = append(parts, "-@all")
+	}
+	for _, rule := range r.commands {
+		s := "-"
+		if rule.allow {
+			s = "+"
+		}
+		if rule.category != "" {
+			s += "@" + rule.category
+		} else {
+			s += rule.name
+		}
+		parts = append(parts, s)
+	}
+	return strings.Join(parts, " ")
+}
+
+// describeKeys returns the key patterns as ACL GETUSER reports them.
+func (r *rules) describeKeys() string {
+	parts := make([]string, 0, len(r.keys))
+	for _, p := range r.keys {
+		switch {
+		case p.read && p.write:
+			parts = append(parts, "~"+p.pattern)
+		case p.read:
+			parts = append(parts, "%R~"+p.pattern)
+		default:
+			parts = append(parts, "%W~"+p.pattern)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// describeChannels returns the channel patterns as ACL GETUSER reports
+// them.
+func (r *rules) describeChannels() string {
+	parts := make([]string, 0, len(r.channels))
+	for _, p := range r.channels {
+		parts = append(parts, "&"+p)
+	}
+	return strings.Join(parts, " ")
+}
+
+// describe returns the rules of u as an ACL LIST line.
+func (u *user) describe() string {
+	r := u.load()
+	parts := []string{"user", u.name}
+	parts = append(parts, r.flags()...)
+	for _, p := range r.passwords {
+		parts = append(parts, "#"+p)
+	}
+	if keys := r.describeKeys(); keys != "" {
+		parts = append(parts, keys)
+	}
+	if !r.allChannels() {
+		parts = append(parts, "resetchannels")
+	}
+	if channels := r.describeChannels(); channels != "" {
+		parts = append(parts, channels)
+	}
+	parts = append(parts, r.describeCommands())
+	return strings.Join(parts, " ")
+}
+
+func hashPassword(pass string) string {
+	sum := sha256.Sum256([]byte(pass))
+	return hex.EncodeToString(sum[:])
+}
+
+func validHash(hash string) bool {
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+	for _, ch := range hash {
+		if (ch < '0' || ch > '9') && (ch < 'a' || ch > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func validCategory(cat string) bool {
+	if cat == "all" {
+		return true
+	}
+	i := sort.SearchStrings(sortedCategories, cat)
+	return i < len(sortedCategories) && sortedCategories[i] == cat
+}
+
+var sortedCategories = func() []string {
+	cats := append([]string(nil), redhub.ACLCategories...)
+	sort.Strings(cats)
+	return cats
+}()
@@ -0,0 +1,181 @@
+package acl
+
+import (
+	"testing"
+
+	"github.com/IceFireDB/redhub"
+	"github.com/IceFireDB/redhub/pkg/resp"
+)
+
+func parse(t *testing.T, m *redhub.Mux, ops ...string) *rules {
+	t.Helper()
+	r := &rules{}
+	for _, op := range ops {
+		if err := r.apply(m, op); err != nil {
+			t.Fatalf("apply(%q): %v", op, err)
+		}
+	}
+	return r
+}
+
+func TestApply(t *testing.T) {
+	m := redhub.NewMux()
+	m.HandleFunc("get", 2, func(c redhub.Conn, cmd resp.Command) redhub.Action { return redhub.None })
+	hash := hashPassword("secret")
+
+	tests := []struct {
+		ops []string
+		err error // of the last op
+	}{
+		{[]string{"on", "off", "nopass", "resetpass", "reset"}, nil},
+		{[]string{"ON", "AllKeys", "AllChannels", "AllCommands", "NoCommands"}, nil},
+		{[]string{">secret", "<secret"}, nil},
+		{[]string{"#" + hash, "!" + hash}, nil},
+		{[]string{"~a*", "%R~b*", "%W~c*", "%RW~d*", "resetkeys", "~*"}, nil},
+		{[]string{"&a*", "resetchannels", "&*"}, nil},
+		{[]string{"+get", "-get", "+@string", "-@all", "+@all"}, nil},
+		{[]string{""}, errSyntax},
+		{[]string{"bogus"}, errSyntax},
+		{[]string{"%~a"}, errSyntax},
+		{[]string{"%X~a"}, errSyntax},
+		{[]string{"#" + hash[1:]}, errBadHash},
+		{[]string{"#" + hash[:63] + "G"}, errBadHash},
+		{[]string{"!nothex"}, errBadHash},
+		{[]string{"<secret"}, errNoPassword},
+		{[]string{">other", "!" + hash}, errNoPassword},
+		{[]string{"~*", "~a"}, errAfterAllKeys},
+		{[]string{"allkeys", "%R~a"}, errAfterAllKeys},
+		{[]string{"&*", "&a"}, errAfterAllChans},
+		{[]string{"allchannels", "&a"}, errAfterAllChans},
+		{[]string{"+nosuch"}, errUnknownCommand},
+		{[]string{"-"}, errUnknownCommand},
+		{[]string{"+@nosuch"}, errUnknownCommand},
+	}
+	for _, tt := range tests {
+		r := &rules{}
+		var err error
+		for _, op := range tt.ops {
+			if err = r.apply(m, op); err != nil {
+				break
+			}
+		}
+		if err != tt.err {
+			t.Errorf("%q: got %v, want %v", tt.ops, err, tt.err)
+		}
+	}
+}
+
+func TestAllows(t *testing.T) {
+	str, admin := []string{"string", "read"}, []string{"admin"}
+	tests := []struct {
+		ops          []string
+		name, parent string
+		cats         []string
+		want         bool
+	}{
+		{nil, "get", "", str, false},
+		{[]string{"+@all"}, "get", "", str, true},
+		{[]string{"allcommands"}, "get", "", str, true},
+		{[]string{"+@all", "-get"}, "get", "", str, false},
+		{[]string{"+@all", "-get", "+get"}, "get", "", str, true},
+		{[]string{"+get", "-@all"}, "get", "", str, false},
+		{[]string{"+@all", "nocommands"}, "get", "", str, false},
+		{[]string{"+@string"}, "get", "", str, true},
+		{[]string{"+@string"}, "config|get", "config", admin, false},
+		{[]string{"+@all", "-@admin"}, "config|get", "config", admin, false},
+		{[]string{"+config"}, "config|get", "config", admin, true},
+		{[]string{"+config", "-config|set"}, "config|set", "config", admin, false},
+		{[]string{"+config", "-config|set"}, "config|get", "config", admin, true},
+	}
+	for _, tt := range tests {
+		r := parse(t, nil, tt.ops...)
+		if got := r.allows(tt.name, tt.parent, tt.cats); got != tt.want {
+			t.Errorf("%q: allows(%q, %q, %q) = %v, want %v", tt.ops, tt.name, tt.parent, tt.cats, got, tt.want)
+		}
+	}
+}
+
+func TestAllowsKey(t *testing.T) {
+	tests := []struct {
+		ops         []string
+		key         string
+		read, write bool
+		want        bool
+	}{
+		{nil, "k", true, false, false},
+		{[]string{"allkeys"}, "k", true, true, true},
+		{[]string{"~user:*"}, "user:1", true, true, true},
+		{[]string{"~user:*"}, "order:1", true, false, false},
+		{[]string{"%R~*"}, "k", true, false, true},
+		{[]string{"%R~*"}, "k", false, true, false},
+		{[]string{"%W~*"}, "k", false, true, true},
+		{[]string{"%W~*"}, "k", true, true, false},
+		// Read and write access may come from different patterns.
+		{[]string{"%R~k*", "%W~*"}, "key", true, true, true},
+		{[]string{"%R~k*", "%W~*"}, "other", true, true, false},
+		{[]string{"~a", "resetkeys"}, "a", true, false, false},
+	}
+	for _, tt := range tests {
+		r := parse(t, nil, tt.ops...)
+		if got := r.allowsKey(tt.key, tt.read, tt.write); got != tt.want {
+			t.Errorf("%q: allowsKey(%q, read %v, write %v) = %v, want %v",
+				tt.ops, tt.key, tt.read, tt.write, got, tt.want)
+		}
+	}
+}
+
+func TestAllowsChannel(t *testing.T) {
+	tests := []struct {
+		ops     []string
+		channel string
+		literal bool
+		want    bool
+	}{
+		{nil, "news", false, false},
+		{[]string{"allchannels"}, "news", false, true},
+		{[]string{"&*"}, "news*", true, true},
+		{[]string{"&news.*"}, "news.sport", false, true},
+		{[]string{"&news.*"}, "weather", false, false},
+		// PSUBSCRIBE patterns must match literally.
+		{[]string{"&news.*"}, "news.*", true, true},
+		{[]string{"&news.*"}, "news.sport", true, false},
+		{[]string{"&news.*"}, "*", true, false},
+	}
+	for _, tt := range tests {
+		r := parse(t, nil, tt.ops...)
+		if got := r.allowsChannel(tt.channel, tt.literal); got != tt.want {
+			t.Errorf("%q: allowsChannel(%q, literal %v) = %v, want %v", tt.ops, tt.channel, tt.literal, got, tt.want)
+		}
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	tests := []struct {
+		ops  []string
+		pass string
+		want bool
+	}{
+		{nil, "", false},
+		{[]string{"nopass"}, "anything", true},
+		{[]string{">one", ">two"}, "one", true},
+		{[]string{">one", ">two"}, "two", true},
+		{[]string{">one", ">two"}, "three", false},
+		{[]string{">one", "<one"}, "one", false},
+		{[]string{"#" + hashPassword("one")}, "one", true},
+		{[]string{"nopass", ">one"}, "other", false},
+		{[]string{">one", "nopass", "resetpass"}, "one", false},
+	}
+	for _, tt := range tests {
+		r := parse(t, nil, tt.ops...)
+		if got := r.checkPassword(tt.pass); got != tt.want {
+			t.Errorf("%q: checkPassword(%q) = %v, want %v", tt.ops, tt.pass, got, tt.want)
+		}
+	}
+}
+
+func TestEqualHash(t *testing.T) {
+	a, b := hashPassword("a"), hashPassword("b")
+	if !equalHash(a, a) || equalHash(a, b) || equalHash(a, a[:32]) || equalHash("", a) {
+		t.Error("equalHash compares hashes wrongly")
+	}
+}
@@ -0,0 +1,583 @@
+package redhub
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IceFireDB/redhub/pkg/resp"
+)
+
+// ClientInfo describes a client connection, as reported by CLIENT LIST.
+type ClientInfo struct {
+	// ID is the unique, monotonically increasing ID of the connection.
+	ID uint64
+	// Addr and LocalAddr are the remote and local addresses.
+	Addr      string
+	LocalAddr string
+	// Listener is the address of the listener the connection was accepted
+	// on, as returned by Conn.Listener.
+	Listener string
+	// Name is the name set with CLIENT SETNAME or HELLO SETNAME.
+	Name string
+	// User is the user the connection is authenticated as.
+	User string
+	// Created is when the connection was opened.
+	Created time.Time
+	// LastCommand is when the connection last ran commands.
+	LastCommand time.Time
+	// Command is the name of the last command run.
+	Command string
+	// QueryBuffer is the number of bytes received but not yet parsed into
+	// a command.
+	QueryBuffer int
+	// OutputBuffer is the number of bytes of out-of-band messages waiting
+	// for a pipeline to finish.
+	OutputBuffer int
+	// Protocol is the protocol version, resp.RESP2 or resp.RESP3.
+	Protocol int
+	// NoEvict and NoTouch are the flags set with CLIENT NO-EVICT and
+	// CLIENT NO-TOUCH.
+	NoEvict bool
+	NoTouch bool
+}
+
+func (c *conn) info() ClientInfo {
+	info := ClientInfo{
+		ID:          c.id,
+		Addr:        c.RemoteAddr(),
+		LocalAddr:   c.laddr,
+		Listener:    c.listener,
+		Created:     c.created,
+		LastCommand: time.Unix(0, atomic.LoadInt64(&c.lastCmd)),
+		QueryBuffer: int(atomic.LoadInt64(&c.qbuf)),
+		Protocol:    int(atomic.LoadInt32(&c.proto)),
+		NoEvict:     c.NoEvict(),
+		NoTouch:     c.NoTouch(),
+	}
+	c.muInfo.Lock()
+	info.Name, info.User, info.Command = c.name, c.user, c.cmd
+	c.muInfo.Unlock()
+	c.muOut.Lock()
+	info.OutputBuffer = len(c.pending)
+	c.muOut.Unlock()
+	return info
+}
+
+// Clients returns the open connections, ordered by ID.
+func (rs *RedHub) Clients() []ClientInfo {
+	conns := rs.openConns()
+	infos := make([]ClientInfo, len(conns))
+	for i, c := range conns {
+		infos[i] = c.info()
+	}
+	return infos
+}
+
+// Kill closes the connection with the given ID. It reports whether the
+// connection was found.
+func (rs *RedHub) Kill(id uint64) bool {
+	for _, c := range rs.openConns() {
+		if c.id == id {
+			_ = c.close()
+			return true
+		}
+	}
+	return false
+}
+
+// openConns returns the connections that haven't been closed, ordered by ID.
+func (rs *RedHub) openConns() []*conn {
+	rs.muClients.RLock()
+	conns := make([]*conn, 0, len(rs.clients))
+	for c := range rs.clients {
+		if !c.isClosed() {
+			conns = append(conns, c)
+		}
+	}
+	rs.muClients.RUnlock()
+	sort.Slice(conns, func(i, j int) bool { return conns[i].id < conns[j].id })
+	return conns
+}
+
+// clientPause is the state of CLIENT PAUSE.
+type clientPause struct {
+	mu    sync.Mutex
+	all   bool
+	until time.Time
+	timer *time.Timer
+	// end is closed when the pause ends. It is nil while not paused.
+	end chan struct{}
+}
+
+// pause pauses clients for d, only their write commands unless all is set.
+// A pause that is already in effect is extended and made stricter, never
+// shortened or relaxed.
+func (rs *RedHub) pause(d time.Duration, all bool) {
+	p := &rs.paused
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	until := time.Now().Add(d)
+	if p.end == nil {
+		p.end = make(chan struct{})
+		p.all = all
+	} else {
+		p.all = p.all || all
+		if until.Before(p.until) {
+			until = p.until
+		}
+		p.timer.Stop()
+	}
+	p.until = until
+	end := p.end
+	p.timer = time.AfterFunc(time.Until(until), func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if p.end == end {
+			p.stop()
+		}
+	})
+}
+
+// unpause ends CLIENT PAUSE.
+func (rs *RedHub) unpause() {
+	p := &rs.paused
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.end != nil {
+		p.timer.Stop()
+		p.stop()
+	}
+}
+
+// stop ends the pause. The caller must hold mu.
+func (p *clientPause) stop() {
+	close(p.end)
+	p.end = nil
+}
+
+// pauseFor returns a channel that is closed when the pause holding the
+// command args ends, or nil when the command may run.
+func (rs *RedHub) pauseFor(args [][]byte) <-chan struct{} {
+	p := &rs.paused
+	p.mu.Lock()
+	end, all := p.end, p.all
+	p.mu.Unlock()
+	if end == nil || all {
+		return end
+	}
+	if m := rs.clientMux; m != nil {
+		if spec := m.Lookup(args); spec != nil && spec.Flags&FlagWrite == 0 {
+			return nil
+		}
+	}
+	return end
+}
+
+// ClientCommand returns the spec of the CLIENT command, serving ID, INFO,
+// LIST, SETNAME, GETNAME, KILL, PAUSE, UNPAUSE, REPLY, NO-EVICT, NO-TOUCH
+// and HELP for the clients of rs. Register it on the Mux:
+//
+//	mux.Handle(rh.ClientCommand(mux))
+//
+// m tells CLIENT PAUSE WRITE which commands write. Commands it doesn't know,
+// or all commands when m is nil, are treated as writes.
+func (rs *RedHub) ClientCommand(m *Mux) CommandSpec {
+	rs.clientMux = m
+	const flags = FlagNoScript | FlagLoading | FlagStale
+	return CommandSpec{
+		Name: "client", Arity: -2, Flags: FlagSkipSlowlog, Group: "connection",
+		Categories: []string{"connection"},
+		Summary:    "A container for client connection commands.", Since: "2.4.0",
+		Complexity: "Depends on subcommand.",
+		Subcommands: []CommandSpec{
+			{Name: "id", Arity: 2, Flags: flags, Handler: rs.clientID, Categories: []string{"connection"},
+				Summary: "Returns the unique client ID of the connection.", Since: "5.0.0",
+				Group: "connection", Complexity: "O(1)"},
+			{Name: "info", Arity: 2, Flags: flags, Handler: rs.clientInfo, Categories: []string{"connection"},
+				Summary: "Returns information about the connection.", Since: "6.2.0",
+				Group: "connection", Complexity: "O(1)"},
+			{Name: "list", Arity: -2, Flags: flags | FlagAdmin, Handler: rs.clientList,
+				Categories: []string{"connection"}, Summary: "Lists open connections.", Since: "2.4.0",
+				Group: "connection", Complexity: "O(N) where N is the number of client connections"},
+			{Name: "setname", Arity: 3, Flags: flags, Handler: rs.clientSetName, Categories: []string{"connection"},
+				Summary: "Sets the connection name.", Since: "2.6.9",
+				Group: "connection", Complexity: "O(1)"},
+			{Name: "getname", Arity: 2, Flags: flags, Handler: rs.clientGetName, Categories: []string{"connection"},
+				Summary: "Returns the name of the connection.", Since: "2.6.9",
+				Group: "connection", Complexity: "O(1)"},
+			{Name: "kill", Arity: -3, Flags: flags | FlagAdmin, Handler: rs.clientKill,
+				Categories: []string{"connection"}, Summary: "Terminates open connections.", Since: "2.4.0",
+				Group: "connection", Complexity: "O(N) where N is the number of client connections"},
+			{Name: "pause", Arity: -3, Flags: flags | FlagAdmin, Handler: rs.clientPause,
+				Categories: []string{"connection"}, Summary: "Suspends commands processing.", Since: "3.0.0",
+				Group: "connection", Complexity: "O(1)"},
+			{Name: "unpause", Arity: 2, Flags: flags | FlagAdmin, Handler: rs.clientUnpause,
+				Categories: []string{"connection"}, Summary: "Resumes processing commands from paused clients.",
+				Since: "6.2.0", Group: "connection", Complexity: "O(N) Where N is the number of paused clients"},
+			{Name: "reply", Arity: 3, Flags: flags, Handler: rs.clientReply, Categories: []string{"connection"},
+				Summary: "Instructs the server whether to reply to commands.", Since: "3.2.0",
+				Group: "connection", Complexity: "O(1)"},
+			{Name: "no-evict", Arity: 3, Flags: flags | FlagAdmin, Handler: rs.clientNoEvict,
+				Categories: []string{"connection"}, Summary: "Sets the client eviction mode of the connection.",
+				Since: "7.0.0", Group: "connection", Complexity: "O(1)"},
+			{Name: "no-touch", Arity: 3, Flags: flags | FlagFast, Handler: rs.clientNoTouch,
+				Categories: []string{"connection"},
+				Summary:    "Controls whether commands sent by the client affect the LRU/LFU of accessed keys.",
+				Since:      "7.2.0", Group: "connection", Complexity: "O(1)"},
+			{Name: "help", Arity: 2, Flags: FlagLoading | FlagStale, Handler: rs.clientHelp,
+				Categories: []string{"connection"}, Summary: "Returns helpful text about the different subcommands.",
+				Since: "5.0.0", Group: "connection", Complexity: "O(1)"},
+		},
+	}
+}
+
+func (rs *RedHub) clientID(c Conn, cmd resp.Command) Action {
+	c.WriteUint64(c.ID())
+	return None
+}
+
+func (rs *RedHub) clientInfo(c Conn, cmd resp.Command) Action {
+	cc, ok := c.(*conn)
+	if !ok {
+		c.WriteError("ERR no client info available")
+		return None
+	}
+	c.WriteVerbatim("txt", string(appendClientInfo(nil, cc.info())))
+	return None
+}
+
+func (rs *RedHub) clientList(c Conn, cmd resp.Command) Action {
+	var ids map[uint64]bool
+	args := cmd.Args[2:]
+	for len(args) > 0 {
+		switch strings.ToLower(string(args[0])) {
+		case "type":
+			if len(args) < 2 {
+				c.WriteError("ERR syntax error")
+				return None
+			}
+			switch strings.ToLower(string(args[1])) {
+			case "normal":
+			case "master", "replica", "slave", "pubsub":
+				// redhub only serves normal clients.
+				ids = map[uint64]bool{}
+			default:
+				c.WriteError("ERR Unknown client type '" + string(args[1]) + "'")
+				return None
+			}
+			args = args[2:]
+		case "id":
+			if len(args) < 2 {
+				c.WriteError("ERR syntax error")
+				return None
+			}
+			ids = map[uint64]bool{}
+			for _, arg := range args[1:] {
+				id, err := strconv.ParseUint(string(arg), 10, 64)
+				if err != nil || id == 0 {
+					c.WriteError("ERR Invalid client ID")
+					return None
+				}
+				ids[id] = true
+			}
+			args = nil
+		default:
+			c.WriteError("ERR syntax error")
+			return None
+		}
+	}
+
+	var b []byte
+	for _, info := range rs.Clients() {
+		if ids == nil || ids[info.ID] {
+			b = appendClientInfo(b, info)
+		}
+	}
+	c.WriteVerbatim("txt", string(b))
+	return None
+}
+
+// appendClientInfo appends the CLIENT LIST line describing info.
+func appendClientInfo(b []byte, info ClientInfo) []byte {
+	now := time.Now()
+	b = append(b, "id="...)
+	b = strconv.AppendUint(b, info.ID, 10)
+	b = append(b, " addr="...)
+	b = append(b, info.Addr...)
+	b = append(b, " laddr="...)
+	b = append(b, info.LocalAddr...)
+	b = append(b, " name="...)
+	b = append(b, info.Name...)
+	b = append(b, " age="...)
+	b = strconv.AppendInt(b, int64(now.Sub(info.Created)/time.Second), 10)
+	b = append(b, " idle="...)
+	b = strconv.AppendInt(b, int64(now.Sub(info.LastCommand)/time.Second), 10)
+	b = append(b, " flags="...)
+	switch {
+	case info.NoEvict && info.NoTouch:
+		b = append(b, "eT"...)
+	case info.NoEvict:
+		b = append(b, 'e')
+	case info.NoTouch:
+		b = append(b, 'T')
+	default:
+		b = append(b, 'N')
+	}
+	b = append(b, " db=0 qbuf="...)
+	b = strconv.AppendInt(b, int64(info.QueryBuffer), 10)
+	b = append(b, " omem="...)
+	b = strconv.AppendInt(b, int64(info.OutputBuffer), 10)
+	b = append(b, " cmd="...)
+	b = append(b, info.Command...)
+	b = append(b, " user="...)
+	b = append(b, info.User...)
+	b = append(b, " resp="...)
+	b = strconv.AppendInt(b, int64(info.Protocol), 10)
+	return append(b, '\n')
+}
+
+func (rs *RedHub) clientSetName(c Conn, cmd resp.Command) Action {
+	if !validClientName(cmd.Args[2]) {
+		c.WriteError("ERR Client names cannot contain spaces, newlines or special characters.")
+		return None
+	}
+	if cc, ok := c.(*conn); ok {
+		cc.setName(string(cmd.Args[2]))
+	}
+	c.WriteString("OK")
+	return None
+}
+
+func (rs *RedHub) clientGetName(c Conn, cmd resp.Command) Action {
+	cc, ok := c.(*conn)
+	if !ok {
+		c.WriteNull()
+		return None
+	}
+	cc.muInfo.Lock()
+	name := cc.name
+	cc.muInfo.Unlock()
+	if name == "" {
+		c.WriteNull()
+	} else {
+		c.WriteBulkString(name)
+	}
+	return None
+}
+
+func (rs *RedHub) clientKill(c Conn, cmd resp.Command) Action {
+	args := cmd.Args[2:]
+
+	// The old form, CLIENT KILL addr:port, replies OK or an error.
+	if len(args) == 1 {
+		for _, target := range rs.openConns() {
+			if target.RemoteAddr() != string(args[0]) {
+				continue
+			}
+			c.WriteString("OK")
+			if target.id == c.ID() {
+				return Close
+			}
+			_ = target.close()
+			return None
+		}
+		c.WriteError("ERR No such client")
+		return None
+	}
+
+	var (
+		id                uint64
+		addr, laddr, user string
+		skipMe            = true
+	)
+	if len(args)%2 != 0 {
+		c.WriteError("ERR syntax error")
+		return None
+	}
+	for i := 0; i < len(args); i += 2 {
+		val := string(args[i+1])
+		switch strings.ToLower(string(args[i])) {
+		case "id":
+			n, err := strconv.ParseUint(val, 10, 64)
+			if err != nil || n == 0 {
+				c.WriteError("ERR client-id should be greater than 0")
+				return None
+			}
+			id = n
+		case "addr":
+			addr = val
+		case "laddr":
+			laddr = val
+		case "user":
+			user = val
+		case "skipme":
+			switch strings.ToLower(val) {
+			case "yes":
+				skipMe = true
+			case "no":
+				skipMe = false
+			default:
+				c.WriteError("ERR syntax error")
+				return None
+			}
+		default:
+			c.WriteError("ERR syntax error")
+			return None
+		}
+	}
+
+	var killed int
+	var self bool
+	for _, target := range rs.openConns() {
+		if id != 0 && target.id != id {
+			continue
+		}
+		info := target.info()
+		if (addr != "" && info.Addr != addr) || (laddr != "" && info.LocalAddr != laddr) ||
+			(user != "" && info.User != user) {
+			continue
+		}
+		if target.id == c.ID() {
+			if skipMe {
+				continue
+			}
+			self = true
+		} else {
+			_ = target.close()
+		}
+		killed++
+	}
+	c.WriteInt(killed)
+	if self {
+		return Close
+	}
+	return None
+}
+
+func (rs *RedHub) clientPause(c Conn, cmd resp.Command) Action {
+	ms, err := strconv.ParseInt(string(cmd.Args[2]), 10, 64)
+	if err != nil || ms < 0 {
+		c.WriteError("ERR timeout is not an integer or out of range")
+		return None
+	}
+	all := true
+	if len(cmd.Args) > 3 {
+		if len(cmd.Args) > 4 {
+			c.WriteError("ERR syntax error")
+			return None
+		}
+		switch strings.ToLower(string(cmd.Args[3])) {
+		case "all":
+		case "write":
+			all = false
+		default:
+			c.WriteError("ERR syntax error")
+			return None
+		}
+	}
+	rs.pause(time.Duration(ms)*time.Millisecond, all)
+	c.WriteString("OK")
+	return None
+}
+
+func (rs *RedHub) clientUnpause(c Conn, cmd resp.Command) Action {
+	rs.unpause()
+	c.WriteString("OK")
+	return None
+}
+
+func (rs *RedHub) clientReply(c Conn, cmd resp.Command) Action {
+	mode := strings.ToLower(string(cmd.Args[2]))
+	if mode != "on" && mode != "off" && mode != "skip" {
+		c.WriteError("ERR syntax error")
+		return None
+	}
+	if cc, ok := c.(*conn); ok {
+		cc.setReplyMode(mode)
+	}
+	c.WriteString("OK")
+	return None
+}
+
+func (rs *RedHub) clientNoEvict(c Conn, cmd resp.Command) Action {
+	return setClientFlag(c, cmd, func(cc *conn) *int32 { return &cc.noEvict })
+}
+
+func (rs *RedHub) clientNoTouch(c Conn, cmd resp.Command) Action {
+	return setClientFlag(c, cmd, func(cc *conn) *int32 { return &cc.noTouch })
+}
+
+// setClientFlag turns the flag of c selected by field on or off, as given by
+// the last argument of cmd.
+func setClientFlag(c Conn, cmd resp.Command, field func(cc *conn) *int32) Action {
+	var v int32
+	switch strings.ToLower(string(cmd.Args[2])) {
+	case "on":
+		v = 1
+	case "off":
+	default:
+		c.WriteError("ERR syntax error")
+		return None
+	}
+	if cc, ok := c.(*conn); ok {
+		atomic.StoreInt32(field(cc), v)
+	}
+	c.WriteString("OK")
+	return None
+}
+
+func (rs *RedHub) clientHelp(c Conn, cmd resp.Command) Action {
+	lines := []string{
+		"CLIENT <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+		"GETNAME",
+		"    Return the name of the current connection.",
+		"ID",
+		"    Return the ID of the current connection.",
+		"INFO",
+		"    Return information about the current client connection.",
+		"KILL <ip:port>",
+		"    Kill connection made from <ip:port>.",
+		"KILL <option> <value> [<option> <value> [...]]",
+		"    Kill connections. Options are:",
+		"    * ADDR (<ip:port>|<unixsocket>:0)",
+		"      Kill connections made from the specified address",
+		"    * LADDR (<ip:port>|<unixsocket>:0)",
+		"      Kill connections made to specified local address",
+		"    * USER <username>",
+		"      Kill connections authenticated by <username>.",
+		"    * ID <client-id>",
+		"      Kill connections by client id.",
+		"    * SKIPME (YES|NO)",
+		"      Skip killing current connection (default: yes).",
+		"LIST [options ...]",
+		"    Return information about client connections. Options:",
+		"    * TYPE (NORMAL|MASTER|REPLICA|PUBSUB)",
+		"      Return clients of specified type.",
+		"    * ID <client-id> [<client-id> ...]",
+		"      Return clients of specified IDs only.",
+		"NO-EVICT (ON|OFF)",
+		"    Protect current client connection from eviction.",
+		"NO-TOUCH (ON|OFF)",
+		"    Will not touch LRU/LFU stats when this mode is on.",
+		"PAUSE <timeout> [WRITE|ALL]",
+		"    Suspend all, or just write, clients for <timeout> milliseconds.",
+		"UNPAUSE",
+		"    Stop the current client pause, resuming traffic.",
+		"REPLY (ON|OFF|SKIP)",
+		"    Control the replies sent to the current connection.",
+		"SETNAME <name>",
+		"    Assign the name <name> to the current connection.",
+		"HELP",
+		"    Print this help.",
+	}
+	c.WriteArray(len(lines))
+	for _, line := range lines {
+		c.WriteString(line)
+	}
+	return None
+}
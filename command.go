@@ -0,0 +1,495 @@
+package redhub
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/IceFireDB/redhub/pkg/glob"
+	"github.com/IceFireDB/redhub/pkg/resp"
+)
+
+// flagNames are the names COMMAND reports for each CommandFlag, in flag
+// order.
+var flagNames = []string{
+	"write", "readonly", "denyoom", "admin", "pubsub", "noscript", "blocking",
+	"loading", "stale", "skip_monitor", "skip_slowlog", "fast", "no_auth", "no_multi",
+}
+
+// Names returns the names of the flags set in f, as reported by COMMAND.
+func (f CommandFlag) Names() []string {
+	var names []string
+	for i, name := range flagNames {
+		if f&(1<<uint(i)) != 0 {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// ACLCategories lists the ACL command categories known to Redis, in the
+// order Redis reports them.
+var ACLCategories = []string{
+	"keyspace", "read", "write", "set", "sortedset", "list", "hash", "string",
+	"bitmap", "hyperloglog", "geo", "stream", "pubsub", "admin", "fast", "slow",
+	"blocking", "dangerous", "connection", "transaction", "scripting",
+}
+
+// ACLCategories returns the ACL categories of the command, without the
+// leading '@': the ones implied by its flags followed by the ones listed in
+// Categories.
+func (s *CommandSpec) ACLCategories() []string {
+	has := make(map[string]bool, len(s.Categories)+4)
+	for _, cat := range s.Categories {
+		has[strings.ToLower(cat)] = true
+	}
+	if s.Flags&FlagWrite != 0 {
+		has["write"] = true
+	}
+	if s.Flags&FlagReadOnly != 0 {
+		has["read"] = true
+	}
+	if s.Flags&FlagAdmin != 0 {
+		has["admin"] = true
+		has["dangerous"] = true
+	}
+	if s.Flags&FlagPubSub != 0 {
+		has["pubsub"] = true
+	}
+	if s.Flags&FlagFast != 0 {
+		has["fast"] = true
+	}
+	if s.Flags&FlagBlocking != 0 {
+		has["blocking"] = true
+	}
+	if !has["fast"] {
+		has["slow"] = true
+	}
+
+	var cats []string
+	for _, cat := range ACLCategories {
+		if has[cat] {
+			cats = append(cats, cat)
+			delete(has, cat)
+		}
+	}
+	var extra []string
+	for cat := range has {
+		extra = append(extra, cat)
+	}
+	sort.Strings(extra)
+	return append(cats, extra...)
+}
+
+// HasKeys reports whether the command takes key arguments.
+func (s *CommandSpec) HasKeys() bool {
+	return s.FirstKey > 0
+}
+
+// Keys returns the key arguments of args, a full command line including the
+// command name, according to the spec's key positions.
+func (s *CommandSpec) Keys(args [][]byte) [][]byte {
+	if s.FirstKey <= 0 || s.FirstKey >= len(args) {
+		return nil
+	}
+	last := s.LastKey
+	if last < 0 {
+		last += len(args)
+	}
+	if last >= len(args) {
+		last = len(args) - 1
+	}
+	step := s.KeyStep
+	if step <= 0 {
+		step = 1
+	}
+	var keys [][]byte
+	for i := s.FirstKey; i <= last; i += step {
+		keys = append(keys, args[i])
+	}
+	return keys
+}
+
+// sorted returns the registered commands ordered by name.
+func (m *Mux) sorted() []*muxCommand {
+	cmds := make([]*muxCommand, 0, len(m.commands))
+	for _, cmd := range m.commands {
+		cmds = append(cmds, cmd)
+	}
+	sortCommands(cmds)
+	return cmds
+}
+
+func (mc *muxCommand) sortedSubs() []*muxCommand {
+	subs := make([]*muxCommand, 0, len(mc.subs))
+	for _, sub := range mc.subs {
+		subs = append(subs, sub)
+	}
+	sortCommands(subs)
+	return subs
+}
+
+func sortCommands(cmds []*muxCommand) {
+	sort.Slice(cmds, func(i, j int) bool {
+		return cmds[i].fullName < cmds[j].fullName
+	})
+}
+
+// commandSpec returns the spec of the built-in COMMAND command.
+func (m *Mux) commandSpec() CommandSpec {
+	return CommandSpec{
+		Name:       "command",
+		Arity:      -1,
+		Flags:      FlagLoading | FlagStale,
+		Categories: []string{"connection"},
+		Summary:    "Returns detailed information about all commands.",
+		Since:      "2.8.13",
+		Group:      "server",
+		Complexity: "O(N) where N is the total number of Redis commands",
+		Handler:    m.commandAll,
+		Subcommands: []CommandSpec{
+			{Name: "count", Arity: 2, Flags: FlagLoading | FlagStale, Categories: []string{"connection"},
+				Summary: "Returns a count of commands.", Since: "2.8.13", Group: "server",
+				Complexity: "O(1)", Handler: m.commandCount},
+			{Name: "docs", Arity: -2, Flags: FlagLoading | FlagStale, Categories: []string{"connection"},
+				Summary: "Returns documentary information about one, multiple or all commands.", Since: "7.0.0",
+				Group: "server", Complexity: "O(N) where N is the number of commands to look up",
+				Handler: m.commandDocs},
+			{Name: "getkeys", Arity: -3, Flags: FlagLoading | FlagStale, Categories: []string{"connection"},
+				Summary: "Extracts the key names from an arbitrary command.", Since: "2.8.13", Group: "server",
+				Complexity: "O(N) where N is the number of arguments to the command", Handler: m.commandGetKeys},
+			{Name: "getkeysandflags", Arity: -3, Flags: FlagLoading | FlagStale, Categories: []string{"connection"},
+				Summary: "Extracts the key names and access flags for an arbitrary command.", Since: "7.0.0",
+				Group: "server", Complexity: "O(N) where N is the number of arguments to the command",
+				Handler: m.commandGetKeys},
+			{Name: "help", Arity: 2, Flags: FlagLoading | FlagStale, Categories: []string{"connection"},
+				Summary: "Returns helpful text about the different subcommands.", Since: "5.0.0", Group: "server",
+				Complexity: "O(1)", Handler: m.commandHelp},
+			{Name: "info", Arity: -2, Flags: FlagLoading | FlagStale, Categories: []string{"connection"},
+				Summary: "Returns information about one, multiple or all commands.", Since: "2.8.13", Group: "server",
+				Complexity: "O(N) where N is the number of commands to look up", Handler: m.commandInfo},
+			{Name: "list", Arity: -2, Flags: FlagLoading | FlagStale, Categories: []string{"connection"},
+				Summary: "Returns a list of command names.", Since: "7.0.0", Group: "server",
+				Complexity: "O(N) where N is the total number of Redis commands", Handler: m.commandList},
+		},
+	}
+}
+
+func (m *Mux) commandAll(c Conn, cmd resp.Command) Action {
+	cmds := m.sorted()
+	c.WriteArray(len(cmds))
+	for _, mc := range cmds {
+		writeCommandInfo(c, mc)
+	}
+	return None
+}
+
+func (m *Mux) commandCount(c Conn, cmd resp.Command) Action {
+	c.WriteInt(len(m.commands))
+	return None
+}
+
+func (m *Mux) commandInfo(c Conn, cmd resp.Command) Action {
+	if len(cmd.Args) == 2 {
+		return m.commandAll(c, cmd)
+	}
+	c.WriteArray(len(cmd.Args) - 2)
+	for _, name := range cmd.Args[2:] {
+		mc := m.byFullName(string(name))
+		if mc == nil {
+			c.WriteNull()
+			continue
+		}
+		writeCommandInfo(c, mc)
+	}
+	return None
+}
+
+func (m *Mux) commandDocs(c Conn, cmd resp.Command) Action {
+	var cmds []*muxCommand
+	if len(cmd.Args) == 2 {
+		cmds = m.sorted()
+	} else {
+		for _, name := range cmd.Args[2:] {
+			if mc := m.byFullName(string(name)); mc != nil {
+				cmds = append(cmds, mc)
+			}
+		}
+	}
+	c.WriteMap(len(cmds))
+	for _, mc := range cmds {
+		c.WriteBulkString(mc.fullName)
+		writeCommandDocs(c, mc)
+	}
+	return None
+}
+
+func (m *Mux) commandList(c Conn, cmd resp.Command) Action {
+	filter := func(mc *muxCommand) bool { return true }
+	switch {
+	case len(cmd.Args) == 2:
+	case len(cmd.Args) == 5 && strings.EqualFold(string(cmd.Args[2]), "filterby"):
+		arg := string(cmd.Args[4])
+		switch strings.ToLower(string(cmd.Args[3])) {
+		case "module":
+			// no commands come from modules
+			filter = func(mc *muxCommand) bool { return false }
+		case "aclcat":
+			arg = strings.ToLower(arg)
+			filter = func(mc *muxCommand) bool {
+				for _, cat := range mc.ACLCategories() {
+					if cat == arg {
+						return true
+					}
+				}
+				return false
+			}
+		case "pattern":
+			arg = strings.ToLower(arg)
+			filter = func(mc *muxCommand) bool { return glob.Match(arg, mc.fullName) }
+		default:
+			c.WriteError("ERR syntax error")
+			return None
+		}
+	default:
+		c.WriteError("ERR syntax error")
+		return None
+	}
+
+	var names []string
+	for _, mc := range m.sorted() {
+		if filter(mc) {
+			names = append(names, mc.fullName)
+		}
+		for _, sub := range mc.sortedSubs() {
+			if filter(sub) {
+				names = append(names, sub.fullName)
+			}
+		}
+	}
+	c.WriteArray(len(names))
+	for _, name := range names {
+		c.WriteBulkString(name)
+	}
+	return None
+}
+
+func (m *Mux) commandGetKeys(c Conn, cmd resp.Command) Action {
+	withFlags := strings.EqualFold(string(cmd.Args[1]), "getkeysandflags")
+	args := cmd.Args[2:]
+	mc := m.lookup(args)
+	switch {
+	case mc == nil || (mc.subs != nil && len(args) > 1):
+		c.WriteError("ERR Invalid command specified")
+		return None
+	case !mc.HasKeys():
+		c.WriteError("ERR The command has no key arguments")
+		return None
+	case !mc.arityOK(len(args)):
+		c.WriteError("ERR Invalid number of arguments specified for command")
+		return None
+	}
+
+	keys := mc.Keys(args)
+	if len(keys) == 0 {
+		c.WriteError("ERR Invalid arguments specified for command")
+		return None
+	}
+	c.WriteArray(len(keys))
+	for _, key := range keys {
+		if !withFlags {
+			c.WriteBulk(key)
+			continue
+		}
+		flags := keySpecFlags(mc.Flags)
+		c.WriteArray(2)
+		c.WriteBulk(key)
+		c.WriteArray(len(flags))
+		for _, flag := range flags {
+			c.WriteString(flag)
+		}
+	}
+	return None
+}
+
+func (m *Mux) commandHelp(c Conn, cmd resp.Command) Action {
+	lines := []string{
+		"COMMAND <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+		"(no subcommand)",
+		"    Return details about all Redis commands.",
+		"COUNT",
+		"    Return the total number of commands in this Redis server.",
+		"LIST",
+		"    Return a list of all commands in this Redis server.",
+		"INFO [<command-name> ...]",
+		"    Return details about multiple Redis commands.",
+		"    If no command names are given, documentation details for all",
+		"    commands are returned.",
+		"DOCS [<command-name> ...]",
+		"    Return documentation details about multiple Redis commands.",
+		"    If no command names are given, documentation details for all",
+		"    commands are returned.",
+		"GETKEYS <full-command>",
+		"    Return the keys from a full Redis command.",
+		"GETKEYSANDFLAGS <full-command>",
+		"    Return the keys and the access flags from a full Redis command.",
+		"HELP",
+		"    Print this help.",
+	}
+	c.WriteArray(len(lines))
+	for _, line := range lines {
+		c.WriteString(line)
+	}
+	return None
+}
+
+// byFullName looks up a command by its name as reported by COMMAND, which is
+// "parent|sub" for subcommands.
+func (m *Mux) byFullName(name string) *muxCommand {
+	name = strings.ToLower(name)
+	parent, sub := name, ""
+	if i := strings.IndexByte(name, '|'); i >= 0 {
+		parent, sub = name[:i], name[i+1:]
+	}
+	mc := m.commands[parent]
+	if mc == nil || sub == "" {
+		return mc
+	}
+	return mc.subs[sub]
+}
+
+// keySpecFlags returns the key specification flags reported for the keys of
+// a command with the given flags.
+func keySpecFlags(f CommandFlag) []string {
+	switch {
+	case f&FlagWrite != 0:
+		return []string{"RW", "update"}
+	default:
+		return []string{"RO", "access"}
+	}
+}
+
+// writeCommandInfo writes the COMMAND INFO reply of a command, the ten
+// element array Redis 7 replies with.
+func writeCommandInfo(c Conn, mc *muxCommand) {
+	c.WriteArray(10)
+	c.WriteBulkString(mc.fullName)
+	c.WriteInt(mc.Arity)
+
+	flags := mc.Flags.Names()
+	c.WriteSet(len(flags))
+	for _, flag := range flags {
+		c.WriteString(flag)
+	}
+
+	c.WriteInt(mc.FirstKey)
+	c.WriteInt(mc.LastKey)
+	c.WriteInt(mc.KeyStep)
+
+	cats := mc.ACLCategories()
+	c.WriteSet(len(cats))
+	for _, cat := range cats {
+		c.WriteString("@" + cat)
+	}
+
+	// tips
+	c.WriteSet(0)
+
+	if mc.HasKeys() {
+		c.WriteArray(1)
+		writeKeySpec(c, mc)
+	} else {
+		c.WriteArray(0)
+	}
+
+	subs := mc.sortedSubs()
+	c.WriteArray(len(subs))
+	for _, sub := range subs {
+		writeCommandInfo(c, sub)
+	}
+}
+
+// writeKeySpec writes the key specification derived from the legacy
+// first/last/step key positions.
+func writeKeySpec(c Conn, mc *muxCommand) {
+	lastKey := mc.LastKey
+	if lastKey >= 0 {
+		lastKey -= mc.FirstKey
+	}
+	step := mc.KeyStep
+	if step <= 0 {
+		step = 1
+	}
+
+	c.WriteMap(3)
+	c.WriteBulkString("flags")
+	flags := keySpecFlags(mc.Flags)
+	c.WriteSet(len(flags))
+	for _, flag := range flags {
+		c.WriteString(flag)
+	}
+
+	c.WriteBulkString("begin_search")
+	c.WriteMap(2)
+	c.WriteBulkString("type")
+	c.WriteBulkString("index")
+	c.WriteBulkString("spec")
+	c.WriteMap(1)
+	c.WriteBulkString("index")
+	c.WriteInt(mc.FirstKey)
+
+	c.WriteBulkString("find_keys")
+	c.WriteMap(2)
+	c.WriteBulkString("type")
+	c.WriteBulkString("range")
+	c.WriteBulkString("spec")
+	c.WriteMap(3)
+	c.WriteBulkString("lastkey")
+	c.WriteInt(lastKey)
+	c.WriteBulkString("keystep")
+	c.WriteInt(step)
+	c.WriteBulkString("limit")
+	c.WriteInt(0)
+}
+
+// writeCommandDocs writes the COMMAND DOCS map of a command.
+func writeCommandDocs(c Conn, mc *muxCommand) {
+	group := mc.Group
+	if group == "" {
+		group = "generic"
+	}
+
+	n := 1
+	for _, field := range []string{mc.Summary, mc.Since, mc.Complexity} {
+		if field != "" {
+			n++
+		}
+	}
+	if mc.subs != nil {
+		n++
+	}
+
+	c.WriteMap(n)
+	if mc.Summary != "" {
+		c.WriteBulkString("summary")
+		c.WriteBulkString(mc.Summary)
+	}
+	if mc.Since != "" {
+		c.WriteBulkString("since")
+		c.WriteBulkString(mc.Since)
+	}
+	c.WriteBulkString("group")
+	c.WriteBulkString(group)
+	if mc.Complexity != "" {
+		c.WriteBulkString("complexity")
+		c.WriteBulkString(mc.Complexity)
+	}
+	if mc.subs != nil {
+		subs := mc.sortedSubs()
+		c.WriteBulkString("subcommands")
+		c.WriteMap(len(subs))
+		for _, sub := range subs {
+			c.WriteBulkString(sub.fullName)
+			writeCommandDocs(c, sub)
+		}
+	}
+}
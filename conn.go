@@ -2,10 +2,13 @@ package redhub
 
 import (
 	"context"
+	"crypto/tls"
 	"github.com/IceFireDB/redhub/pkg/resp"
 	gnet "github.com/panjf2000/gnet/v2"
 	"github.com/panjf2000/gnet/v2/pkg/pool/byteslice"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -39,6 +42,30 @@ type Conn interface {
 	WriteArray(count int)
 	// WriteNull writes a null to the client
 	WriteNull()
+	// WriteNullArray writes a null array to the client.
+	WriteNullArray()
+	// WriteMap writes a RESP3 map header. You must then write count
+	// key/value pairs to complete the response.
+	WriteMap(count int)
+	// WriteSet writes a RESP3 set header. You must then write count
+	// additional sub-responses to complete the response.
+	WriteSet(count int)
+	// WritePush writes a RESP3 push header as part of a reply. You must then
+	// write count additional sub-responses to complete the message.
+	WritePush(count int)
+	// WriteAttribute writes a RESP3 attribute header. You must then write
+	// count key/value pairs followed by the reply the attribute describes.
+	WriteAttribute(count int)
+	// WriteDouble writes a RESP3 double to the client.
+	WriteDouble(f float64)
+	// WriteBool writes a RESP3 boolean to the client.
+	WriteBool(t bool)
+	// WriteBigNumber writes a RESP3 big number, given as a decimal string,
+	// to the client.
+	WriteBigNumber(num string)
+	// WriteVerbatim writes a RESP3 verbatim string to the client. The format
+	// is a three character type hint such as "txt" or "mkd".
+	WriteVerbatim(format string, str string)
 	// WriteRaw writes raw data to the client.
 	WriteRaw(data []byte)
 	// WriteAny writes any type to the client.
@@ -53,7 +80,64 @@ type Conn interface {
 	//   SimpleString    -> string
 	//   SimpleInt       -> integer
 	//   everything-else -> bulk-string representation using fmt.Sprint()
+	// When RESP3 is active, nil, bools, floats and maps use their RESP3 types.
 	WriteAny(any interface{})
+	// Protocol returns the protocol version used on the connection,
+	// resp.RESP2 or resp.RESP3.
+	Protocol() int
+	// SetProtocol sets the protocol version used to encode replies.
+	SetProtocol(proto int)
+	// Push sends an out-of-band message made of values, encoded as with
+	// WriteAny, to the client. It is safe to call from any goroutine. RESP3
+	// clients receive a push frame and RESP2 clients an array.
+	// A message pushed while the connection is running a pipeline is sent
+	// after that pipeline's replies. A client that falls 64MB behind is
+	// disconnected.
+	Push(values ...interface{})
+	// AsyncWrite sends raw data to the client outside of a handler call. It
+	// is safe to call from any goroutine and orders with pipelined replies
+	// the same way Push does.
+	AsyncWrite(data []byte)
+	// Replying reports whether the reply of the command being served is sent
+	// to the client. It is false after CLIENT REPLY OFF or SKIP, and handlers
+	// may skip building expensive replies that would be dropped.
+	Replying() bool
+	// NoEvict and NoTouch report the flags set with CLIENT NO-EVICT and
+	// CLIENT NO-TOUCH, for storage layers that evict keys or track their
+	// access time.
+	NoEvict() bool
+	NoTouch() bool
+	// ID returns the unique ID of the connection, as reported by CLIENT ID.
+	ID() uint64
+	// User returns the name of the user the connection is authenticated as,
+	// "default" until SetUser is called.
+	User() string
+	// SetUser records the user the connection is authenticated as, for
+	// CLIENT LIST and CLIENT KILL USER. It is called by access control
+	// layers such as the acl package.
+	SetUser(name string)
+	// TLS returns the TLS state of a connection accepted on the TLS
+	// listener, or nil for plaintext connections.
+	TLS() *tls.ConnectionState
+	// Listener returns the address of the listener the connection was
+	// accepted on, as configured without its options, for example
+	// "tcp://0.0.0.0:6379" or "unix:///run/redhub.sock", so that handlers
+	// and access control layers can treat the clients of an admin socket
+	// differently.
+	Listener() string
+	// ClientSubject returns the subject of the certificate the client
+	// presented over mutual TLS, for example "CN=alice,O=Example Corp", or
+	// "" when it presented none. Access control layers can map it to a
+	// user.
+	ClientSubject() string
+	// Defer parks the command being served, for blocking commands such as
+	// BLPOP. The handler returns without writing a reply, and later
+	// pipelined commands stay queued until the returned Reply is resolved
+	// from another goroutine. When timeout is positive and elapses first,
+	// onTimeout writes the reply instead, or a null array when onTimeout is
+	// nil. Closing the connection cancels the wait. Defer must only be
+	// called by the handler serving the command, at most once.
+	Defer(timeout time.Duration, onTimeout func(c Conn)) Reply
 	// ReadPipeline returns all commands in current pipeline, if any
 	// The commands are removed from the pipeline.
 	ReadPipeline() []resp.Command
@@ -80,64 +164,230 @@ var writerPool = sync.Pool{
 	},
 }
 
+// nextConnID is the last ID handed out to a connection.
+var nextConnID uint64
+
 type conn struct {
-	conn        gnet.Conn
+	hub         *RedHub
+	id          uint64
+	created     time.Time
+	laddr       string
+	raddr       string
+	listener    string
+	conn        transport
 	cb          *connBuffer
 	wr          *resp.Writer
 	processData chan interface{}
 	closed      bool
 	muClosed    *sync.Mutex
 	ctx         context.Context
+
+	// done is set once the connection is closed, for the processing
+	// goroutine to check without taking muClosed.
+	done int32
+
+	// muInfo guards the fields reported by CLIENT LIST that change while the
+	// connection is open. lastCmd and qbuf are accessed atomically.
+	muInfo  sync.Mutex
+	name    string
+	user    string
+	cmd     string
+	lastCmd int64
+	qbuf    int64
+	noEvict int32
+	noTouch int32
+
+	// replyOff and skipNext hold the CLIENT REPLY mode. They are only used
+	// by the processing goroutine.
+	replyOff bool
+	skipNext bool
+
+	// proto mirrors the writer's protocol so Push can read it from other
+	// goroutines.
+	proto int32
+	// muOut orders out-of-band writes with pipeline flushes. While busy is
+	// set, out-of-band data is held in pending, up to outputMaxPending
+	// bytes, and sent after the replies.
+	muOut     sync.Mutex
+	busy      bool
+	outClosed bool
+	pending   []byte
+
+	// parked is the reply the command being served is waiting for, set by
+	// Defer.
+	muParked sync.Mutex
+	parked   *reply
+
+	// spans are the spans of the command being served, and spanCtx the
+	// context the tracers set for it. They are only used by the processing
+	// goroutine.
+	spans   []CommandSpan
+	spanCtx context.Context
 }
 
 func NewConn(gc gnet.Conn) *conn {
+	return newConn(gnetTransport{gc})
+}
+
+func newConn(t transport) *conn {
 	// buffer for read size
 	cb := connBufferPool.Get().(*connBuffer)
 
+	wr := writerPool.Get().(*resp.Writer)
+	wr.SetProtocol(resp.RESP2)
+	wr.Mute(false)
+
+	now := time.Now()
 	return &conn{
-		conn:        gc,
+		id:          atomic.AddUint64(&nextConnID, 1),
+		created:     now,
+		lastCmd:     now.UnixNano(),
+		user:        "default",
+		conn:        t,
 		cb:          cb,
-		wr:          writerPool.Get().(*resp.Writer),
-		processData: make(chan interface{}),
+		wr:          wr,
+		processData: make(chan interface{}, 1),
 		muClosed:    &sync.Mutex{},
 		ctx:         context.Background(),
+		proto:       resp.RESP2,
 	}
 }
 
 func (c *conn) close() error {
 	c.muClosed.Lock()
 	defer c.muClosed.Unlock()
+	return c.closeLocked()
+}
 
+// closeLocked closes the connection. The caller must hold muClosed. The
+// buffers are released by the processing goroutine once it exits.
+func (c *conn) closeLocked() error {
 	if c.closed {
 		return nil
 	}
 
 	c.closed = true
+	atomic.StoreInt32(&c.done, 1)
 	close(c.processData)
+	c.cancelParked()
 
+	c.muOut.Lock()
+	c.outClosed = true
+	c.pending = nil
+	c.muOut.Unlock()
+
+	return c.conn.Close()
+}
+
+// isClosed reports whether the connection has been closed.
+func (c *conn) isClosed() bool {
+	return atomic.LoadInt32(&c.done) == 1
+}
+
+// release returns the buffers of a closed connection to their pools.
+func (c *conn) release() {
+	c.cb.mu.Lock()
 	// ensure conn buffer is reset before returning it
 	c.cb.reset()
+	c.cb.mu.Unlock()
 	connBufferPool.Put(c.cb)
 
 	// ensure writer is flushed before returning it
 	c.wr.Flush()
 	writerPool.Put(c.wr)
+}
 
-	return c.conn.Close()
+func (c *conn) WriteString(str string)           { c.wr.WriteString(str) }
+func (c *conn) WriteBulk(bulk []byte)            { c.wr.WriteBulk(bulk) }
+func (c *conn) WriteBulkString(bulk string)      { c.wr.WriteBulkString(bulk) }
+func (c *conn) WriteInt(num int)                 { c.wr.WriteInt(num) }
+func (c *conn) WriteInt64(num int64)             { c.wr.WriteInt64(num) }
+func (c *conn) WriteUint64(num uint64)           { c.wr.WriteUint64(num) }
+func (c *conn) WriteError(msg string)            { c.wr.WriteError(msg) }
+func (c *conn) WriteArray(count int)             { c.wr.WriteArray(count) }
+func (c *conn) WriteNull()                       { c.wr.WriteNull() }
+func (c *conn) WriteNullArray()                  { c.wr.WriteNullArray() }
+func (c *conn) WriteRaw(data []byte)             { c.wr.WriteRaw(data) }
+func (c *conn) WriteAny(v interface{})           { c.wr.WriteAny(v) }
+func (c *conn) WriteMap(count int)               { c.wr.WriteMap(count) }
+func (c *conn) WriteSet(count int)               { c.wr.WriteSet(count) }
+func (c *conn) WriteAttribute(count int)         { c.wr.WriteAttribute(count) }
+func (c *conn) WriteDouble(f float64)            { c.wr.WriteDouble(f) }
+func (c *conn) WriteBool(t bool)                 { c.wr.WriteBool(t) }
+func (c *conn) WriteBigNumber(num string)        { c.wr.WriteBigNumber(num) }
+func (c *conn) WriteVerbatim(format, str string) { c.wr.WriteVerbatim(format, str) }
+func (c *conn) Protocol() int                    { return c.wr.Protocol() }
+func (c *conn) WritePush(count int)              { c.wr.WritePush(count) }
+func (c *conn) RemoteAddr() string               { return c.raddr }
+func (c *conn) Listener() string                 { return c.listener }
+func (c *conn) ID() uint64                       { return c.id }
+func (c *conn) Replying() bool                   { return !c.wr.Muted() }
+func (c *conn) NoEvict() bool                    { return atomic.LoadInt32(&c.noEvict) == 1 }
+func (c *conn) NoTouch() bool                    { return atomic.LoadInt32(&c.noTouch) == 1 }
+func (c *conn) SetProtocol(proto int) {
+	c.wr.SetProtocol(proto)
+	atomic.StoreInt32(&c.proto, int32(proto))
+}
+
+func (c *conn) Push(values ...interface{}) {
+	var b []byte
+	if atomic.LoadInt32(&c.proto) == resp.RESP3 {
+		b = resp.AppendPush(b, len(values))
+		for _, v := range values {
+			b = resp.AppendAnyRESP3(b, v)
+		}
+	} else {
+		b = resp.AppendArray(b, len(values))
+		for _, v := range values {
+			b = resp.AppendAny(b, v)
+		}
+	}
+	c.AsyncWrite(b)
+}
+
+func (c *conn) AsyncWrite(data []byte) {
+	c.asyncWrite(data, nil)
+}
+
+// asyncWrite is AsyncWrite, calling sent, when not nil, once the transport
+// no longer holds data, or once data is queued behind a running pipeline or
+// dropped.
+//
+// A connection whose pending data would grow over outputMaxPending is
+// closed.
+func (c *conn) asyncWrite(data []byte, sent func()) {
+	c.muOut.Lock()
+	if c.outClosed || c.busy {
+		overflow := false
+		if !c.outClosed {
+			if len(c.pending)+len(data) > outputMaxPending {
+				overflow = true
+			} else {
+				c.pending = append(c.pending, data...)
+			}
+		}
+		c.muOut.Unlock()
+		if sent != nil {
+			sent()
+		}
+		if overflow {
+			_ = c.close()
+		}
+		return
+	}
+	defer c.muOut.Unlock()
+
+	outBuffer := outBufferPool.Get(len(data))
+	copy(outBuffer, data)
+	c.conn.write(outBuffer, func() {
+		outBufferPool.Put(outBuffer)
+		if sent != nil {
+			sent()
+		}
+	})
+	c.written(len(data))
 }
 
-func (c *conn) WriteString(str string)      { c.wr.WriteString(str) }
-func (c *conn) WriteBulk(bulk []byte)       { c.wr.WriteBulk(bulk) }
-func (c *conn) WriteBulkString(bulk string) { c.wr.WriteBulkString(bulk) }
-func (c *conn) WriteInt(num int)            { c.wr.WriteInt(num) }
-func (c *conn) WriteInt64(num int64)        { c.wr.WriteInt64(num) }
-func (c *conn) WriteUint64(num uint64)      { c.wr.WriteUint64(num) }
-func (c *conn) WriteError(msg string)       { c.wr.WriteError(msg) }
-func (c *conn) WriteArray(count int)        { c.wr.WriteArray(count) }
-func (c *conn) WriteNull()                  { c.wr.WriteNull() }
-func (c *conn) WriteRaw(data []byte)        { c.wr.WriteRaw(data) }
-func (c *conn) WriteAny(v interface{})      { c.wr.WriteAny(v) }
-func (c *conn) RemoteAddr() string          { return c.conn.RemoteAddr().String() }
 func (c *conn) ReadPipeline() []resp.Command {
 	cmds := c.cb.command
 	c.cb.command = []resp.Command{}
@@ -156,18 +406,50 @@ func (c *conn) GetContext() context.Context {
 	return c.ctx
 }
 
-func (c *conn) process(handler func(c Conn, cmd resp.Command) (action Action)) {
-	for {
-		select {
-		case _, ok := <-c.processData:
-			if !ok {
-				return
+// serve runs handler for cmd. A panic in the handler is recovered: the partial
+// reply is discarded, the client is sent an error and the panic is reported
+// to the hub.
+func (c *conn) serve(handler HandlerFunc, cmd resp.Command) (action Action) {
+	c.setCommand(cmd.Args[0])
+	mark := c.wr.Len()
+	defer func() {
+		v := recover()
+		if v == nil {
+			return
+		}
+		stack := debug.Stack()
+		c.cancelParked()
+		c.wr.Truncate(mark)
+		c.wr.WriteError("ERR internal error")
+		action = None
+		if c.hub != nil {
+			c.hub.panicked(c, cmd, v, stack)
+			if c.hub.options.PanicPolicy == PanicClose {
+				action = Close
 			}
 		}
+	}()
+	return handler(c, cmd)
+}
+
+func (c *conn) process(handler HandlerFunc) {
+	defer c.release()
+
+	for {
+		if _, ok := <-c.processData; !ok || c.isClosed() {
+			return
+		}
 
 		status := None
+		observed := len(c.observers()) > 0
+		traced := len(c.tracers()) > 0
+		var served int
 
 		c.cb.mu.Lock()
+		c.muOut.Lock()
+		c.busy = true
+		c.muOut.Unlock()
+
 		for {
 			if len(c.cb.command) == 0 {
 				break
@@ -176,36 +458,224 @@ func (c *conn) process(handler func(c Conn, cmd resp.Command) (action Action)) {
 			cmd := c.cb.command[0]
 			c.cb.command = c.cb.command[1:]
 
-			status = handler(c, cmd)
+			if c.hub != nil {
+				if end := c.hub.pauseFor(cmd.Args); end != nil {
+					c.flush()
+					c.cb.mu.Unlock()
+					if !c.sleep(end) {
+						return
+					}
+				}
+			}
+
+			// Replies are dropped after CLIENT REPLY OFF, and for the
+			// command following CLIENT REPLY SKIP.
+			c.wr.Mute(c.replyOff || c.skipNext)
+			c.skipNext = false
+
+			var start time.Time
+			var prevCtx context.Context
+			mark := c.wr.Len()
+			if observed {
+				start = time.Now()
+			}
+			if traced {
+				prevCtx = c.startSpans(cmd)
+			}
+			status = c.serve(handler, cmd)
+			var elapsed time.Duration
+			if observed {
+				elapsed = time.Since(start)
+			}
+			if c.hub != nil && c.hub.monitoring() {
+				c.hub.feedMonitors(c, cmd)
+			}
+			if r := c.parkedReply(); r != nil {
+				// Send the replies so far and wait for the parked one
+				// without holding the buffer, so that later commands are
+				// still read and queued.
+				c.flush()
+				c.cb.mu.Unlock()
+				var ok bool
+				if ok, status = c.wait(r, cmd); !ok {
+					if traced {
+						c.endSpans(prevCtx, c.wr.Len())
+					}
+					return
+				}
+				mark = 0
+			}
+			if observed {
+				c.served(cmd, elapsed, mark)
+				served++
+			}
+			if traced {
+				c.endSpans(prevCtx, mark)
+			}
 			if status == Close {
 				break
 			}
 		}
 
-		// Get a buffer out of the pool and if it's big enough use it. Otherwise,
-		// allocate a new buffer.
-		orig := c.wr.OrigBuffer()
-		outBuffer := outBufferPool.Get(len(orig))
-		copy(outBuffer, orig)
-
-		c.wr.Flush()
-		_ = c.conn.AsyncWrite(outBuffer, func(gc gnet.Conn, _ error) error {
-			outBufferPool.Put(outBuffer)
-			return nil
-		})
-
+		if served > 0 {
+			for _, o := range c.observers() {
+				o.Pipeline(c, served)
+			}
+		}
+		c.flush()
 		c.cb.pb.Reset()
 
 		if status == Close {
-			_ = c.close()
 			c.cb.mu.Unlock()
+			_ = c.close()
 		} else {
-			c.cb.lastAccess = time.Now()
+			now := time.Now()
+			c.cb.lastAccess = now
+			atomic.StoreInt64(&c.lastCmd, now.UnixNano())
 			c.cb.mu.Unlock()
 		}
 	}
 }
 
+// sleep waits, without holding cb.mu, until end is closed. It returns with
+// cb.mu held, or false when the connection closed.
+func (c *conn) sleep(end <-chan struct{}) bool {
+	for {
+		select {
+		case <-end:
+		case _, ok := <-c.processData:
+			if !ok {
+				return false
+			}
+			// The commands that woke us are already queued.
+			continue
+		}
+		break
+	}
+	c.cb.mu.Lock()
+	if c.isClosed() {
+		c.cb.mu.Unlock()
+		return false
+	}
+	c.muOut.Lock()
+	c.busy = true
+	c.muOut.Unlock()
+	return true
+}
+
+// setCommand records name as the last command of the connection.
+func (c *conn) setCommand(name []byte) {
+	var buf [maxLowerName]byte
+	lname := resp.AppendLower(buf[:0], name)
+	c.muInfo.Lock()
+	if string(lname) != c.cmd {
+		c.cmd = string(lname)
+	}
+	c.muInfo.Unlock()
+}
+
+// setReplyMode applies CLIENT REPLY ON, OFF or SKIP. OFF and SKIP take
+// effect immediately, so the command setting them gets no reply either.
+func (c *conn) setReplyMode(mode string) {
+	switch mode {
+	case "on":
+		c.replyOff, c.skipNext = false, false
+		c.wr.Mute(false)
+	case "off":
+		c.replyOff = true
+		c.wr.Mute(true)
+	case "skip":
+		if !c.replyOff {
+			c.skipNext = true
+		}
+		c.wr.Mute(true)
+	}
+}
+
+func (c *conn) setName(name string) {
+	c.muInfo.Lock()
+	c.name = name
+	c.muInfo.Unlock()
+}
+
+func (c *conn) TLS() *tls.ConnectionState { return c.conn.tlsState() }
+
+func (c *conn) ClientSubject() string {
+	state := c.conn.tlsState()
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	return state.PeerCertificates[0].Subject.String()
+}
+
+func (c *conn) User() string {
+	c.muInfo.Lock()
+	defer c.muInfo.Unlock()
+	return c.user
+}
+
+func (c *conn) SetUser(name string) {
+	c.muInfo.Lock()
+	c.user = name
+	c.muInfo.Unlock()
+}
+
+// flush sends the buffered replies, followed by out-of-band data queued
+// while they were written, and ends the busy period.
+func (c *conn) flush() {
+	// Get a buffer out of the pool and if it's big enough use it. Otherwise,
+	// allocate a new buffer.
+	orig := c.wr.OrigBuffer()
+	c.muOut.Lock()
+	defer c.muOut.Unlock()
+
+	c.busy = false
+	if len(orig) == 0 && len(c.pending) == 0 {
+		return
+	}
+	outBuffer := outBufferPool.Get(len(orig) + len(c.pending))
+	copy(outBuffer, orig)
+	copy(outBuffer[len(orig):], c.pending)
+	c.pending = c.pending[:0]
+
+	c.wr.Flush()
+	c.conn.write(outBuffer, func() {
+		outBufferPool.Put(outBuffer)
+	})
+	c.written(len(outBuffer))
+}
+
+// drain closes the connection if it is idle: no pipeline is running, no
+// commands are queued and no partial command has been received. A non-empty
+// notice is sent to the client as an error reply before closing. drain
+// reports whether the connection is closed.
+func (c *conn) drain(notice string) bool {
+	c.muClosed.Lock()
+	defer c.muClosed.Unlock()
+
+	if c.closed {
+		return true
+	}
+	if !c.cb.mu.TryLock() {
+		return false
+	}
+	defer c.cb.mu.Unlock()
+
+	if len(c.cb.command) > 0 || c.cb.buf.Len() > 0 {
+		return false
+	}
+	if notice != "" {
+		c.AsyncWrite(resp.AppendError(nil, notice))
+	}
+	_ = c.closeLocked()
+	return true
+}
+
+// notify wakes the processing goroutine. A wake-up that is already pending
+// covers the commands queued since, so notify never blocks the event loop.
 func (c *conn) notify() {
-	c.processData <- struct{}{}
+	select {
+	case c.processData <- struct{}{}:
+	default:
+	}
 }
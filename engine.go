@@ -0,0 +1,150 @@
+package redhub
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+
+	gnet "github.com/panjf2000/gnet/v2"
+)
+
+// engine accepts and runs the connections of a RedHub on its main address.
+// An engine must close rs.booted once it accepts connections.
+type engine interface {
+	// serve serves connections until the engine is stopped or fails.
+	serve() error
+	// stop stops the engine. Connections still open are closed.
+	stop(ctx context.Context) error
+}
+
+// gnetEngine serves an address with gnet event loops.
+type gnetEngine struct {
+	rs   *RedHub
+	addr string
+}
+
+func (e *gnetEngine) serve() error {
+	rs := e.rs
+	primary, err := parseAddr(e.addr)
+	if err != nil {
+		return err
+	}
+	// A Unix socket with a mode is created by gnet in a private directory,
+	// and renamed into place by OnBoot.
+	addr := primary.name
+	var ps *privateSocket
+	if primary.network == "unix" && primary.mode != 0 {
+		if ps, err = primary.privateSocket(); err != nil {
+			return err
+		}
+		defer ps.close()
+		addr = "unix://" + ps.path
+	}
+	rs.connSync.Lock()
+	rs.primary = primary
+	rs.primarySocket = ps
+	rs.connSync.Unlock()
+
+	options := rs.options
+	serveOptions := gnet.Options{
+		Multicore:        options.Multicore,
+		LockOSThread:     options.LockOSThread,
+		ReadBufferCap:    options.ReadBufferCap,
+		LB:               options.LB,
+		NumEventLoop:     options.NumEventLoop,
+		ReusePort:        options.ReusePort,
+		Ticker:           options.Ticker && rs.tickFreq > 0,
+		TCPKeepAlive:     options.TCPKeepAlive,
+		TCPNoDelay:       gnet.TCPDelay,
+		SocketRecvBuffer: options.SocketRecvBuffer,
+		SocketSendBuffer: options.SocketSendBuffer,
+		EdgeTriggeredIO:  options.EdgeTriggeredIO,
+		ReuseAddr:        false,
+	}
+	err = gnet.Run(rs, addr, gnet.WithOptions(serveOptions))
+	if err == nil && ps != nil && ps.err != nil {
+		// OnBoot shut gnet down as the socket couldn't be put in place.
+		err = ps.err
+	}
+	return err
+}
+
+func (e *gnetEngine) stop(ctx context.Context) error {
+	e.rs.connSync.RLock()
+	eng := e.rs.engine
+	e.rs.connSync.RUnlock()
+	return eng.Stop(ctx)
+}
+
+// netEngine serves a net.Listener with a goroutine per connection, using
+// only the net package. It serves the same Conn and handler API as the gnet
+// engine.
+type netEngine struct {
+	rs       *RedHub
+	ln       net.Listener
+	stopping int32
+}
+
+func (e *netEngine) serve() error {
+	rs := e.rs
+	addr := e.ln.Addr()
+	rs.connSync.Lock()
+	rs.primary = listenAddr{name: addr.Network() + "://" + addr.String()}
+	rs.listenAddr = addr
+	close(rs.booted)
+	rs.connSync.Unlock()
+	rs.info.listening(addr)
+
+	// OnTick returns the tick frequency as its delay; without one the
+	// ticker would spin.
+	if rs.options.Ticker && rs.tickFreq > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go e.tick(done)
+	}
+
+	rs.netConns.Add(1)
+	err := rs.serveListener(e.ln, rs.primary.name, 0)
+	if atomic.LoadInt32(&e.stopping) == 1 {
+		return nil
+	}
+	return err
+}
+
+// tick calls OnTick and waits the delay it returns, as the gnet ticker
+// does, until done is closed. OnTick returning gnet.Shutdown stops the
+// engine.
+func (e *netEngine) tick(done <-chan struct{}) {
+	var timer *time.Timer
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+	for {
+		delay, action := e.rs.OnTick()
+		if action == gnet.Shutdown {
+			_ = e.stop(context.Background())
+			return
+		}
+		if timer == nil {
+			timer = time.NewTimer(delay)
+		} else {
+			timer.Reset(delay)
+		}
+		select {
+		case <-done:
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+func (e *netEngine) stop(ctx context.Context) error {
+	atomic.StoreInt32(&e.stopping, 1)
+	// Closing the listener makes serve return, and run closes the
+	// connections still open.
+	_ = e.ln.Close()
+	return nil
+}
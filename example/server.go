@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
-	"strings"
+	"os"
+	"os/signal"
 	"sync"
+	"time"
 
 	"net/http"
 	_ "net/http/pprof"
@@ -38,43 +41,37 @@ func main() {
 
 	protoAddr := fmt.Sprintf("%s://%s", network, addr)
 	option := redhub.Options{
-		Multicore: multicore,
-		ReusePort: reusePort,
+		Multicore:       multicore,
+		ReusePort:       reusePort,
+		ShutdownTimeout: 10 * time.Second,
 	}
 
-	signal := make(chan error)
-
-	rh := redhub.NewRedHub(
-		func(c redhub.Conn) (action redhub.Action) {
-			return
-		},
-		func(c redhub.Conn, err error) (action redhub.Action) {
-			return
-		},
-		func(c redhub.Conn, cmd resp.Command) (action redhub.Action) {
-			var status redhub.Action
-			switch strings.ToLower(string(cmd.Args[0])) {
-			default:
-				c.WriteError("ERR unknown command '" + string(cmd.Args[0]) + "'")
-			case "ping":
+	mux := redhub.NewMux()
+	mux.Handle(
+		redhub.CommandSpec{Name: "ping", Arity: -1, Flags: redhub.FlagFast,
+			Handler: func(c redhub.Conn, cmd resp.Command) (action redhub.Action) {
 				c.WriteString("PONG")
-			case "quit":
+				return
+			}},
+		redhub.CommandSpec{Name: "hello", Arity: -1, Flags: redhub.FlagFast | redhub.FlagNoAuth,
+			Handler: redhub.Hello},
+		redhub.CommandSpec{Name: "quit", Arity: -1, Flags: redhub.FlagFast | redhub.FlagNoAuth,
+			Handler: func(c redhub.Conn, cmd resp.Command) (action redhub.Action) {
 				c.WriteString("OK")
-				status = redhub.Close
-			case "set":
-				if len(cmd.Args) != 3 {
-					c.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
-					break
-				}
+				return redhub.Close
+			}},
+		redhub.CommandSpec{Name: "set", Arity: 3, Flags: redhub.FlagWrite | redhub.FlagDenyOOM,
+			FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Handler: func(c redhub.Conn, cmd resp.Command) (action redhub.Action) {
 				mu.Lock()
 				items[string(cmd.Args[1])] = cmd.Args[2]
 				mu.Unlock()
 				c.WriteString("OK")
-			case "get":
-				if len(cmd.Args) != 2 {
-					c.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
-					break
-				}
+				return
+			}},
+		redhub.CommandSpec{Name: "get", Arity: 2, Flags: redhub.FlagReadOnly | redhub.FlagFast,
+			FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Handler: func(c redhub.Conn, cmd resp.Command) (action redhub.Action) {
 				mu.RLock()
 				val, ok := items[string(cmd.Args[1])]
 				mu.RUnlock()
@@ -83,11 +80,11 @@ func main() {
 				} else {
 					c.WriteBulk(val)
 				}
-			case "del":
-				if len(cmd.Args) != 2 {
-					c.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
-					break
-				}
+				return
+			}},
+		redhub.CommandSpec{Name: "del", Arity: 2, Flags: redhub.FlagWrite,
+			FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Handler: func(c redhub.Conn, cmd resp.Command) (action redhub.Action) {
 				mu.Lock()
 				_, ok := items[string(cmd.Args[1])]
 				delete(items, string(cmd.Args[1]))
@@ -97,19 +94,35 @@ func main() {
 				} else {
 					c.WriteInt64(1)
 				}
-			}
-			return status
-		},
+				return
+			}},
 	)
 
-	go func() {
-		select {
-		case _ = <-signal:
-			fmt.Println("signal recieved")
+	rh := redhub.NewRedHub(
+		func(c redhub.Conn) (action redhub.Action) {
+			return
+		},
+		func(c redhub.Conn, err error) (action redhub.Action) {
+			return
+		},
+		mux.ServeRESP,
+		time.Second,
+		30*time.Second,
+	)
+	mux.Handle(rh.ClientCommand(mux), rh.InfoCommand(mux), rh.SlowlogCommand(mux), rh.MonitorCommand(mux))
+	rh.AddInfoSection("keyspace", func(w *redhub.InfoWriter) {
+		mu.RLock()
+		n := len(items)
+		mu.RUnlock()
+		if n > 0 {
+			w.Add("db0", fmt.Sprintf("keys=%d,expires=0,avg_ttl=0", n))
 		}
-	}()
+	})
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
 
-	err := redhub.ListendAndServe(signal, protoAddr, option, rh)
+	err := redhub.Serve(ctx, protoAddr, option, rh)
 	if err != nil {
 		log.Fatal(err)
 	}
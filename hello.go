@@ -0,0 +1,106 @@
+package redhub
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/IceFireDB/redhub/pkg/resp"
+)
+
+// ServerName and ServerVersion are reported to clients by HELLO. Clients use
+// the version to detect features, so it defaults to the Redis release whose
+// protocol redhub speaks.
+var (
+	ServerName    = "redis"
+	ServerVersion = "7.2.0"
+)
+
+// Hello implements HELLO [protover [AUTH username password] [SETNAME clientname]].
+// It switches the connection to the requested protocol version and replies
+// with the server-info map, so every later Write* call on the connection is
+// encoded for the negotiated protocol. Route the command to it from a handler:
+//
+//	case "hello":
+//		return redhub.Hello(c, cmd)
+//
+// redhub has no users of its own, so AUTH only accepts the "default" user,
+// matching a Redis server that has no password configured. The acl package
+// authenticates the AUTH option itself and passes HELLO on without it.
+func Hello(c Conn, cmd resp.Command) Action {
+	proto := c.Protocol()
+	var name string
+	var setName bool
+
+	args := cmd.Args[1:]
+	if len(args) > 0 {
+		ver, err := strconv.ParseInt(string(args[0]), 10, 64)
+		if err != nil {
+			c.WriteError("ERR Protocol version is not an integer or out of range")
+			return None
+		}
+		if ver < resp.RESP2 || ver > resp.RESP3 {
+			c.WriteError("NOPROTO unsupported protocol version")
+			return None
+		}
+		proto = int(ver)
+
+		for i := 1; i < len(args); i++ {
+			more := len(args) - i - 1
+			switch opt := strings.ToLower(string(args[i])); {
+			case opt == "auth" && more >= 2:
+				if string(args[i+1]) != "default" {
+					c.WriteError("WRONGPASS invalid username-password pair or user is disabled.")
+					return None
+				}
+				i += 2
+			case opt == "setname" && more >= 1:
+				if !validClientName(args[i+1]) {
+					c.WriteError("ERR Client names cannot contain spaces, newlines or special characters.")
+					return None
+				}
+				name, setName = string(args[i+1]), true
+				i++
+			default:
+				c.WriteError("ERR Syntax error in HELLO option '" + string(args[i]) + "'")
+				return None
+			}
+		}
+	}
+
+	c.SetProtocol(proto)
+	var id uint64
+	if cc, ok := c.(*conn); ok {
+		if setName {
+			cc.setName(name)
+		}
+		id = cc.id
+	}
+
+	c.WriteMap(7)
+	c.WriteBulkString("server")
+	c.WriteBulkString(ServerName)
+	c.WriteBulkString("version")
+	c.WriteBulkString(ServerVersion)
+	c.WriteBulkString("proto")
+	c.WriteInt(proto)
+	c.WriteBulkString("id")
+	c.WriteUint64(id)
+	c.WriteBulkString("mode")
+	c.WriteBulkString("standalone")
+	c.WriteBulkString("role")
+	c.WriteBulkString("master")
+	c.WriteBulkString("modules")
+	c.WriteArray(0)
+	return None
+}
+
+// validClientName reports whether name may be used as a client name, which
+// Redis limits to printable characters other than space.
+func validClientName(name []byte) bool {
+	for _, ch := range name {
+		if ch < '!' || ch > '~' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,464 @@
+package redhub
+
+import (
+	crand "crypto/rand"
+	"encoding/hex"
+	"net"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IceFireDB/redhub/pkg/resp"
+)
+
+// infoRedisVersion is the redis_version reported by INFO, the version of
+// Redis whose commands and replies redhub follows. Clients and monitoring
+// agents check it before using newer features.
+const infoRedisVersion = "7.2.0"
+
+// maxInfoCommands bounds the commands reported by INFO commandstats when
+// they are named by their first argument, so clients can't grow it.
+const maxInfoCommands = 1024
+
+// InfoWriter writes the fields of an INFO section, one "key:value" line
+// each. Keys and values must not contain ':' or line breaks; values of
+// sections such as keyspace hold comma-separated "name=value" pairs, for
+// example "keys=10,expires=2,avg_ttl=0".
+type InfoWriter struct {
+	b []byte
+}
+
+// Add writes a field.
+func (w *InfoWriter) Add(key, value string) {
+	w.b = append(w.b, key...)
+	w.b = append(w.b, ':')
+	w.b = append(w.b, value...)
+	w.b = append(w.b, '\r', '\n')
+}
+
+// AddInt writes an integer field.
+func (w *InfoWriter) AddInt(key string, value int64) {
+	w.Add(key, strconv.FormatInt(value, 10))
+}
+
+// AddUint writes an unsigned integer field.
+func (w *InfoWriter) AddUint(key string, value uint64) {
+	w.Add(key, strconv.FormatUint(value, 10))
+}
+
+// AddFloat writes a field with two decimals, as Redis does.
+func (w *InfoWriter) AddFloat(key string, value float64) {
+	w.Add(key, strconv.FormatFloat(value, 'f', 2, 64))
+}
+
+// InfoFunc writes the fields of an INFO section.
+type InfoFunc func(w *InfoWriter)
+
+type infoSection struct {
+	name string
+	fn   InfoFunc
+	// all is set for sections only reported by INFO all or everything, or
+	// when asked for by name.
+	all bool
+}
+
+// info holds the sections of INFO and the stats they report. It has a lock
+// of its own, as INFO is served while the connection's buffer is locked and
+// must not wait on connSync.
+type info struct {
+	mu       sync.Mutex
+	sections []infoSection
+	stats    *infoStats
+
+	// The fields of the server section, set as the server starts.
+	started      time.Time
+	runID        string
+	multiplexing string
+	eventLoops   int
+	port         int
+}
+
+// start records the fields of the server section for a server starting with
+// options on e.
+func (i *info) start(options Options, e engine) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.started = time.Now()
+	i.runID = newRunID()
+	i.port = 0
+	i.eventLoops = 0
+	switch e.(type) {
+	case *gnetEngine:
+		i.multiplexing = "gnet"
+		i.eventLoops = eventLoops(options)
+	case *netEngine:
+		i.multiplexing = "goroutines"
+	}
+}
+
+// listening records the address the server listens on.
+func (i *info) listening(addr net.Addr) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		i.port = tcp.Port
+	}
+}
+
+// AddInfoSection adds a section to INFO, reported after the built-in server,
+// clients, memory and stats sections, for example the keyspace:
+//
+//	rh.AddInfoSection("keyspace", func(w *redhub.InfoWriter) {
+//		w.Add("db0", fmt.Sprintf("keys=%d,expires=%d,avg_ttl=0", db.Len(), db.Expiring()))
+//	})
+//
+// Adding a section with the name of an existing one, built-in or not,
+// replaces it. fn is called on the goroutine serving INFO and must be safe
+// for concurrent use.
+func (rs *RedHub) AddInfoSection(name string, fn InfoFunc) {
+	name = strings.ToLower(name)
+	i := &rs.info
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	sections := rs.infoSections()
+	for n := range sections {
+		if sections[n].name == name {
+			sections[n].fn = fn
+			return
+		}
+	}
+	// Keep commandstats, which INFO only reports when asked for, last.
+	n := len(sections)
+	if n > 0 && sections[n-1].all {
+		n--
+	}
+	sections = append(sections, infoSection{})
+	copy(sections[n+1:], sections[n:])
+	sections[n] = infoSection{name: name, fn: fn}
+	i.sections = sections
+}
+
+// infoSections returns the sections of INFO, with the built-in ones when
+// none were added yet. The caller must hold info.mu.
+func (rs *RedHub) infoSections() []infoSection {
+	if rs.info.sections == nil {
+		rs.info.sections = []infoSection{
+			{name: "server", fn: rs.infoServer},
+			{name: "clients", fn: rs.infoClients},
+			{name: "memory", fn: rs.infoMemory},
+			{name: "stats", fn: rs.infoStats},
+			{name: "commandstats", fn: rs.infoCommandStats, all: true},
+		}
+	}
+	return rs.info.sections
+}
+
+// Info returns the INFO report of the given sections, or of the default
+// sections when none are given. As with INFO, "default", "all" and
+// "everything" select groups of sections, and unknown sections are
+// ignored.
+func (rs *RedHub) Info(sections ...string) string {
+	rs.info.mu.Lock()
+	all := append([]infoSection(nil), rs.infoSections()...)
+	rs.info.mu.Unlock()
+
+	if len(sections) == 0 {
+		sections = []string{"default"}
+	}
+	want := make(map[string]bool, len(sections))
+	for _, name := range sections {
+		want[strings.ToLower(name)] = true
+	}
+
+	var w InfoWriter
+	for _, s := range all {
+		if !want[s.name] && !want["all"] && !want["everything"] && (s.all || !want["default"]) {
+			continue
+		}
+		if len(w.b) > 0 {
+			w.b = append(w.b, '\r', '\n')
+		}
+		w.b = append(w.b, "# "...)
+		w.b = append(w.b, strings.ToUpper(s.name[:1])...)
+		w.b = append(w.b, s.name[1:]...)
+		w.b = append(w.b, '\r', '\n')
+		s.fn(&w)
+	}
+	return string(w.b)
+}
+
+// InfoCommand returns the spec of the INFO command, reporting the sections
+// of Info. Register it on the Mux:
+//
+//	mux.Handle(rh.InfoCommand(mux))
+//
+// Registering it installs the Observer that counts the stats and
+// commandstats sections, so it must be done before the server starts. m
+// names the commands of commandstats, "client|list" for subcommands, and
+// commands it doesn't know are not counted; when m is nil, commands are
+// named by their first argument.
+func (rs *RedHub) InfoCommand(m *Mux) CommandSpec {
+	if rs.info.stats == nil {
+		rs.info.stats = &infoStats{mux: m, commands: make(map[string]*infoCommand)}
+		rs.Observe(rs.info.stats)
+	}
+	return CommandSpec{
+		Name: "info", Arity: -1, Handler: rs.infoCommand,
+		Flags: FlagLoading | FlagStale, Categories: []string{"slow", "dangerous"},
+		Summary: "Returns information and statistics about the server.", Since: "1.0.0",
+		Group: "server", Complexity: "O(1)",
+	}
+}
+
+func (rs *RedHub) infoCommand(c Conn, cmd resp.Command) Action {
+	sections := make([]string, len(cmd.Args)-1)
+	for i, arg := range cmd.Args[1:] {
+		sections[i] = string(arg)
+	}
+	c.WriteVerbatim("txt", rs.Info(sections...))
+	return None
+}
+
+func (rs *RedHub) infoServer(w *InfoWriter) {
+	i := &rs.info
+	i.mu.Lock()
+	started, runID, multiplexing, loops, port := i.started, i.runID, i.multiplexing, i.eventLoops, i.port
+	i.mu.Unlock()
+
+	w.Add("redis_version", infoRedisVersion)
+	w.Add("redis_mode", "standalone")
+	w.Add("os", runtime.GOOS+" "+runtime.GOARCH)
+	w.AddInt("arch_bits", int64(strconv.IntSize))
+	if multiplexing != "" {
+		w.Add("multiplexing_api", multiplexing)
+	}
+	if loops > 0 {
+		w.AddInt("gnet_event_loops", int64(loops))
+	}
+	w.Add("go_version", runtime.Version())
+	w.AddInt("process_id", int64(os.Getpid()))
+	w.Add("run_id", runID)
+	if port > 0 {
+		w.AddInt("tcp_port", int64(port))
+	}
+	now := time.Now()
+	w.AddInt("server_time_usec", now.UnixNano()/int64(time.Microsecond))
+	var uptime time.Duration
+	if !started.IsZero() {
+		uptime = now.Sub(started)
+	}
+	w.AddInt("uptime_in_seconds", int64(uptime/time.Second))
+	w.AddInt("uptime_in_days", int64(uptime/(24*time.Hour)))
+	w.AddInt("goroutines", int64(runtime.NumGoroutine()))
+}
+
+// eventLoops returns the number of event loops gnet runs with options.
+func eventLoops(options Options) int {
+	switch {
+	case options.NumEventLoop > 0:
+		return options.NumEventLoop
+	case options.Multicore:
+		return runtime.NumCPU()
+	}
+	return 1
+}
+
+func (rs *RedHub) infoClients(w *InfoWriter) {
+	var blocked int
+	var maxIn, maxOut int
+	conns := rs.openConns()
+	for _, c := range conns {
+		c.muParked.Lock()
+		if c.parked != nil {
+			blocked++
+		}
+		c.muParked.Unlock()
+		if n := int(atomic.LoadInt64(&c.qbuf)); n > maxIn {
+			maxIn = n
+		}
+		c.muOut.Lock()
+		if n := len(c.pending); n > maxOut {
+			maxOut = n
+		}
+		c.muOut.Unlock()
+	}
+	w.AddInt("connected_clients", int64(len(conns)))
+	w.AddInt("blocked_clients", int64(blocked))
+	w.AddInt("client_recent_max_input_buffer", int64(maxIn))
+	w.AddInt("client_recent_max_output_buffer", int64(maxOut))
+}
+
+func (rs *RedHub) infoMemory(w *InfoWriter) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	var pb, ip int64
+	for _, c := range rs.openConns() {
+		pb += atomic.LoadInt64(&c.cb.pbSize)
+		ip += atomic.LoadInt64(&c.cb.ipSize)
+	}
+
+	w.AddUint("used_memory", ms.HeapAlloc)
+	w.Add("used_memory_human", humanBytes(ms.HeapAlloc))
+	w.AddUint("used_memory_rss", ms.Sys)
+	w.Add("used_memory_rss_human", humanBytes(ms.Sys))
+	w.Add("mem_allocator", "go")
+	w.AddUint("mem_gc_runs", uint64(ms.NumGC))
+	w.AddInt("mem_byte_pool_bytes", pb)
+	w.AddInt("mem_int_pool_bytes", ip)
+}
+
+// humanBytes formats n as Redis does in the *_human fields, such as
+// "1.50M".
+func humanBytes(n uint64) string {
+	const units = "KMGTPE"
+	if n < 1024 {
+		return strconv.FormatUint(n, 10) + "B"
+	}
+	f, u := float64(n)/1024, 0
+	for f >= 1024 && u < len(units)-1 {
+		f /= 1024
+		u++
+	}
+	return strconv.FormatFloat(f, 'f', 2, 64) + units[u:u+1]
+}
+
+func (rs *RedHub) infoStats(w *InfoWriter) {
+	s := rs.info.stats
+	if s == nil {
+		s = &infoStats{}
+	}
+	w.AddUint("total_connections_received", atomic.LoadUint64(&s.conns))
+	w.AddUint("total_commands_processed", atomic.LoadUint64(&s.served))
+	w.AddUint("total_net_input_bytes", atomic.LoadUint64(&s.bytesIn))
+	w.AddUint("total_net_output_bytes", atomic.LoadUint64(&s.bytesOut))
+	w.AddUint("total_error_replies", atomic.LoadUint64(&s.errors))
+	w.AddUint("total_parse_errors", atomic.LoadUint64(&s.parseErrors))
+	w.AddUint("total_buffers_reclaimed", atomic.LoadUint64(&s.reclaimed))
+}
+
+func (rs *RedHub) infoCommandStats(w *InfoWriter) {
+	s := rs.info.stats
+	if s == nil {
+		return
+	}
+	s.mu.RLock()
+	names := make([]string, 0, len(s.commands))
+	for name := range s.commands {
+		names = append(names, name)
+	}
+	s.mu.RUnlock()
+	sort.Strings(names)
+
+	var b []byte
+	for _, name := range names {
+		s.mu.RLock()
+		cmd := s.commands[name]
+		s.mu.RUnlock()
+		calls := atomic.LoadUint64(&cmd.calls)
+		usec := atomic.LoadUint64(&cmd.usec)
+		var perCall float64
+		if calls > 0 {
+			perCall = float64(usec) / float64(calls)
+		}
+		b = append(b[:0], "calls="...)
+		b = strconv.AppendUint(b, calls, 10)
+		b = append(b, ",usec="...)
+		b = strconv.AppendUint(b, usec, 10)
+		b = append(b, ",usec_per_call="...)
+		b = strconv.AppendFloat(b, perCall, 'f', 2, 64)
+		b = append(b, ",failed_calls="...)
+		b = strconv.AppendUint(b, atomic.LoadUint64(&cmd.failed), 10)
+		w.Add("cmdstat_"+name, string(b))
+	}
+}
+
+// infoStats is the Observer counting the stats and commandstats sections of
+// INFO.
+type infoStats struct {
+	mux         *Mux
+	conns       uint64
+	served      uint64
+	bytesIn     uint64
+	bytesOut    uint64
+	errors      uint64
+	parseErrors uint64
+	reclaimed   uint64
+
+	mu       sync.RWMutex
+	commands map[string]*infoCommand
+}
+
+// infoCommand holds the commandstats of a command.
+type infoCommand struct {
+	calls  uint64
+	usec   uint64
+	failed uint64
+}
+
+func (s *infoStats) ConnOpened(c Conn)            { atomic.AddUint64(&s.conns, 1) }
+func (s *infoStats) ConnClosed(c Conn, err error) {}
+func (s *infoStats) Read(c Conn, n int)           { atomic.AddUint64(&s.bytesIn, uint64(n)) }
+func (s *infoStats) Written(c Conn, n int)        { atomic.AddUint64(&s.bytesOut, uint64(n)) }
+func (s *infoStats) ParseError(c Conn, err error) { atomic.AddUint64(&s.parseErrors, 1) }
+func (s *infoStats) Pipeline(c Conn, n int)       {}
+func (s *infoStats) BuffersReclaimed(n int)       { atomic.AddUint64(&s.reclaimed, uint64(n)) }
+
+func (s *infoStats) CommandServed(c Conn, cmd resp.Command, d time.Duration, errPrefix string) {
+	atomic.AddUint64(&s.served, 1)
+	if errPrefix != "" {
+		atomic.AddUint64(&s.errors, 1)
+	}
+	stats := s.command(cmd.Args)
+	if stats == nil {
+		return
+	}
+	atomic.AddUint64(&stats.calls, 1)
+	atomic.AddUint64(&stats.usec, uint64(d/time.Microsecond))
+	if errPrefix != "" {
+		atomic.AddUint64(&stats.failed, 1)
+	}
+}
+
+// command returns the commandstats of the command args invoke, creating
+// them if needed, or nil when the command is not counted.
+func (s *infoStats) command(args [][]byte) *infoCommand {
+	var buf [maxLowerName]byte
+	var name []byte
+	if s.mux != nil {
+		mc := s.mux.lookup(args)
+		if mc == nil {
+			return nil
+		}
+		name = append(buf[:0], mc.fullName...)
+	} else if len(args) > 0 {
+		name = resp.AppendLower(buf[:0], args[0])
+	}
+
+	s.mu.RLock()
+	stats := s.commands[string(name)]
+	s.mu.RUnlock()
+	if stats != nil {
+		return stats
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stats = s.commands[string(name)]; stats == nil && len(s.commands) < maxInfoCommands {
+		stats = &infoCommand{}
+		s.commands[string(name)] = stats
+	}
+	return stats
+}
+
+// newRunID returns a random run_id, 40 hex characters as in Redis.
+func newRunID() string {
+	var id [20]byte
+	_, _ = crand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
@@ -0,0 +1,224 @@
+package redhub
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// listenAddr is an address the server listens on, such as
+// "tcp://127.0.0.1:6379" or "unix:///run/redhub.sock?mode=0660".
+type listenAddr struct {
+	// name is the address without its options, as reported by
+	// Conn.Listener.
+	name    string
+	network string
+	address string
+	// mode, when set, is the file mode of a Unix socket.
+	mode os.FileMode
+}
+
+// parseAddr parses an address with a network scheme, tcp when omitted. The
+// only option is mode, the octal file mode of a Unix socket.
+func parseAddr(addr string) (listenAddr, error) {
+	la := listenAddr{name: addr}
+	var query string
+	if i := strings.IndexByte(addr, '?'); i >= 0 {
+		la.name, query = addr[:i], addr[i+1:]
+	}
+	la.network, la.address = "tcp", la.name
+	if i := strings.Index(la.name, "://"); i >= 0 {
+		la.network, la.address = la.name[:i], la.name[i+3:]
+	}
+	switch la.network {
+	case "tcp", "tcp4", "tcp6", "unix":
+	default:
+		return la, fmt.Errorf("redhub: unsupported network in address %q", addr)
+	}
+
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return la, fmt.Errorf("redhub: invalid options in address %q: %v", addr, err)
+	}
+	for key, vals := range values {
+		if key != "mode" || la.network != "unix" {
+			return la, fmt.Errorf("redhub: unknown option %q in address %q", key, addr)
+		}
+		mode, err := strconv.ParseUint(vals[len(vals)-1], 8, 32)
+		if err != nil || mode > 0777 || mode == 0 {
+			return la, fmt.Errorf("redhub: invalid mode in address %q", addr)
+		}
+		if runtime.GOOS == "windows" {
+			return la, fmt.Errorf("redhub: the mode of Unix sockets is not supported on Windows, in address %q", addr)
+		}
+		la.mode = os.FileMode(mode)
+	}
+	return la, nil
+}
+
+// listen starts listening on the address. A stale Unix socket file is
+// removed first.
+func (la listenAddr) listen() (net.Listener, error) {
+	if la.network != "unix" || la.mode == 0 {
+		if la.network == "unix" {
+			_ = os.Remove(la.address)
+		}
+		return net.Listen(la.network, la.address)
+	}
+
+	ps, err := la.privateSocket()
+	if err != nil {
+		return nil, err
+	}
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: ps.path, Net: "unix"})
+	if err != nil {
+		ps.close()
+		return nil, err
+	}
+	ln.SetUnlinkOnClose(false)
+	if err := ps.publish(); err != nil {
+		_ = ln.Close()
+		ps.close()
+		return nil, err
+	}
+	return &unixListener{UnixListener: ln, ps: ps}, nil
+}
+
+// privateSocket is where a Unix socket with a file mode is created: in a
+// directory of its own, that only the process can enter, next to the
+// socket's address. No client can connect before the socket has its mode
+// and is renamed into place, replacing any stale socket file.
+type privateSocket struct {
+	dir       string
+	path      string
+	address   string
+	mode      os.FileMode
+	published bool
+	// err is the error publish failed with.
+	err error
+}
+
+func (la listenAddr) privateSocket() (*privateSocket, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(la.address), ".redhub-")
+	if err != nil {
+		return nil, err
+	}
+	return &privateSocket{
+		dir:     dir,
+		path:    filepath.Join(dir, "s"),
+		address: la.address,
+		mode:    la.mode,
+	}, nil
+}
+
+// publish gives the socket created at path its mode and renames it to its
+// address.
+func (ps *privateSocket) publish() error {
+	if err := os.Chmod(ps.path, ps.mode); err != nil {
+		ps.err = err
+		return err
+	}
+	if err := os.Rename(ps.path, ps.address); err != nil {
+		ps.err = err
+		return err
+	}
+	ps.published = true
+	_ = os.Remove(ps.dir)
+	return nil
+}
+
+// close removes the directory and, once published, the socket file.
+func (ps *privateSocket) close() {
+	_ = os.RemoveAll(ps.dir)
+	if ps.published {
+		_ = os.Remove(ps.address)
+	}
+}
+
+// unixListener is a listener on a socket created by a privateSocket, which
+// reports and removes the socket's final address.
+type unixListener struct {
+	*net.UnixListener
+	ps   *privateSocket
+	once sync.Once
+}
+
+func (l *unixListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: l.ps.address, Net: "unix"}
+}
+
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	l.once.Do(l.ps.close)
+	return err
+}
+
+// listenAddrs starts the listeners of Options.Addrs and Options.TLS.
+func (rs *RedHub) listenAddrs() error {
+	for _, addr := range rs.options.Addrs {
+		la, err := parseAddr(addr)
+		if err != nil {
+			return err
+		}
+		ln, err := la.listen()
+		if err != nil {
+			return err
+		}
+		rs.connSync.Lock()
+		rs.listeners = append(rs.listeners, ln)
+		rs.addrs = append(rs.addrs, ln.Addr())
+		rs.connSync.Unlock()
+
+		rs.netConns.Add(1)
+		go rs.serveListener(ln, la.name, 0)
+	}
+	return rs.listenTLS()
+}
+
+// closeListeners stops accepting connections on the listeners served
+// outside of gnet.
+func (rs *RedHub) closeListeners() {
+	rs.connSync.Lock()
+	lns := rs.listeners
+	rs.listeners = nil
+	rs.connSync.Unlock()
+
+	for _, ln := range lns {
+		_ = ln.Close()
+	}
+}
+
+// closeNetConns closes the listeners served outside of gnet and the
+// connections accepted on them, and waits for their goroutines to exit.
+func (rs *RedHub) closeNetConns() {
+	rs.closeListeners()
+
+	rs.connSync.RLock()
+	conns := make([]*conn, 0, len(rs.conns))
+	for c := range rs.conns {
+		conns = append(conns, c)
+	}
+	rs.connSync.RUnlock()
+	for _, c := range conns {
+		if _, ok := c.conn.(*netTransport); ok {
+			_ = c.close()
+		}
+	}
+	rs.netConns.Wait()
+}
+
+// connAddr returns the address reported for one end of a connection.
+// Unix socket clients have no address of their own and are reported with
+// the socket path, as Redis does.
+func connAddr(addr net.Addr, socket string) string {
+	if addr == nil || addr.Network() == "unix" {
+		return socket
+	}
+	return addr.String()
+}
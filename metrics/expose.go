@@ -0,0 +1,162 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// contentType is the content type of the Prometheus text format.
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// ServeHTTP serves the metrics in the Prometheus text format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", contentType)
+	_, _ = m.WriteTo(w)
+}
+
+// ListenAndServe serves the metrics over HTTP on addr, at /metrics, until
+// the listener fails.
+func (m *Metrics) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return m.Serve(ln)
+}
+
+// Serve serves the metrics over HTTP on ln, at /metrics, until ln is
+// closed.
+func (m *Metrics) Serve(ln net.Listener) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	return http.Serve(ln, mux)
+}
+
+// WriteTo writes the metrics to w in the Prometheus text format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	e := &encoder{w: bufio.NewWriter(cw), ns: m.opts.Namespace}
+
+	e.counter("connections_opened_total", "Connections opened.", atomic.LoadUint64(&m.opened))
+	e.counter("connections_closed_total", "Connections closed.", atomic.LoadUint64(&m.closed))
+	e.header("connections", "Connections currently open.", "gauge")
+	e.sample("connections", "", float64(atomic.LoadInt64(&m.current)))
+	e.counter("read_bytes_total", "Bytes read from clients.", atomic.LoadUint64(&m.bytesIn))
+	e.counter("written_bytes_total", "Bytes sent to clients.", atomic.LoadUint64(&m.bytesOut))
+	e.counter("parse_errors_total", "Client data that could not be parsed as commands.",
+		atomic.LoadUint64(&m.parseErrors))
+	e.counter("buffer_reallocations_total", "Read buffers of idle connections reallocated by the ticker.",
+		atomic.LoadUint64(&m.reallocs))
+	e.header("pipeline_depth", "Commands served per pipeline.", "histogram")
+	e.histogram("pipeline_depth", "", m.pipeline)
+
+	m.mu.RLock()
+	names := make([]string, 0, len(m.commands))
+	commands := make(map[string]*commandStats, len(m.commands))
+	for name, stats := range m.commands {
+		names = append(names, name)
+		commands[name] = stats
+	}
+	prefixes := make([]string, 0, len(m.errors))
+	errors := make(map[string]*uint64, len(m.errors))
+	for prefix, n := range m.errors {
+		prefixes = append(prefixes, prefix)
+		errors[prefix] = n
+	}
+	m.mu.RUnlock()
+	sort.Strings(names)
+	sort.Strings(prefixes)
+
+	e.header("commands_total", "Commands served, by command.", "counter")
+	for _, name := range names {
+		e.sample("commands_total", label("command", name), float64(atomic.LoadUint64(&commands[name].calls)))
+	}
+	e.header("command_duration_seconds", "Time spent serving commands, by command.", "histogram")
+	for _, name := range names {
+		e.histogram("command_duration_seconds", label("command", name), commands[name].latency)
+	}
+	e.header("command_errors_total", "Error replies, by the first word of the error.", "counter")
+	for _, prefix := range prefixes {
+		e.sample("command_errors_total", label("prefix", prefix), float64(atomic.LoadUint64(errors[prefix])))
+	}
+
+	err := e.w.Flush()
+	return cw.n, err
+}
+
+// encoder writes metrics in the Prometheus text format.
+type encoder struct {
+	w  *bufio.Writer
+	ns string
+}
+
+func (e *encoder) header(name, help, typ string) {
+	e.w.WriteString("# HELP " + e.ns + "_" + name + " " + help + "\n")
+	e.w.WriteString("# TYPE " + e.ns + "_" + name + " " + typ + "\n")
+}
+
+func (e *encoder) counter(name, help string, v uint64) {
+	e.header(name, help, "counter")
+	e.sample(name, "", float64(v))
+}
+
+// sample writes a sample. labels are formatted by label, comma separated.
+func (e *encoder) sample(name, labels string, v float64) {
+	e.w.WriteString(e.ns + "_" + name)
+	if labels != "" {
+		e.w.WriteString("{" + labels + "}")
+	}
+	e.w.WriteString(" " + formatFloat(v) + "\n")
+}
+
+func (e *encoder) histogram(name, labels string, h *histogram) {
+	buckets, sum := h.snapshot()
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	for i, n := range buckets {
+		le := math.Inf(1)
+		if i < len(h.bounds) {
+			le = h.bounds[i]
+		}
+		e.sample(name+"_bucket", labels+sep+label("le", formatFloat(le)), float64(n))
+	}
+	e.sample(name+"_sum", labels, sum)
+	e.sample(name+"_count", labels, float64(buckets[len(buckets)-1]))
+}
+
+// label formats a label pair, escaping its value.
+func label(name, value string) string {
+	return name + `="` + labelEscaper.Replace(value) + `"`
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
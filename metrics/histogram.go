@@ -0,0 +1,48 @@
+package metrics
+
+import (
+	"math"
+	"sort"
+	"sync/atomic"
+)
+
+// histogram counts observations in buckets, as a Prometheus histogram.
+// It is safe for concurrent use.
+type histogram struct {
+	bounds []float64
+	// counts holds the observations of each bucket, not cumulated, and of
+	// the +Inf bucket last.
+	counts []uint64
+	sum    uint64 // float64 bits
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+func (h *histogram) observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	atomic.AddUint64(&h.counts[i], 1)
+	for {
+		old := atomic.LoadUint64(&h.sum)
+		sum := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&h.sum, old, sum) {
+			return
+		}
+	}
+}
+
+// snapshot returns the cumulative count of each bucket, the +Inf bucket
+// last, and the sum of the observations.
+func (h *histogram) snapshot() (buckets []uint64, sum float64) {
+	buckets = make([]uint64, len(h.counts))
+	var total uint64
+	for i := range h.counts {
+		total += atomic.LoadUint64(&h.counts[i])
+		buckets[i] = total
+	}
+	return buckets, math.Float64frombits(atomic.LoadUint64(&h.sum))
+}
@@ -0,0 +1,207 @@
+// Package metrics collects the operational metrics of a redhub server and
+// exposes them in the Prometheus text format:
+//
+//	m := metrics.New(metrics.Options{Mux: mux})
+//	rh.Observe(m)
+//	go m.ListenAndServe(":9121")
+//
+// It counts connections, commands per name, error replies per prefix, bytes
+// read and written, pipeline depth, parse errors and buffer reallocations,
+// and keeps latency histograms per command, without instrumenting handlers.
+package metrics
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IceFireDB/redhub"
+	"github.com/IceFireDB/redhub/pkg/resp"
+)
+
+const (
+	// DefaultMaxCommands is the default number of command names reported
+	// separately.
+	DefaultMaxCommands = 256
+
+	// maxErrorPrefixes is the number of error prefixes reported separately,
+	// the limit Redis applies to its errorstats.
+	maxErrorPrefixes = 128
+
+	// otherLabel is the label of the commands and errors beyond the limits,
+	// and unknownLabel that of commands the Mux doesn't know.
+	otherLabel   = "other"
+	unknownLabel = "unknown"
+)
+
+// DefaultLatencyBuckets are the upper bounds, in seconds, of the default
+// command latency histogram buckets, from 10µs to 1s.
+var DefaultLatencyBuckets = []float64{
+	.00001, .000025, .00005, .0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1,
+}
+
+// pipelineBuckets are the upper bounds of the pipeline depth histogram.
+var pipelineBuckets = []float64{1, 2, 4, 8, 16, 32, 64, 128, 256, 512, 1024}
+
+// Options configures the metrics.
+type Options struct {
+	// Namespace prefixes the metric names. The default is "redhub".
+	Namespace string
+
+	// Mux, when set, limits the command names reported to those it knows.
+	// Other commands are reported as "unknown", so clients sending made-up
+	// commands can't grow the number of series.
+	Mux *redhub.Mux
+
+	// MaxCommands bounds the number of command names reported separately.
+	// Commands seen once the limit is reached are reported as "other". The
+	// default is DefaultMaxCommands; a negative value reports every command
+	// as "other".
+	MaxCommands int
+
+	// LatencyBuckets are the upper bounds, in seconds, of the buckets of
+	// the command latency histograms. The default is
+	// DefaultLatencyBuckets.
+	LatencyBuckets []float64
+}
+
+// Metrics collects the metrics of the RedHub it observes. It implements
+// redhub.Observer and http.Handler.
+type Metrics struct {
+	opts Options
+
+	opened      uint64
+	closed      uint64
+	current     int64
+	bytesIn     uint64
+	bytesOut    uint64
+	parseErrors uint64
+	reallocs    uint64
+	pipeline    *histogram
+
+	mu       sync.RWMutex
+	commands map[string]*commandStats
+	errors   map[string]*uint64
+}
+
+// commandStats are the metrics of a command name.
+type commandStats struct {
+	calls   uint64
+	latency *histogram
+}
+
+// New returns metrics configured by opts.
+func New(opts Options) *Metrics {
+	if opts.Namespace == "" {
+		opts.Namespace = "redhub"
+	}
+	if opts.MaxCommands == 0 {
+		opts.MaxCommands = DefaultMaxCommands
+	}
+	if len(opts.LatencyBuckets) == 0 {
+		opts.LatencyBuckets = DefaultLatencyBuckets
+	}
+	return &Metrics{
+		opts:     opts,
+		pipeline: newHistogram(pipelineBuckets),
+		commands: make(map[string]*commandStats),
+		errors:   make(map[string]*uint64),
+	}
+}
+
+func (m *Metrics) ConnOpened(c redhub.Conn) {
+	atomic.AddUint64(&m.opened, 1)
+	atomic.AddInt64(&m.current, 1)
+}
+
+func (m *Metrics) ConnClosed(c redhub.Conn, err error) {
+	atomic.AddUint64(&m.closed, 1)
+	atomic.AddInt64(&m.current, -1)
+}
+
+func (m *Metrics) Read(c redhub.Conn, n int)    { atomic.AddUint64(&m.bytesIn, uint64(n)) }
+func (m *Metrics) Written(c redhub.Conn, n int) { atomic.AddUint64(&m.bytesOut, uint64(n)) }
+
+func (m *Metrics) ParseError(c redhub.Conn, err error) {
+	atomic.AddUint64(&m.parseErrors, 1)
+}
+
+func (m *Metrics) Pipeline(c redhub.Conn, n int) {
+	m.pipeline.observe(float64(n))
+}
+
+func (m *Metrics) BuffersReclaimed(n int) {
+	atomic.AddUint64(&m.reallocs, uint64(n))
+}
+
+func (m *Metrics) CommandServed(c redhub.Conn, cmd resp.Command, d time.Duration, errPrefix string) {
+	if len(cmd.Args) == 0 {
+		return
+	}
+	stats := m.command(cmd.Args[0])
+	atomic.AddUint64(&stats.calls, 1)
+	stats.latency.observe(d.Seconds())
+	if errPrefix != "" {
+		atomic.AddUint64(m.errorCounter(errPrefix), 1)
+	}
+}
+
+// command returns the stats of the command named name, creating them if
+// the limits allow.
+func (m *Metrics) command(name []byte) *commandStats {
+	var buf [32]byte
+	lname := resp.AppendLower(buf[:0], name)
+
+	m.mu.RLock()
+	stats := m.commands[string(lname)]
+	m.mu.RUnlock()
+	if stats != nil {
+		return stats
+	}
+
+	label := string(lname)
+	if m.opts.Mux != nil && m.opts.Mux.LookupName(label) == nil {
+		label = unknownLabel
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if stats = m.commands[label]; stats != nil {
+		return stats
+	}
+	if label != unknownLabel && len(m.commands) >= m.opts.MaxCommands {
+		label = otherLabel
+		if stats = m.commands[label]; stats != nil {
+			return stats
+		}
+	}
+	stats = &commandStats{latency: newHistogram(m.opts.LatencyBuckets)}
+	m.commands[label] = stats
+	return stats
+}
+
+// errorCounter returns the counter of the error prefix, or of "other" when
+// there are too many prefixes already.
+func (m *Metrics) errorCounter(prefix string) *uint64 {
+	m.mu.RLock()
+	n := m.errors[prefix]
+	m.mu.RUnlock()
+	if n != nil {
+		return n
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if n = m.errors[prefix]; n != nil {
+		return n
+	}
+	if len(m.errors) >= maxErrorPrefixes {
+		prefix = otherLabel
+		if n = m.errors[prefix]; n != nil {
+			return n
+		}
+	}
+	n = new(uint64)
+	m.errors[prefix] = n
+	return n
+}
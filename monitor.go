@@ -0,0 +1,312 @@
+package redhub
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IceFireDB/redhub/pkg/resp"
+)
+
+// monitorMaxPending bounds the output a monitor may fall behind by before it
+// is disconnected, as Redis does with clients over their output buffer
+// limit.
+const monitorMaxPending = 16 << 20
+
+// monitors are the connections that ran MONITOR, and how the commands they
+// are sent are redacted.
+type monitors struct {
+	// n is the number of monitors, checked for every command served.
+	n int32
+
+	mu     sync.RWMutex
+	mux    *Mux
+	conns  map[*conn]*monitor
+	redact map[string]func(args []string)
+}
+
+// monitor delivers the lines of a monitoring connection from a goroutine of
+// its own, so serving commands never waits for it.
+type monitor struct {
+	c    *conn
+	kick chan struct{}
+	done chan struct{}
+
+	mu       sync.Mutex
+	buf      []byte
+	overflow bool
+}
+
+// RedactMonitor sets how MONITOR shows the commands named name, "parent|sub"
+// for subcommands: redact is passed a copy of the arguments, starting with
+// the command name, and replaces the sensitive ones in place. The arguments
+// of AUTH and the credentials of HELLO AUTH are redacted by default:
+//
+//	rh.RedactMonitor("setsecret", func(args []string) {
+//		for i := 2; i < len(args); i++ {
+//			args[i] = "(redacted)"
+//		}
+//	})
+//
+// Redactors must be set before the server starts.
+func (rs *RedHub) RedactMonitor(name string, redact func(args []string)) {
+	m := &rs.monitors
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.redactors()[strings.ToLower(name)] = redact
+}
+
+// redactors returns the redactors, with the default ones when none were set
+// yet. The caller must hold mu.
+func (m *monitors) redactors() map[string]func(args []string) {
+	if m.redact == nil {
+		m.redact = map[string]func(args []string){
+			"auth":  redactAuth,
+			"hello": redactHello,
+		}
+	}
+	return m.redact
+}
+
+func redactAuth(args []string) {
+	for i := 1; i < len(args); i++ {
+		args[i] = "(redacted)"
+	}
+}
+
+func redactHello(args []string) {
+	for i := 2; i < len(args); i++ {
+		if strings.EqualFold(args[i], "auth") {
+			for j := i + 1; j < len(args) && j <= i+2; j++ {
+				args[j] = "(redacted)"
+			}
+			return
+		}
+	}
+}
+
+// MonitorCommand returns the spec of the MONITOR command. Register it on the
+// Mux:
+//
+//	mux.Handle(rh.MonitorCommand(mux))
+//
+// Connections that run MONITOR are sent a line for each command any
+// connection is served, such as
+//
+//	+1700000000.123456 [0 127.0.0.1:5555] "SET" "k" "v"
+//
+// Commands m flags with FlagAdmin or FlagSkipMonitor are not shown, as in
+// Redis, nor commands m rejects. Lines are delivered asynchronously, by a
+// goroutine of each monitor; a monitor that falls 16MB behind is
+// disconnected.
+func (rs *RedHub) MonitorCommand(m *Mux) CommandSpec {
+	rs.monitors.mu.Lock()
+	rs.monitors.mux = m
+	rs.monitors.redactors()
+	rs.monitors.mu.Unlock()
+	return CommandSpec{
+		Name: "monitor", Arity: 1, Handler: rs.monitor,
+		Flags:      FlagAdmin | FlagNoScript | FlagLoading | FlagStale,
+		Categories: []string{"admin", "slow", "dangerous"}, Group: "server",
+		Summary: "Listens for all requests received by the server in real-time.", Since: "1.0.0",
+	}
+}
+
+func (rs *RedHub) monitor(c Conn, cmd resp.Command) Action {
+	cc, ok := c.(*conn)
+	if !ok {
+		c.WriteError("ERR MONITOR is not supported on this connection")
+		return None
+	}
+	m := &rs.monitors
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.conns == nil {
+		m.conns = make(map[*conn]*monitor)
+	}
+	if _, ok := m.conns[cc]; !ok && !cc.isClosed() {
+		mon := &monitor{c: cc, kick: make(chan struct{}, 1), done: make(chan struct{})}
+		m.conns[cc] = mon
+		atomic.AddInt32(&m.n, 1)
+		go mon.run()
+	}
+	c.WriteString("OK")
+	return None
+}
+
+// unmonitor stops sending commands to c, if it is a monitor.
+func (rs *RedHub) unmonitor(c *conn) {
+	m := &rs.monitors
+	if atomic.LoadInt32(&m.n) == 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if mon, ok := m.conns[c]; ok {
+		delete(m.conns, c)
+		atomic.AddInt32(&m.n, -1)
+		close(mon.done)
+	}
+}
+
+// monitoring reports whether any connection is a monitor.
+func (rs *RedHub) monitoring() bool {
+	return atomic.LoadInt32(&rs.monitors.n) > 0
+}
+
+// feedMonitors sends cmd, served on c, to the monitors.
+func (rs *RedHub) feedMonitors(c *conn, cmd resp.Command) {
+	m := &rs.monitors
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if len(m.conns) == 0 || len(cmd.Args) == 0 {
+		return
+	}
+	// As in Redis, commands that are rejected are not shown either.
+	if m.mux != nil && (m.mux.Validate(cmd.Args) != nil || m.mux.flagged(cmd.Args, FlagAdmin|FlagSkipMonitor)) {
+		return
+	}
+	line := m.line(c, cmd.Args)
+	for _, mon := range m.conns {
+		mon.send(line)
+	}
+}
+
+// line formats a command as MONITOR shows it. The caller must hold mu.
+func (m *monitors) line(c *conn, args [][]byte) []byte {
+	strs := m.redacted(args)
+	now := time.Now()
+	b := make([]byte, 0, 64)
+	b = append(b, '+')
+	b = strconv.AppendInt(b, now.Unix(), 10)
+	b = append(b, '.')
+	usec := strconv.Itoa(now.Nanosecond() / 1000)
+	b = append(b, "000000"[len(usec):]...)
+	b = append(b, usec...)
+	b = append(b, " [0 "...)
+	b = append(b, c.RemoteAddr()...)
+	b = append(b, ']')
+	for i, arg := range args {
+		b = append(b, ' ')
+		if strs != nil {
+			b = appendRepr(b, strs[i])
+		} else {
+			b = appendRepr(b, string(arg))
+		}
+	}
+	return append(b, '\r', '\n')
+}
+
+// redacted returns a copy of args with the sensitive ones redacted, or nil
+// when no redactor is set for the command. It is shared with SLOWLOG. The
+// caller must hold mu.
+func (m *monitors) redacted(args [][]byte) []string {
+	redact := m.redact[m.name(args)]
+	if redact == nil {
+		return nil
+	}
+	strs := make([]string, len(args))
+	for i, arg := range args {
+		strs[i] = string(arg)
+	}
+	redact(strs)
+	return strs
+}
+
+// name returns the name redactors are registered by for the command args
+// invoke.
+func (m *monitors) name(args [][]byte) string {
+	if m.mux != nil {
+		if mc := m.mux.lookup(args); mc != nil {
+			if _, ok := m.redact[mc.fullName]; ok {
+				return mc.fullName
+			}
+		}
+	}
+	return strings.ToLower(string(args[0]))
+}
+
+// appendRepr appends s quoted and escaped as Redis does in MONITOR.
+func appendRepr(b []byte, s string) []byte {
+	const hex = "0123456789abcdef"
+	b = append(b, '"')
+	for i := 0; i < len(s); i++ {
+		switch ch := s[i]; ch {
+		case '\\', '"':
+			b = append(b, '\\', ch)
+		case '\n':
+			b = append(b, '\\', 'n')
+		case '\r':
+			b = append(b, '\\', 'r')
+		case '\t':
+			b = append(b, '\\', 't')
+		case '\a':
+			b = append(b, '\\', 'a')
+		case '\b':
+			b = append(b, '\\', 'b')
+		default:
+			if ch >= 0x20 && ch <= 0x7e {
+				b = append(b, ch)
+			} else {
+				b = append(b, '\\', 'x', hex[ch>>4], hex[ch&0xf])
+			}
+		}
+	}
+	return append(b, '"')
+}
+
+// send queues a line for the monitor's goroutine.
+func (mon *monitor) send(line []byte) {
+	mon.mu.Lock()
+	if mon.overflow {
+		mon.mu.Unlock()
+		return
+	}
+	if len(mon.buf)+len(line) > monitorMaxPending {
+		mon.overflow = true
+		mon.buf = nil
+	} else {
+		mon.buf = append(mon.buf, line...)
+	}
+	mon.mu.Unlock()
+
+	select {
+	case mon.kick <- struct{}{}:
+	default:
+	}
+}
+
+// run writes the queued lines to the monitor until it is closed. It waits
+// for each write to be sent before the next, so the lines of a slow monitor
+// queue up in buf.
+func (mon *monitor) run() {
+	var out []byte
+	sent := make(chan struct{}, 1)
+	writing := false
+	for {
+		select {
+		case <-mon.kick:
+		case <-sent:
+			writing = false
+		case <-mon.done:
+			return
+		}
+		mon.mu.Lock()
+		overflow := mon.overflow
+		if !writing {
+			out, mon.buf = mon.buf, out[:0]
+		}
+		mon.mu.Unlock()
+
+		if overflow {
+			_ = mon.c.close()
+			return
+		}
+		if !writing && len(out) > 0 {
+			writing = true
+			mon.c.asyncWrite(out, func() { sent <- struct{}{} })
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package redhub
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/IceFireDB/redhub/pkg/resp"
+)
+
+// CommandFlag describes properties of a command, as reported by COMMAND.
+type CommandFlag uint32
+
+const (
+	// FlagWrite marks commands that may modify data.
+	FlagWrite CommandFlag = 1 << iota
+	// FlagReadOnly marks commands that only read data.
+	FlagReadOnly
+	// FlagDenyOOM marks commands that may grow memory usage.
+	FlagDenyOOM
+	// FlagAdmin marks administrative commands.
+	FlagAdmin
+	// FlagPubSub marks publish/subscribe commands.
+	FlagPubSub
+	// FlagNoScript marks commands that are not allowed in scripts.
+	FlagNoScript
+	// FlagBlocking marks commands that may block the client.
+	FlagBlocking
+	// FlagLoading marks commands allowed while the dataset is loading.
+	FlagLoading
+	// FlagStale marks commands allowed while serving stale data.
+	FlagStale
+	// FlagSkipMonitor marks commands that are not shown by MONITOR.
+	FlagSkipMonitor
+	// FlagSkipSlowlog marks commands that are not recorded by SLOWLOG.
+	FlagSkipSlowlog
+	// FlagFast marks commands that run in constant or log(N) time.
+	FlagFast
+	// FlagNoAuth marks commands that may run before authentication.
+	FlagNoAuth
+	// FlagNoMulti marks commands that can't be queued in a transaction.
+	FlagNoMulti
+)
+
+// CommandSpec declares a command served by a Mux.
+type CommandSpec struct {
+	// Name is the command name, matched case-insensitively.
+	Name string
+	// Arity is the number of arguments, including the command name. A
+	// negative value -N means at least N arguments.
+	Arity int
+	// Flags describes the command.
+	Flags CommandFlag
+	// FirstKey, LastKey and KeyStep give the positions of the key
+	// arguments. LastKey may be negative to count from the last argument.
+	// All three are zero for commands that take no keys.
+	FirstKey int
+	LastKey  int
+	KeyStep  int
+	// Handler serves the command. Subcommands without a handler of their
+	// own use the handler of their parent.
+	Handler HandlerFunc
+	// Subcommands are the subcommands of a container command such as
+	// CLIENT or CONFIG, selected by the second argument.
+	Subcommands []CommandSpec
+
+	// Categories lists ACL categories, without the leading '@', in
+	// addition to the ones implied by Flags, for example "string" or
+	// "keyspace".
+	Categories []string
+
+	// Summary, Since, Group and Complexity document the command for
+	// COMMAND DOCS. Group defaults to "generic".
+	Summary    string
+	Since      string
+	Group      string
+	Complexity string
+}
+
+// muxCommand is a registered command.
+type muxCommand struct {
+	CommandSpec
+	// fullName is the name used in error replies, "parent|sub" for
+	// subcommands.
+	fullName string
+	subs     map[string]*muxCommand
+}
+
+// Mux is a command router. Commands are registered with their metadata and
+// the Mux dispatches each command to its handler, replying with the Redis
+// errors for unknown commands and wrong arities. A Mux is passed to
+// NewRedHub as the handler:
+//
+//	mux := redhub.NewMux()
+//	mux.Handle(redhub.CommandSpec{Name: "get", Arity: 2, Flags: redhub.FlagReadOnly | redhub.FlagFast,
+//		FirstKey: 1, LastKey: 1, KeyStep: 1, Handler: get})
+//	rh := redhub.NewRedHub(onOpened, onClosed, mux.ServeRESP, tickFreq, reclaimMemAfter)
+//
+// Commands must be registered before the server starts.
+type Mux struct {
+	commands map[string]*muxCommand
+}
+
+// NewMux creates a new Mux. The COMMAND command is registered on it, and
+// answers from the commands registered afterwards.
+func NewMux() *Mux {
+	m := &Mux{
+		commands: make(map[string]*muxCommand),
+	}
+	m.Handle(m.commandSpec())
+	return m
+}
+
+// Handle registers commands, replacing any command with the same name.
+func (m *Mux) Handle(specs ...CommandSpec) {
+	for _, spec := range specs {
+		cmd := newMuxCommand(spec, "", nil)
+		m.commands[strings.ToLower(spec.Name)] = cmd
+	}
+}
+
+// HandleFunc registers a command with the given arity and no further
+// metadata.
+func (m *Mux) HandleFunc(name string, arity int, handler HandlerFunc) {
+	m.Handle(CommandSpec{Name: name, Arity: arity, Handler: handler})
+}
+
+func newMuxCommand(spec CommandSpec, parent string, handler HandlerFunc) *muxCommand {
+	if spec.Handler == nil {
+		spec.Handler = handler
+	}
+	cmd := &muxCommand{
+		CommandSpec: spec,
+		fullName:    strings.ToLower(spec.Name),
+	}
+	if parent != "" {
+		cmd.fullName = parent + "|" + cmd.fullName
+	}
+	if len(spec.Subcommands) == 0 {
+		if spec.Handler == nil {
+			panic("redhub: command " + cmd.fullName + " has no handler")
+		}
+		return cmd
+	}
+	if spec.Handler == nil && cmd.arityOK(1) {
+		panic("redhub: container command " + cmd.fullName + " has no handler but its arity allows no subcommand")
+	}
+	cmd.subs = make(map[string]*muxCommand, len(spec.Subcommands))
+	for _, sub := range spec.Subcommands {
+		cmd.subs[strings.ToLower(sub.Name)] = newMuxCommand(sub, cmd.fullName, spec.Handler)
+	}
+	return cmd
+}
+
+// Lookup returns the spec of the command, or subcommand, that args invokes,
+// or nil when there is none.
+func (m *Mux) Lookup(args [][]byte) *CommandSpec {
+	cmd := m.lookup(args)
+	if cmd == nil || (cmd.subs != nil && len(args) > 1) {
+		return nil
+	}
+	return &cmd.CommandSpec
+}
+
+// LookupName returns the spec of a command by its full name, "parent|sub"
+// for subcommands, or nil when there is none.
+func (m *Mux) LookupName(name string) *CommandSpec {
+	mc := m.byFullName(name)
+	if mc == nil {
+		return nil
+	}
+	return &mc.CommandSpec
+}
+
+// Names returns the full names of the registered commands and their
+// subcommands, sorted.
+func (m *Mux) Names() []string {
+	var names []string
+	for _, mc := range m.sorted() {
+		names = append(names, mc.fullName)
+		for _, sub := range mc.sortedSubs() {
+			names = append(names, sub.fullName)
+		}
+	}
+	return names
+}
+
+// lookup returns the registered command for args. For container commands it
+// returns the subcommand, or the container itself when the subcommand is
+// missing or unknown.
+func (m *Mux) lookup(args [][]byte) *muxCommand {
+	if len(args) == 0 {
+		return nil
+	}
+	var buf [maxLowerName]byte
+	cmd := m.commands[string(resp.AppendLower(buf[:0], args[0]))]
+	if cmd == nil || cmd.subs == nil || len(args) < 2 {
+		return cmd
+	}
+	if sub := cmd.subs[string(resp.AppendLower(buf[:0], args[1]))]; sub != nil {
+		return sub
+	}
+	return cmd
+}
+
+// flagged reports whether the command args invokes, or the container of the
+// subcommand it invokes, has flag.
+func (m *Mux) flagged(args [][]byte, flag CommandFlag) bool {
+	mc := m.lookup(args)
+	if mc == nil {
+		return false
+	}
+	if mc.Flags&flag != 0 {
+		return true
+	}
+	var buf [maxLowerName]byte
+	parent := m.commands[string(resp.AppendLower(buf[:0], args[0]))]
+	return parent != mc && parent.Flags&flag != 0
+}
+
+// ServeRESP dispatches cmd to the handler of the registered command. Its
+// signature matches the handler argument of NewRedHub.
+func (m *Mux) ServeRESP(c Conn, cmd resp.Command) Action {
+	mc, msg := m.resolve(cmd.Args)
+	if msg != "" {
+		c.WriteError(msg)
+		return None
+	}
+	return mc.Handler(c, cmd)
+}
+
+// Validate returns the error ServeRESP would reply with when args don't
+// invoke a registered command with a valid number of arguments, or nil.
+func (m *Mux) Validate(args [][]byte) error {
+	if _, msg := m.resolve(args); msg != "" {
+		return errors.New(msg)
+	}
+	return nil
+}
+
+// resolve returns the command args invokes, or the error message to reply
+// with.
+func (m *Mux) resolve(args [][]byte) (*muxCommand, string) {
+	mc := m.lookup(args)
+	if mc == nil {
+		return nil, unknownCommandError(args)
+	}
+	if mc.subs != nil && len(args) > 1 {
+		return nil, "ERR unknown subcommand '" + truncate(args[1], 128) +
+			"'. Try " + strings.ToUpper(mc.Name) + " HELP."
+	}
+	// A container without a handler of its own is only reached without a
+	// subcommand.
+	if !mc.arityOK(len(args)) || mc.Handler == nil {
+		return nil, "ERR wrong number of arguments for '" + mc.fullName + "' command"
+	}
+	return mc, ""
+}
+
+func (mc *muxCommand) arityOK(argc int) bool {
+	if mc.Arity >= 0 {
+		return argc == mc.Arity
+	}
+	return argc >= -mc.Arity
+}
+
+// unknownCommandError formats the error Redis replies with for an unknown
+// command, quoting the beginning of its arguments.
+func unknownCommandError(args [][]byte) string {
+	var sb strings.Builder
+	sb.WriteString("ERR unknown command '")
+	sb.WriteString(truncate(args[0], 128))
+	sb.WriteString("', with args beginning with: ")
+	var n int
+	for _, arg := range args[1:] {
+		if n >= 128 {
+			break
+		}
+		quoted := truncate(arg, 128-n)
+		sb.WriteString("'" + quoted + "' ")
+		n += len(quoted) + 3
+	}
+	return sb.String()
+}
+
+func truncate(b []byte, n int) string {
+	if len(b) > n {
+		b = b[:n]
+	}
+	return string(b)
+}
+
+// maxLowerName is the longest command name matched without allocating.
+const maxLowerName = 32
@@ -0,0 +1,90 @@
+package redhub
+
+import (
+	"testing"
+
+	"github.com/IceFireDB/redhub/pkg/resp"
+)
+
+func nop(c Conn, cmd resp.Command) Action { return None }
+
+func args(strs ...string) [][]byte {
+	out := make([][]byte, len(strs))
+	for i, s := range strs {
+		out[i] = []byte(s)
+	}
+	return out
+}
+
+func TestMuxResolve(t *testing.T) {
+	m := NewMux()
+	m.HandleFunc("get", 2, nop)
+	m.HandleFunc("mset", -3, nop)
+	m.Handle(CommandSpec{
+		Name: "config", Arity: -2,
+		Subcommands: []CommandSpec{
+			{Name: "get", Arity: 3, Handler: nop},
+			{Name: "set", Arity: -4, Handler: nop},
+		},
+	})
+	m.Handle(CommandSpec{
+		Name: "object", Arity: -1, Handler: nop,
+		Subcommands: []CommandSpec{
+			{Name: "encoding", Arity: 3},
+		},
+	})
+
+	tests := []struct {
+		args []string
+		name string // the full name of the command resolved, or ""
+		err  string
+	}{
+		{[]string{"GET", "k"}, "get", ""},
+		{[]string{"get"}, "", "ERR wrong number of arguments for 'get' command"},
+		{[]string{"get", "k", "x"}, "", "ERR wrong number of arguments for 'get' command"},
+		{[]string{"mset", "k", "v"}, "mset", ""},
+		{[]string{"mset", "k"}, "", "ERR wrong number of arguments for 'mset' command"},
+		{[]string{"nosuch", "a", "b"}, "", "ERR unknown command 'nosuch', with args beginning with: 'a' 'b' "},
+		{[]string{"CONFIG", "Get", "maxmemory"}, "config|get", ""},
+		{[]string{"config", "get"}, "", "ERR wrong number of arguments for 'config|get' command"},
+		{[]string{"config", "set", "a", "b"}, "config|set", ""},
+		{[]string{"config", "nosuch"}, "", "ERR unknown subcommand 'nosuch'. Try CONFIG HELP."},
+		// A container without a handler of its own needs a subcommand.
+		{[]string{"config"}, "", "ERR wrong number of arguments for 'config' command"},
+		// One with a handler serves the calls without a subcommand.
+		{[]string{"object"}, "object", ""},
+		{[]string{"object", "encoding", "k"}, "object|encoding", ""},
+		{[]string{"object", "freq", "k"}, "", "ERR unknown subcommand 'freq'. Try OBJECT HELP."},
+	}
+	for _, tt := range tests {
+		mc, msg := m.resolve(args(tt.args...))
+		if msg != tt.err {
+			t.Errorf("resolve(%q) replies %q, want %q", tt.args, msg, tt.err)
+			continue
+		}
+		if tt.name == "" {
+			if mc != nil {
+				t.Errorf("resolve(%q) = %s, want nil", tt.args, mc.fullName)
+			}
+			continue
+		}
+		if mc == nil || mc.fullName != tt.name || mc.Handler == nil {
+			t.Errorf("resolve(%q) = %+v, want %s with a handler", tt.args, mc, tt.name)
+		}
+	}
+}
+
+func TestMuxContainerWithoutHandler(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a container without a handler that takes no subcommand didn't panic")
+		}
+	}()
+	m := NewMux()
+	m.Handle(CommandSpec{
+		Name: "config", Arity: -1,
+		Subcommands: []CommandSpec{
+			{Name: "get", Arity: 3, Handler: nop},
+		},
+	})
+}
@@ -0,0 +1,90 @@
+package redhub
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/IceFireDB/redhub/pkg/resp"
+)
+
+// Observer is notified of what happens on the connections of a RedHub, to
+// collect metrics without instrumenting each handler. Observers are
+// installed with RedHub.Observe before the server starts.
+//
+// Methods are called on the hot path, from the goroutines serving the
+// connections, and must be fast and safe for concurrent use. They must not
+// write to the connection.
+type Observer interface {
+	// ConnOpened is called once a connection has been opened, and
+	// ConnClosed once it has been closed.
+	ConnOpened(c Conn)
+	ConnClosed(c Conn, err error)
+
+	// Read is called with the number of bytes read from a connection, and
+	// Written with the number of bytes sent to it.
+	Read(c Conn, n int)
+	Written(c Conn, n int)
+
+	// ParseError is called when the data read from a connection is not a
+	// valid command. The client is sent an error and the data is dropped.
+	ParseError(c Conn, err error)
+
+	// Pipeline is called once a connection has served the n commands it
+	// had queued, before their replies are sent.
+	Pipeline(c Conn, n int)
+
+	// CommandServed is called once a command has been served, with the
+	// time spent serving it, not counting the time a command parked with
+	// Conn.Defer waited, and the first word of its reply when the reply is
+	// an error, such as "ERR" or "WRONGTYPE", or "" otherwise.
+	CommandServed(c Conn, cmd resp.Command, d time.Duration, errPrefix string)
+
+	// BuffersReclaimed is called when the ticker reallocated the read
+	// buffers of n idle connections, to return their memory.
+	BuffersReclaimed(n int)
+}
+
+// Observe installs observers. They must be installed before the server
+// starts.
+func (rs *RedHub) Observe(observers ...Observer) {
+	rs.observers = append(rs.observers, observers...)
+}
+
+// observers returns the observers of the connection's hub.
+func (c *conn) observers() []Observer {
+	if c.hub == nil {
+		return nil
+	}
+	return c.hub.observers
+}
+
+// written reports n bytes sent to the connection.
+func (c *conn) written(n int) {
+	for _, o := range c.observers() {
+		o.Written(c, n)
+	}
+}
+
+// served reports cmd served in d, with its reply written to the writer from
+// mark on.
+func (c *conn) served(cmd resp.Command, d time.Duration, mark int) {
+	observers := c.observers()
+	if len(observers) == 0 {
+		return
+	}
+	var prefix string
+	if out := c.wr.OrigBuffer(); mark < len(out) && out[mark] == resp.Error {
+		prefix = errorPrefix(out[mark+1:])
+	}
+	for _, o := range observers {
+		o.CommandServed(c, cmd, d, prefix)
+	}
+}
+
+// errorPrefix returns the first word of an error reply's message.
+func errorPrefix(msg []byte) string {
+	if i := bytes.IndexAny(msg, " \r"); i >= 0 {
+		msg = msg[:i]
+	}
+	return string(msg)
+}
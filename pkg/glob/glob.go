@@ -0,0 +1,106 @@
+// Package glob implements the glob-style pattern matching used by Redis for
+// KEYS, PSUBSCRIBE, ACL key patterns and similar commands.
+package glob
+
+// Match reports whether str matches pattern. The pattern syntax is the one
+// Redis uses: '*' matches any sequence of characters, '?' matches a single
+// character, "[abc]" matches one of the listed characters, "[^abc]" any
+// character that is not listed, "[a-z]" a character in the range, and a
+// backslash matches the next character literally.
+func Match(pattern, str string) bool {
+	skipLonger := false
+	return match(pattern, str, &skipLonger)
+}
+
+// match is a port of stringmatchlen from the Redis sources. skipLonger is set
+// once a '*' failed to match the rest of the string, in which case trying a
+// longer match for an outer '*' can't succeed either.
+func match(p, s string, skipLonger *bool) bool {
+loop:
+	for len(p) > 0 && len(s) > 0 {
+		switch p[0] {
+		case '*':
+			for len(p) > 1 && p[1] == '*' {
+				p = p[1:]
+			}
+			if len(p) == 1 {
+				return true
+			}
+			for len(s) > 0 {
+				if match(p[1:], s, skipLonger) {
+					return true
+				}
+				if *skipLonger {
+					return false
+				}
+				s = s[1:]
+			}
+			*skipLonger = true
+			return false
+		case '?':
+			s = s[1:]
+		case '[':
+			p = p[1:]
+			not := len(p) > 0 && p[0] == '^'
+			if not {
+				p = p[1:]
+			}
+			matched := false
+		class:
+			for {
+				switch {
+				case len(p) >= 2 && p[0] == '\\':
+					p = p[1:]
+					if p[0] == s[0] {
+						matched = true
+					}
+				case len(p) == 0:
+					// unterminated class, treat the end of the pattern
+					// as its end
+					break class
+				case p[0] == ']':
+					break class
+				case len(p) >= 3 && p[1] == '-':
+					start, end := p[0], p[2]
+					if start > end {
+						start, end = end, start
+					}
+					if s[0] >= start && s[0] <= end {
+						matched = true
+					}
+					p = p[2:]
+				case p[0] == s[0]:
+					matched = true
+				}
+				p = p[1:]
+			}
+			if not {
+				matched = !matched
+			}
+			if !matched {
+				return false
+			}
+			s = s[1:]
+		case '\\':
+			if len(p) >= 2 {
+				p = p[1:]
+			}
+			fallthrough
+		default:
+			if p[0] != s[0] {
+				return false
+			}
+			s = s[1:]
+		}
+		if len(p) > 0 {
+			p = p[1:]
+		}
+		if len(s) == 0 {
+			for len(p) > 0 && p[0] == '*' {
+				p = p[1:]
+			}
+			break loop
+		}
+	}
+	return len(p) == 0 && len(s) == 0
+}
@@ -0,0 +1,61 @@
+package glob
+
+import "testing"
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern, str string
+		want         bool
+	}{
+		{"", "", true},
+		{"", "a", false},
+		{"a", "", false},
+		{"*", "", false}, // as in Redis
+		{"*", "anything", true},
+		{"h*o", "hello", true},
+		{"h*o", "hell", false},
+		{"h**o", "ho", true},
+		{"*o*o*", "foo", true},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"?", "", false},
+
+		// Classes and ranges.
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"h[a-b]llo", "hcllo", false},
+		{"h[b-a]llo", "hallo", true},
+		{"[0-9]*", "7up", true},
+		{"[^0-9]*", "7up", false},
+		{"[]", "a", false},
+
+		// Escapes.
+		{`\*`, "*", true},
+		{`\*`, "a", false},
+		{`\?`, "?", true},
+		{`\?`, "a", false},
+		{`h\[e\]llo`, "h[e]llo", true},
+		{`[\]]`, "]", true},
+		{`[\-a]`, "-", true},
+		{`[\-a]`, "b", false},
+		{`a\`, `a\`, true},
+		{`\a`, "a", true},
+
+		// An unterminated class ends with the pattern.
+		{"[abc", "a", true},
+		{"[abc", "d", false},
+		{"h[ae", "ha", true},
+		{"h[ae", "hal", false},
+		{"[^", "a", true},
+		{"[", "a", false},
+		{`[\`, `\`, true},
+	}
+	for _, tt := range tests {
+		if got := Match(tt.pattern, tt.str); got != tt.want {
+			t.Errorf("Match(%q, %q) = %v, want %v", tt.pattern, tt.str, got, tt.want)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package resp
 
 import (
 	"fmt"
+	"math"
 	"reflect"
 	"sort"
 	"strconv"
@@ -18,6 +19,24 @@ const (
 	Bulk    = '$'
 	Array   = '*'
 	Error   = '-'
+
+	// RESP3 kinds
+	Null      = '_'
+	Double    = ','
+	Boolean   = '#'
+	BlobError = '!'
+	Verbatim  = '='
+	BigNumber = '('
+	Map       = '%'
+	Set       = '~'
+	Attribute = '|'
+	Push      = '>'
+)
+
+// Protocol versions
+const (
+	RESP2 = 2
+	RESP3 = 3
 )
 
 // RESP ...
@@ -441,6 +460,86 @@ func AppendNull(b []byte) []byte {
 	return append(b, '$', '-', '1', '\r', '\n')
 }
 
+// AppendNullArray appends a RESP2 null array to the input bytes.
+func AppendNullArray(b []byte) []byte {
+	return append(b, '*', '-', '1', '\r', '\n')
+}
+
+// AppendNullRESP3 appends a RESP3 null to the input bytes.
+func AppendNullRESP3(b []byte) []byte {
+	return append(b, '_', '\r', '\n')
+}
+
+// AppendMap appends a RESP3 map header to the input bytes. The header must
+// be followed by n key/value pairs.
+func AppendMap(b []byte, n int) []byte {
+	return appendPrefix(b, '%', int64(n))
+}
+
+// AppendSet appends a RESP3 set header to the input bytes.
+func AppendSet(b []byte, n int) []byte {
+	return appendPrefix(b, '~', int64(n))
+}
+
+// AppendAttribute appends a RESP3 attribute header to the input bytes. The
+// header must be followed by n key/value pairs and then by the reply the
+// attribute describes.
+func AppendAttribute(b []byte, n int) []byte {
+	return appendPrefix(b, '|', int64(n))
+}
+
+// AppendPush appends a RESP3 push header to the input bytes. The header must
+// be followed by n elements.
+func AppendPush(b []byte, n int) []byte {
+	return appendPrefix(b, '>', int64(n))
+}
+
+// AppendDouble appends a RESP3 double to the input bytes.
+func AppendDouble(b []byte, f float64) []byte {
+	b = append(b, ',')
+	b = appendDoubleValue(b, f)
+	return append(b, '\r', '\n')
+}
+
+// appendDoubleValue appends the textual form of f used by RESP3 doubles.
+func appendDoubleValue(b []byte, f float64) []byte {
+	switch {
+	case math.IsInf(f, 1):
+		return append(b, "inf"...)
+	case math.IsInf(f, -1):
+		return append(b, "-inf"...)
+	case math.IsNaN(f):
+		return append(b, "nan"...)
+	}
+	return strconv.AppendFloat(b, f, 'g', -1, 64)
+}
+
+// AppendBool appends a RESP3 boolean to the input bytes.
+func AppendBool(b []byte, t bool) []byte {
+	if t {
+		return append(b, '#', 't', '\r', '\n')
+	}
+	return append(b, '#', 'f', '\r', '\n')
+}
+
+// AppendBigNumber appends a RESP3 big number to the input bytes. The number
+// is passed as its decimal string representation.
+func AppendBigNumber(b []byte, n string) []byte {
+	b = append(b, '(')
+	b = append(b, stripNewlines(n)...)
+	return append(b, '\r', '\n')
+}
+
+// AppendVerbatim appends a RESP3 verbatim string to the input bytes. The
+// format is a three character type hint such as "txt" or "mkd".
+func AppendVerbatim(b []byte, format string, s string) []byte {
+	b = appendPrefix(b, '=', int64(len(format)+1+len(s)))
+	b = append(b, format...)
+	b = append(b, ':')
+	b = append(b, s...)
+	return append(b, '\r', '\n')
+}
+
 // AppendBulkFloat appends a float64, as bulk bytes.
 func AppendBulkFloat(dst []byte, f float64) []byte {
 	return AppendBulk(dst, strconv.AppendFloat(nil, f, 'f', -1, 64))
@@ -488,26 +587,48 @@ type Marshaler interface {
 }
 
 // AppendAny appends any type to valid Redis type.
-//   nil             -> null
-//   error           -> error (adds "ERR " when first word is not uppercase)
-//   string          -> bulk-string
-//   numbers         -> bulk-string
-//   []byte          -> bulk-string
-//   bool            -> bulk-string ("0" or "1")
-//   slice           -> array
-//   map             -> array with key/value pairs
-//   SimpleString    -> string
-//   SimpleInt       -> integer
-//   Marshaler       -> raw bytes
-//   everything-else -> bulk-string representation using fmt.Sprint()
+//
+//	nil             -> null
+//	error           -> error (adds "ERR " when first word is not uppercase)
+//	string          -> bulk-string
+//	numbers         -> bulk-string
+//	[]byte          -> bulk-string
+//	bool            -> bulk-string ("0" or "1")
+//	slice           -> array
+//	map             -> array with key/value pairs
+//	SimpleString    -> string
+//	SimpleInt       -> integer
+//	Marshaler       -> raw bytes
+//	everything-else -> bulk-string representation using fmt.Sprint()
 func AppendAny(b []byte, v interface{}) []byte {
+	return appendAny(b, v, false)
+}
+
+// AppendAnyRESP3 is like AppendAny but picks RESP3 types where RESP2 has
+// no native equivalent.
+//
+//	nil             -> null
+//	bool            -> boolean
+//	floats          -> double
+//	map             -> map
+//	map[T]struct{}  -> set
+//	everything-else -> same as AppendAny
+func AppendAnyRESP3(b []byte, v interface{}) []byte {
+	return appendAny(b, v, true)
+}
+
+func appendAny(b []byte, v interface{}, resp3 bool) []byte {
 	switch v := v.(type) {
 	case SimpleString:
 		b = AppendString(b, string(v))
 	case SimpleInt:
 		b = AppendInt(b, int64(v))
 	case nil:
-		b = AppendNull(b)
+		if resp3 {
+			b = AppendNullRESP3(b)
+		} else {
+			b = AppendNull(b)
+		}
 	case error:
 		b = AppendError(b, prefixERRIfNeeded(v.Error()))
 	case string:
@@ -515,7 +636,9 @@ func AppendAny(b []byte, v interface{}) []byte {
 	case []byte:
 		b = AppendBulk(b, v)
 	case bool:
-		if v {
+		if resp3 {
+			b = AppendBool(b, v)
+		} else if v {
 			b = AppendBulkString(b, "1")
 		} else {
 			b = AppendBulkString(b, "0")
@@ -541,9 +664,17 @@ func AppendAny(b []byte, v interface{}) []byte {
 	case uint64:
 		b = AppendBulkUint(b, uint64(v))
 	case float32:
-		b = AppendBulkFloat(b, float64(v))
+		if resp3 {
+			b = AppendDouble(b, float64(v))
+		} else {
+			b = AppendBulkFloat(b, float64(v))
+		}
 	case float64:
-		b = AppendBulkFloat(b, float64(v))
+		if resp3 {
+			b = AppendDouble(b, v)
+		} else {
+			b = AppendBulkFloat(b, v)
+		}
 	case Marshaler:
 		b = append(b, v.MarshalRESP()...)
 	default:
@@ -553,11 +684,19 @@ func AppendAny(b []byte, v interface{}) []byte {
 			n := vv.Len()
 			b = AppendArray(b, n)
 			for i := 0; i < n; i++ {
-				b = AppendAny(b, vv.Index(i).Interface())
+				b = appendAny(b, vv.Index(i).Interface(), resp3)
 			}
 		case reflect.Map:
 			n := vv.Len()
-			b = AppendArray(b, n*2)
+			set := resp3 && vv.Type().Elem() == emptyStructType
+			switch {
+			case set:
+				b = AppendSet(b, n)
+			case resp3:
+				b = AppendMap(b, n)
+			default:
+				b = AppendArray(b, n*2)
+			}
 			var i int
 			var strKey bool
 			var strsKeyItems []strKeyItem
@@ -576,8 +715,10 @@ func AppendAny(b []byte, v interface{}) []byte {
 						key.(string), iter.Value().Interface(),
 					}
 				} else {
-					b = AppendAny(b, key)
-					b = AppendAny(b, iter.Value().Interface())
+					b = appendAny(b, key, resp3)
+					if !set {
+						b = appendAny(b, iter.Value().Interface(), resp3)
+					}
 				}
 				i++
 			}
@@ -587,7 +728,9 @@ func AppendAny(b []byte, v interface{}) []byte {
 				})
 				for _, item := range strsKeyItems {
 					b = AppendBulkString(b, item.key)
-					b = AppendAny(b, item.value)
+					if !set {
+						b = appendAny(b, item.value, resp3)
+					}
 				}
 			}
 		default:
@@ -597,7 +740,25 @@ func AppendAny(b []byte, v interface{}) []byte {
 	return b
 }
 
+var emptyStructType = reflect.TypeOf(struct{}{})
+
 type strKeyItem struct {
 	key   string
 	value interface{}
 }
+
+// AppendLower appends name to b with its ASCII letters lower-cased, the form
+// command names are matched in. With b a buffer on the stack, command names
+// are matched without allocating:
+//
+//	var buf [16]byte
+//	switch string(resp.AppendLower(buf[:0], cmd.Args[0])) {
+func AppendLower(b []byte, name []byte) []byte {
+	for _, ch := range name {
+		if ch >= 'A' && ch <= 'Z' {
+			ch += 'a' - 'A'
+		}
+		b = append(b, ch)
+	}
+	return b
+}
@@ -6,19 +6,81 @@ const cleanUpBufferAfterUses = 1000
 type Writer struct {
 	b          []byte
 	useCounter int32
+	proto      int
+	// skip counts the values still to be dropped from a RESP3 attribute
+	// that was written for a RESP2 client.
+	skip int
+	// muted drops every write, for clients that turned replies off.
+	muted bool
 }
 
 // NewWriter creates a new RESP writer.
 func NewWriter() *Writer {
 	buff := [bufferSize]byte{}
-	return &Writer{b: buff[0:0], useCounter: 0}
+	return &Writer{b: buff[0:0], useCounter: 0, proto: RESP2}
+}
+
+// Protocol returns the protocol version the writer encodes for.
+func (w *Writer) Protocol() int {
+	return w.proto
+}
+
+// SetProtocol sets the protocol version the writer encodes for, either
+// RESP2 or RESP3.
+func (w *Writer) SetProtocol(proto int) {
+	w.proto = proto
+}
+
+// Mute turns dropping every write on or off.
+func (w *Writer) Mute(on bool) {
+	w.muted = on
+}
+
+// Muted reports whether writes are dropped.
+func (w *Writer) Muted() bool {
+	return w.muted
+}
+
+// discard reports whether the next value is dropped, because the writer is
+// muted or the value is part of an attribute that RESP2 cannot represent.
+// Aggregate headers pass the number of values they contain so those are
+// dropped as well.
+func (w *Writer) discard(elems int) bool {
+	if w.muted {
+		return true
+	}
+	if w.skip == 0 {
+		return false
+	}
+	w.skip += elems - 1
+	return true
 }
 
 // WriteNull writes a null to the client
 func (w *Writer) WriteNull() {
+	if w.discard(0) {
+		return
+	}
+	if w.proto == RESP3 {
+		w.b = AppendNullRESP3(w.b)
+		return
+	}
 	w.b = AppendNull(w.b)
 }
 
+// WriteNullArray writes a null array, the reply Redis uses for example when
+// a transaction is aborted. RESP3 has a single null type.
+func (w *Writer) WriteNullArray() {
+	if w.discard(0) {
+		return
+	}
+	if w.proto == RESP3 {
+		w.b = AppendNullRESP3(w.b)
+		return
+	}
+	w.b = AppendNullArray(w.b)
+}
+
 // WriteArray writes an array header. You must then write additional
 // sub-responses to the client to complete the response.
 // For example to write two strings:
@@ -27,16 +89,144 @@ func (w *Writer) WriteNull() {
 //	c.WriteBulk("item 1")
 //	c.WriteBulk("item 2")
 func (w *Writer) WriteArray(count int) {
+	if w.discard(count) {
+		return
+	}
 	w.b = AppendArray(w.b, count)
 }
 
+// WriteMap writes a RESP3 map header. You must then write count key/value
+// pairs to complete the response.
+// For example to write a map with one entry:
+//
+//	c.WriteMap(1)
+//	c.WriteBulkString("key")
+//	c.WriteBulkString("value")
+//
+// RESP2 clients receive a flat array of 2*count elements.
+func (w *Writer) WriteMap(count int) {
+	if w.discard(count * 2) {
+		return
+	}
+	if w.proto != RESP3 {
+		w.b = AppendArray(w.b, count*2)
+		return
+	}
+	w.b = AppendMap(w.b, count)
+}
+
+// WriteSet writes a RESP3 set header. You must then write count additional
+// sub-responses to complete the response. RESP2 clients receive an array.
+func (w *Writer) WriteSet(count int) {
+	if w.discard(count) {
+		return
+	}
+	if w.proto != RESP3 {
+		w.b = AppendArray(w.b, count)
+		return
+	}
+	w.b = AppendSet(w.b, count)
+}
+
+// WritePush writes a RESP3 push header. You must then write count additional
+// sub-responses to complete the message. RESP2 clients receive an array.
+func (w *Writer) WritePush(count int) {
+	if w.discard(count) {
+		return
+	}
+	if w.proto != RESP3 {
+		w.b = AppendArray(w.b, count)
+		return
+	}
+	w.b = AppendPush(w.b, count)
+}
+
+// WriteAttribute writes a RESP3 attribute header. You must then write count
+// key/value pairs followed by the reply the attribute describes. RESP2 has no
+// attributes, so for RESP2 clients the key/value pairs are dropped and only the
+// described reply is sent.
+func (w *Writer) WriteAttribute(count int) {
+	if w.muted {
+		return
+	}
+	if w.proto != RESP3 || w.skip > 0 {
+		w.skip += count * 2
+		return
+	}
+	w.b = AppendAttribute(w.b, count)
+}
+
+// WriteDouble writes a RESP3 double to the client. RESP2 clients receive a
+// bulk string.
+func (w *Writer) WriteDouble(f float64) {
+	if w.discard(0) {
+		return
+	}
+	if w.proto != RESP3 {
+		w.b = AppendBulk(w.b, appendDoubleValue(nil, f))
+		return
+	}
+	w.b = AppendDouble(w.b, f)
+}
+
+// WriteBool writes a RESP3 boolean to the client. RESP2 clients receive the
+// integer 1 or 0.
+func (w *Writer) WriteBool(t bool) {
+	if w.discard(0) {
+		return
+	}
+	if w.proto != RESP3 {
+		if t {
+			w.b = AppendInt(w.b, 1)
+		} else {
+			w.b = AppendInt(w.b, 0)
+		}
+		return
+	}
+	w.b = AppendBool(w.b, t)
+}
+
+// WriteBigNumber writes a RESP3 big number to the client. The number is
+// passed as its decimal string representation. RESP2 clients receive a bulk
+// string.
+func (w *Writer) WriteBigNumber(num string) {
+	if w.discard(0) {
+		return
+	}
+	if w.proto != RESP3 {
+		w.b = AppendBulkString(w.b, num)
+		return
+	}
+	w.b = AppendBigNumber(w.b, num)
+}
+
+// WriteVerbatim writes a RESP3 verbatim string to the client. The format is
+// a three character type hint such as "txt" or "mkd". RESP2 clients receive
+// the string without the format as a bulk string.
+func (w *Writer) WriteVerbatim(format string, str string) {
+	if w.discard(0) {
+		return
+	}
+	if w.proto != RESP3 {
+		w.b = AppendBulkString(w.b, str)
+		return
+	}
+	w.b = AppendVerbatim(w.b, format, str)
+}
+
 // WriteBulk writes bulk bytes to the client.
 func (w *Writer) WriteBulk(bulk []byte) {
+	if w.discard(0) {
+		return
+	}
 	w.b = AppendBulk(w.b, bulk)
 }
 
 // WriteBulkString writes a bulk string to the client.
 func (w *Writer) WriteBulkString(bulk string) {
+	if w.discard(0) {
+		return
+	}
 	w.b = AppendBulkString(w.b, bulk)
 }
 
@@ -53,6 +243,20 @@ func (w *Writer) OrigBuffer() []byte {
 	return w.b
 }
 
+// Len returns the number of unflushed bytes.
+func (w *Writer) Len() int {
+	return len(w.b)
+}
+
+// Truncate discards all but the first n unflushed bytes, for example to drop
+// a partially written reply.
+func (w *Writer) Truncate(n int) {
+	if n < len(w.b) {
+		w.b = w.b[:n]
+	}
+	w.skip = 0
+}
+
 // SetBuffer replaces the unflushed buffer with new bytes.
 func (w *Writer) SetBuffer(raw []byte) {
 	w.b = w.b[:0]
@@ -71,15 +275,22 @@ func (w *Writer) Flush() {
 	}
 
 	w.b = w.b[:0]
+	w.skip = 0
 }
 
 // WriteError writes an error to the client.
 func (w *Writer) WriteError(msg string) {
+	if w.discard(0) {
+		return
+	}
 	w.b = AppendError(w.b, msg)
 }
 
 // WriteString writes a string to the client.
 func (w *Writer) WriteString(msg string) {
+	if w.discard(0) {
+		return
+	}
 	w.b = AppendString(w.b, msg)
 }
 
@@ -90,16 +301,25 @@ func (w *Writer) WriteInt(num int) {
 
 // WriteInt64 writes a 64-bit signed integer to the client.
 func (w *Writer) WriteInt64(num int64) {
+	if w.discard(0) {
+		return
+	}
 	w.b = AppendInt(w.b, num)
 }
 
 // WriteUint64 writes a 64-bit unsigned integer to the client.
 func (w *Writer) WriteUint64(num uint64) {
+	if w.discard(0) {
+		return
+	}
 	w.b = AppendUint(w.b, num)
 }
 
 // WriteRaw writes raw data to the client.
 func (w *Writer) WriteRaw(data []byte) {
+	if w.discard(0) {
+		return
+	}
 	w.b = append(w.b, data...)
 }
 
@@ -116,6 +336,16 @@ func (w *Writer) WriteRaw(data []byte) {
 //	SimpleString    -> string
 //	SimpleInt       -> integer
 //	everything-else -> bulk-string representation using fmt.Sprint()
+//
+// When the writer encodes for RESP3, nil, bools, floats and maps are written
+// using their RESP3 types instead, see AppendAnyRESP3.
 func (w *Writer) WriteAny(v interface{}) {
+	if w.discard(0) {
+		return
+	}
+	if w.proto == RESP3 {
+		w.b = AppendAnyRESP3(w.b, v)
+		return
+	}
 	w.b = AppendAny(w.b, v)
 }
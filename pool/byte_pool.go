@@ -34,3 +34,8 @@ func (b *BytePool) Reset() {
 		b.bp = [][BytePoolArrSize]byte{}
 	}
 }
+
+// Size returns the number of bytes the pool holds.
+func (b *BytePool) Size() int {
+	return len(b.bp) * BytePoolArrSize
+}
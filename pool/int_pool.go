@@ -1,5 +1,7 @@
 package pool
 
+import "math/bits"
+
 const intArrSize = 16384
 const cleanUpIntPoolAfterUses = 100
 
@@ -33,3 +35,8 @@ func (b *IntPool) Reset() {
 		b.useCounter = 0
 	}
 }
+
+// Size returns the number of bytes the pool holds.
+func (b *IntPool) Size() int {
+	return len(b.bp) * intArrSize * bits.UintSize / 8
+}
@@ -0,0 +1,522 @@
+// Package pubsub implements the Redis publish/subscribe commands on top of
+// redhub. A Broker is installed on a RedHub with Plug:
+//
+//	broker := pubsub.NewBroker()
+//	rh := redhub.NewRedHub(onOpened, onClosed, handler, tickFreq, reclaimMemAfter)
+//	rh.Plug(broker)
+//
+// The broker then serves SUBSCRIBE, UNSUBSCRIBE, PSUBSCRIBE, PUNSUBSCRIBE,
+// SSUBSCRIBE, SUNSUBSCRIBE, PUBLISH, SPUBLISH and PUBSUB and passes every
+// other command on to the handler.
+package pubsub
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/IceFireDB/redhub"
+	"github.com/IceFireDB/redhub/pkg/glob"
+	"github.com/IceFireDB/redhub/pkg/resp"
+)
+
+// Broker tracks channel, pattern and shard channel subscriptions per
+// connection and delivers published messages to the subscribers.
+type Broker struct {
+	// mu guards the subscription tables. Publishing holds it while messages
+	// are handed to the connections, so every subscriber sees messages in
+	// the same order.
+	mu       sync.Mutex
+	channels map[string]map[redhub.Conn]struct{}
+	patterns map[string]map[redhub.Conn]struct{}
+	shards   map[string]map[redhub.Conn]struct{}
+
+	// clients holds a *client for every connection with at least one
+	// subscription. It is a sync.Map so that the subscribed mode check on
+	// every command doesn't contend on mu.
+	clients sync.Map
+
+	handlers map[string]func(c redhub.Conn, cmd resp.Command) redhub.Action
+}
+
+type client struct {
+	channels map[string]struct{}
+	patterns map[string]struct{}
+	shards   map[string]struct{}
+	// count is the number of subscriptions of any kind, read without mu.
+	count int32
+}
+
+// NewBroker creates a new Broker.
+func NewBroker() *Broker {
+	b := &Broker{
+		channels: make(map[string]map[redhub.Conn]struct{}),
+		patterns: make(map[string]map[redhub.Conn]struct{}),
+		shards:   make(map[string]map[redhub.Conn]struct{}),
+	}
+	b.handlers = map[string]func(c redhub.Conn, cmd resp.Command) redhub.Action{
+		"subscribe":    b.subscribe,
+		"psubscribe":   b.psubscribe,
+		"ssubscribe":   b.ssubscribe,
+		"unsubscribe":  b.unsubscribe,
+		"punsubscribe": b.punsubscribe,
+		"sunsubscribe": b.sunsubscribe,
+		"publish":      b.publish,
+		"spublish":     b.spublish,
+		"pubsub":       b.pubsub,
+	}
+	return b
+}
+
+// Wrap implements redhub.Plugin. It serves the pub/sub commands and, while a
+// RESP2 connection has subscriptions, rejects the commands Redis doesn't
+// allow in subscribed mode.
+func (b *Broker) Wrap(next redhub.HandlerFunc) redhub.HandlerFunc {
+	return func(c redhub.Conn, cmd resp.Command) redhub.Action {
+		var buf [16]byte
+		name := resp.AppendLower(buf[:0], cmd.Args[0])
+
+		if c.Protocol() == resp.RESP2 && b.subscribed(c) {
+			switch string(name) {
+			case "subscribe", "psubscribe", "ssubscribe",
+				"unsubscribe", "punsubscribe", "sunsubscribe", "quit":
+			case "ping":
+				// PING replies with a "pong" message in subscribed mode.
+				if len(cmd.Args) > 2 {
+					c.WriteError("ERR wrong number of arguments for 'ping' command")
+					return redhub.None
+				}
+				c.WriteArray(2)
+				c.WriteBulkString("pong")
+				if len(cmd.Args) == 2 {
+					c.WriteBulk(cmd.Args[1])
+				} else {
+					c.WriteBulkString("")
+				}
+				return redhub.None
+			case "reset":
+				b.Closed(c)
+			default:
+				c.WriteError("ERR Can't execute '" + strings.ToLower(string(cmd.Args[0])) +
+					"': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context")
+				return redhub.None
+			}
+		} else if string(name) == "reset" {
+			b.Closed(c)
+		}
+
+		if h, ok := b.handlers[string(name)]; ok {
+			return h(c, cmd)
+		}
+		return next(c, cmd)
+	}
+}
+
+// Closed implements redhub.Plugin and drops every subscription of c.
+func (b *Broker) Closed(c redhub.Conn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	v, ok := b.clients.Load(c)
+	if !ok {
+		return
+	}
+	cl := v.(*client)
+	for ch := range cl.channels {
+		remove(b.channels, ch, c)
+	}
+	for pat := range cl.patterns {
+		remove(b.patterns, pat, c)
+	}
+	for ch := range cl.shards {
+		remove(b.shards, ch, c)
+	}
+	b.clients.Delete(c)
+}
+
+// Publish sends message to every connection subscribed to channel, either
+// directly or through a matching pattern, and returns the number of
+// connections that received it.
+func (b *Broker) Publish(channel string, message []byte) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var n int
+	for c := range b.channels[channel] {
+		c.Push("message", channel, message)
+		n++
+	}
+	for pat, conns := range b.patterns {
+		if !glob.Match(pat, channel) {
+			continue
+		}
+		for c := range conns {
+			c.Push("pmessage", pat, channel, message)
+			n++
+		}
+	}
+	return n
+}
+
+// SPublish sends message to every connection subscribed to the shard channel
+// and returns the number of connections that received it.
+func (b *Broker) SPublish(channel string, message []byte) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var n int
+	for c := range b.shards[channel] {
+		c.Push("smessage", channel, message)
+		n++
+	}
+	return n
+}
+
+// Channels returns the active channels matching pattern, or all of them
+// when pattern is empty.
+func (b *Broker) Channels(pattern string) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return names(b.channels, pattern)
+}
+
+// NumSub returns the number of subscribers of channel, not counting
+// pattern subscribers.
+func (b *Broker) NumSub(channel string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.channels[channel])
+}
+
+// NumPat returns the number of unique patterns clients are subscribed to.
+func (b *Broker) NumPat() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.patterns)
+}
+
+func (b *Broker) subscribed(c redhub.Conn) bool {
+	v, ok := b.clients.Load(c)
+	return ok && atomic.LoadInt32(&v.(*client).count) > 0
+}
+
+// client returns the subscription state of c, creating it if needed. The
+// caller must hold mu.
+func (b *Broker) client(c redhub.Conn) *client {
+	if v, ok := b.clients.Load(c); ok {
+		return v.(*client)
+	}
+	cl := &client{
+		channels: make(map[string]struct{}),
+		patterns: make(map[string]struct{}),
+		shards:   make(map[string]struct{}),
+	}
+	b.clients.Store(c, cl)
+	return cl
+}
+
+// total returns the subscription count reported in (un)subscribe replies.
+// Shard channels are counted on their own, like Redis does.
+func (cl *client) total(shard bool) int {
+	if shard {
+		return len(cl.shards)
+	}
+	return len(cl.channels) + len(cl.patterns)
+}
+
+func (cl *client) updateCount() {
+	atomic.StoreInt32(&cl.count, int32(len(cl.channels)+len(cl.patterns)+len(cl.shards)))
+}
+
+// kind describes one of the three subscription types.
+type kind struct {
+	subscribe   string
+	unsubscribe string
+	table       func(b *Broker) map[string]map[redhub.Conn]struct{}
+	own         func(cl *client) map[string]struct{}
+	shard       bool
+}
+
+var (
+	channelKind = kind{"subscribe", "unsubscribe",
+		func(b *Broker) map[string]map[redhub.Conn]struct{} { return b.channels },
+		func(cl *client) map[string]struct{} { return cl.channels }, false}
+	patternKind = kind{"psubscribe", "punsubscribe",
+		func(b *Broker) map[string]map[redhub.Conn]struct{} { return b.patterns },
+		func(cl *client) map[string]struct{} { return cl.patterns }, false}
+	shardKind = kind{"ssubscribe", "sunsubscribe",
+		func(b *Broker) map[string]map[redhub.Conn]struct{} { return b.shards },
+		func(cl *client) map[string]struct{} { return cl.shards }, true}
+)
+
+func (b *Broker) subscribe(c redhub.Conn, cmd resp.Command) redhub.Action {
+	return b.doSubscribe(c, cmd, channelKind)
+}
+
+func (b *Broker) psubscribe(c redhub.Conn, cmd resp.Command) redhub.Action {
+	return b.doSubscribe(c, cmd, patternKind)
+}
+
+func (b *Broker) ssubscribe(c redhub.Conn, cmd resp.Command) redhub.Action {
+	return b.doSubscribe(c, cmd, shardKind)
+}
+
+func (b *Broker) unsubscribe(c redhub.Conn, cmd resp.Command) redhub.Action {
+	return b.doUnsubscribe(c, cmd, channelKind)
+}
+
+func (b *Broker) punsubscribe(c redhub.Conn, cmd resp.Command) redhub.Action {
+	return b.doUnsubscribe(c, cmd, patternKind)
+}
+
+func (b *Broker) sunsubscribe(c redhub.Conn, cmd resp.Command) redhub.Action {
+	return b.doUnsubscribe(c, cmd, shardKind)
+}
+
+func (b *Broker) doSubscribe(c redhub.Conn, cmd resp.Command, k kind) redhub.Action {
+	if len(cmd.Args) < 2 {
+		c.WriteError("ERR wrong number of arguments for '" + k.subscribe + "' command")
+		return redhub.None
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	cl := b.client(c)
+	own, table := k.own(cl), k.table(b)
+	for _, arg := range cmd.Args[1:] {
+		name := string(arg)
+		if _, ok := own[name]; !ok {
+			own[name] = struct{}{}
+			conns := table[name]
+			if conns == nil {
+				conns = make(map[redhub.Conn]struct{})
+				table[name] = conns
+			}
+			conns[c] = struct{}{}
+		}
+		c.WritePush(3)
+		c.WriteBulkString(k.subscribe)
+		c.WriteBulk(arg)
+		c.WriteInt(cl.total(k.shard))
+	}
+	cl.updateCount()
+	return redhub.None
+}
+
+func (b *Broker) doUnsubscribe(c redhub.Conn, cmd resp.Command, k kind) redhub.Action {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var targets []string
+	v, ok := b.clients.Load(c)
+	if len(cmd.Args) > 1 {
+		for _, arg := range cmd.Args[1:] {
+			targets = append(targets, string(arg))
+		}
+	} else if ok {
+		for name := range k.own(v.(*client)) {
+			targets = append(targets, name)
+		}
+		sort.Strings(targets)
+	}
+
+	if len(targets) == 0 {
+		// nothing to unsubscribe from, Redis still confirms with a nil name
+		var count int
+		if ok {
+			count = v.(*client).total(k.shard)
+		}
+		c.WritePush(3)
+		c.WriteBulkString(k.unsubscribe)
+		c.WriteNull()
+		c.WriteInt(count)
+		return redhub.None
+	}
+
+	for _, name := range targets {
+		var count int
+		if ok {
+			cl := v.(*client)
+			own := k.own(cl)
+			if _, subscribed := own[name]; subscribed {
+				delete(own, name)
+				remove(k.table(b), name, c)
+			}
+			count = cl.total(k.shard)
+		}
+		c.WritePush(3)
+		c.WriteBulkString(k.unsubscribe)
+		c.WriteBulkString(name)
+		c.WriteInt(count)
+	}
+	if ok {
+		cl := v.(*client)
+		cl.updateCount()
+		if cl.count == 0 {
+			b.clients.Delete(c)
+		}
+	}
+	return redhub.None
+}
+
+func (b *Broker) publish(c redhub.Conn, cmd resp.Command) redhub.Action {
+	if len(cmd.Args) != 3 {
+		c.WriteError("ERR wrong number of arguments for 'publish' command")
+		return redhub.None
+	}
+	c.WriteInt(b.Publish(string(cmd.Args[1]), cmd.Args[2]))
+	return redhub.None
+}
+
+func (b *Broker) spublish(c redhub.Conn, cmd resp.Command) redhub.Action {
+	if len(cmd.Args) != 3 {
+		c.WriteError("ERR wrong number of arguments for 'spublish' command")
+		return redhub.None
+	}
+	c.WriteInt(b.SPublish(string(cmd.Args[1]), cmd.Args[2]))
+	return redhub.None
+}
+
+func (b *Broker) pubsub(c redhub.Conn, cmd resp.Command) redhub.Action {
+	if len(cmd.Args) < 2 {
+		c.WriteError("ERR wrong number of arguments for 'pubsub' command")
+		return redhub.None
+	}
+
+	sub := strings.ToLower(string(cmd.Args[1]))
+	wrongArity := func() redhub.Action {
+		c.WriteError("ERR wrong number of arguments for 'pubsub|" + sub + "' command")
+		return redhub.None
+	}
+
+	switch sub {
+	case "channels", "shardchannels":
+		if len(cmd.Args) > 3 {
+			return wrongArity()
+		}
+		var pattern string
+		if len(cmd.Args) == 3 {
+			pattern = string(cmd.Args[2])
+		}
+		b.mu.Lock()
+		var list []string
+		if sub == "channels" {
+			list = names(b.channels, pattern)
+		} else {
+			list = names(b.shards, pattern)
+		}
+		b.mu.Unlock()
+		c.WriteArray(len(list))
+		for _, name := range list {
+			c.WriteBulkString(name)
+		}
+	case "numsub", "shardnumsub":
+		b.mu.Lock()
+		table := b.channels
+		if sub == "shardnumsub" {
+			table = b.shards
+		}
+		// Redis replies with a flat array of pairs, in RESP3 too.
+		c.WriteArray(2 * (len(cmd.Args) - 2))
+		for _, arg := range cmd.Args[2:] {
+			c.WriteBulk(arg)
+			c.WriteInt(len(table[string(arg)]))
+		}
+		b.mu.Unlock()
+	case "numpat":
+		if len(cmd.Args) != 2 {
+			return wrongArity()
+		}
+		c.WriteInt(b.NumPat())
+	case "help":
+		lines := []string{
+			"PUBSUB <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+			"CHANNELS [<pattern>]",
+			"    Return the currently active channels matching a <pattern> (default: '*').",
+			"NUMPAT",
+			"    Return number of subscriptions to patterns.",
+			"NUMSUB [<channel> ...]",
+			"    Return the number of subscribers for the specified channels, excluding",
+			"    pattern subscriptions(default: no channels).",
+			"SHARDCHANNELS [<pattern>]",
+			"    Return the currently active shard level channels matching a <pattern> (default: '*').",
+			"SHARDNUMSUB [<shardchannel> ...]",
+			"    Return the number of subscribers for the specified shard level channel(s)",
+			"HELP",
+			"    Print this help.",
+		}
+		c.WriteArray(len(lines))
+		for _, line := range lines {
+			c.WriteString(line)
+		}
+	default:
+		c.WriteError("ERR unknown subcommand '" + string(cmd.Args[1]) + "'. Try PUBSUB HELP.")
+	}
+	return redhub.None
+}
+
+// names returns the sorted keys of table matching pattern, or all keys when
+// pattern is empty.
+func names(table map[string]map[redhub.Conn]struct{}, pattern string) []string {
+	list := make([]string, 0, len(table))
+	for name := range table {
+		if pattern == "" || glob.Match(pattern, name) {
+			list = append(list, name)
+		}
+	}
+	sort.Strings(list)
+	return list
+}
+
+func remove(table map[string]map[redhub.Conn]struct{}, name string, c redhub.Conn) {
+	conns := table[name]
+	delete(conns, c)
+	if len(conns) == 0 {
+		delete(table, name)
+	}
+}
+
+// Commands returns the specs of the commands the broker serves, so they can
+// be registered on a redhub.Mux and reported by COMMAND. The broker still
+// has to be installed with Plug to enforce subscribed mode and to release
+// subscriptions when connections close.
+func (b *Broker) Commands() []redhub.CommandSpec {
+	const sub = redhub.FlagPubSub | redhub.FlagNoScript | redhub.FlagLoading | redhub.FlagStale
+	const info = redhub.FlagPubSub | redhub.FlagLoading | redhub.FlagStale
+	return []redhub.CommandSpec{
+		{Name: "subscribe", Arity: -2, Flags: sub, Handler: b.subscribe, Group: "pubsub",
+			Summary: "Listens for messages published to channels."},
+		{Name: "psubscribe", Arity: -2, Flags: sub, Handler: b.psubscribe, Group: "pubsub",
+			Summary: "Listens for messages published to channels that match one or more patterns."},
+		{Name: "ssubscribe", Arity: -2, Flags: sub, FirstKey: 1, LastKey: -1, KeyStep: 1,
+			Handler: b.ssubscribe, Group: "pubsub", Summary: "Listens for messages published to shard channels."},
+		{Name: "unsubscribe", Arity: -1, Flags: sub, Handler: b.unsubscribe, Group: "pubsub",
+			Summary: "Stops listening to messages posted to channels."},
+		{Name: "punsubscribe", Arity: -1, Flags: sub, Handler: b.punsubscribe, Group: "pubsub",
+			Summary: "Stops listening to messages published to channels that match one or more patterns."},
+		{Name: "sunsubscribe", Arity: -1, Flags: sub, FirstKey: 1, LastKey: -1, KeyStep: 1,
+			Handler: b.sunsubscribe, Group: "pubsub", Summary: "Stops listening to messages posted to shard channels."},
+		{Name: "publish", Arity: 3, Flags: info | redhub.FlagFast, Handler: b.publish, Group: "pubsub",
+			Summary: "Posts a message to a channel."},
+		{Name: "spublish", Arity: 3, Flags: info | redhub.FlagFast, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Handler: b.spublish, Group: "pubsub", Summary: "Post a message to a shard channel"},
+		{Name: "pubsub", Arity: -2, Handler: b.pubsub, Group: "pubsub",
+			Summary: "A container for Pub/Sub commands.",
+			Subcommands: []redhub.CommandSpec{
+				{Name: "channels", Arity: -2, Flags: info, Group: "pubsub",
+					Summary: "Returns the active channels."},
+				{Name: "numpat", Arity: 2, Flags: info, Group: "pubsub",
+					Summary: "Returns a count of unique pattern subscriptions."},
+				{Name: "numsub", Arity: -2, Flags: info, Group: "pubsub",
+					Summary: "Returns a count of subscribers to channels."},
+				{Name: "shardchannels", Arity: -2, Flags: info, Group: "pubsub",
+					Summary: "Returns the active shard channels."},
+				{Name: "shardnumsub", Arity: -2, Flags: info, Group: "pubsub",
+					Summary: "Returns the count of subscribers of shard channels."},
+				{Name: "help", Arity: 2, Flags: redhub.FlagLoading | redhub.FlagStale, Group: "pubsub",
+					Summary: "Returns helpful text about the different subcommands."},
+			}},
+	}
+}
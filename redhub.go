@@ -2,15 +2,22 @@ package redhub
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"github.com/IceFireDB/redhub/pool"
+	"log"
+	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/IceFireDB/redhub/pkg/resp"
 	gnet "github.com/panjf2000/gnet/v2"
 )
 
+// ErrNotServing is returned by Shutdown when the server was never started.
+var ErrNotServing = errors.New("redhub: server is not serving")
+
 type Action int
 
 const (
@@ -21,6 +28,39 @@ const (
 	Close
 )
 
+// HandlerFunc handles a single command sent by a client.
+type HandlerFunc func(c Conn, cmd resp.Command) (action Action)
+
+// Middleware wraps a handler with logic that runs around every command, such
+// as authentication, timing or logging. A middleware sees the connection and
+// the command before calling next and the resulting Action after it, and may
+// reply on its own and skip next altogether:
+//
+//	func requireAuth(next redhub.HandlerFunc) redhub.HandlerFunc {
+//		return func(c redhub.Conn, cmd resp.Command) redhub.Action {
+//			if !authenticated(c) {
+//				c.WriteError("NOAUTH Authentication required.")
+//				return redhub.None
+//			}
+//			return next(c, cmd)
+//		}
+//	}
+//
+// Middleware runs on the connection's processing goroutine, so replies it
+// writes are flushed in pipeline order together with the handler's.
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// Plugin extends a RedHub with its own commands and per-connection state.
+// Plugins are installed with RedHub.Plug before the server starts.
+type Plugin interface {
+	// Wrap returns a handler that serves the plugin's commands and passes
+	// every other command on to next.
+	Wrap(next HandlerFunc) HandlerFunc
+	// Closed is called once a connection has been closed so the plugin can
+	// release the state it holds for it.
+	Closed(c Conn)
+}
+
 type Options struct {
 	// Multicore indicates whether the server will be effectively created with multi-cores, if so,
 	// then you must take care with synchronizing memory between all event callbacks, otherwise,
@@ -51,7 +91,8 @@ type Options struct {
 	// ReusePort indicates whether to set up the SO_REUSEPORT socket option.
 	ReusePort bool
 
-	// Ticker indicates whether the ticker has been set up.
+	// Ticker indicates whether the ticker has been set up. It runs every
+	// tickFreq passed to NewRedHub, and not at all when that is zero.
 	Ticker bool
 
 	// TCPKeepAlive sets up a duration for (SO_KEEPALIVE) socket option.
@@ -71,8 +112,58 @@ type Options struct {
 	SocketSendBuffer int
 
 	EdgeTriggeredIO bool
+
+	// ShutdownNotice, when set, is sent to each client as an error reply
+	// before its connection is closed by a graceful shutdown, for example
+	// "SHUTDOWN server is shutting down".
+	ShutdownNotice string
+
+	// ShutdownTimeout bounds how long Serve waits for connections to drain
+	// once its context is done. Zero means no limit.
+	ShutdownTimeout time.Duration
+
+	// PanicHandler is called when a handler panics while serving a command,
+	// with the recovered value and the goroutine's stack. The client is sent
+	// "-ERR internal error" in place of any partial reply. When nil, panics
+	// are reported through the standard log package.
+	PanicHandler func(c Conn, cmd resp.Command, v interface{}, stack []byte)
+
+	// PanicPolicy decides what happens to the connection after a panic.
+	PanicPolicy PanicPolicy
+
+	// SlowlogThreshold is how long a handler must take for its command to
+	// be recorded by SLOWLOG. When nil it is 10ms; zero records every
+	// command and a negative threshold records nothing.
+	SlowlogThreshold *time.Duration
+
+	// SlowlogMaxLen is the number of commands SLOWLOG keeps, dropping the
+	// oldest first. The default is 128.
+	SlowlogMaxLen int
+
+	// Addrs are further addresses to serve, besides the one the server is
+	// started with, for example "tcp6://[::1]:6379" or a local admin socket
+	// "unix:///run/redhub.sock?mode=0600". The mode option sets the file
+	// mode of a Unix socket, except on Windows; it is also accepted on the
+	// main address.
+	// Clients of further addresses are served by goroutines of their own,
+	// like TLS clients, rather than by the gnet event loops.
+	Addrs []string
+
+	// TLS, when set, also serves TLS clients on TLS.Addr.
+	TLS *TLSOptions
 }
 
+// PanicPolicy decides what happens to a connection whose handler panicked.
+type PanicPolicy int
+
+const (
+	// PanicReply replies with an error and keeps serving the connection.
+	PanicReply PanicPolicy = iota
+
+	// PanicClose replies with an error and closes the connection.
+	PanicClose
+)
+
 func NewRedHub(
 	onOpened func(c Conn) (action Action),
 	onClosed func(c Conn, err error) (action Action),
@@ -81,7 +172,8 @@ func NewRedHub(
 	reclaimMemAfter time.Duration,
 ) *RedHub {
 	return &RedHub{
-		conns:           make(map[gnet.Conn]*conn),
+		conns:           make(map[*conn]struct{}),
+		clients:         make(map[*conn]struct{}),
 		connSync:        sync.RWMutex{},
 		onOpened:        onOpened,
 		onClosed:        onClosed,
@@ -93,22 +185,99 @@ func NewRedHub(
 
 type RedHub struct {
 	*gnet.Engine
-	onOpened        func(c Conn) (action Action)
-	onClosed        func(c Conn, err error) (action Action)
-	handler         func(c Conn, cmd resp.Command) (action Action)
-	conns           map[gnet.Conn]*conn
-	connSync        sync.RWMutex
+	onOpened   func(c Conn) (action Action)
+	onClosed   func(c Conn, err error) (action Action)
+	handler    func(c Conn, cmd resp.Command) (action Action)
+	plugins    []Plugin
+	middleware []Middleware
+	observers  []Observer
+	tracers    []Tracer
+	dispatch   HandlerFunc
+	conns      map[*conn]struct{}
+	connSync   sync.RWMutex
+
 	adder           string
-	signal          chan error
+	options         Options
+	eng             engine
+	engine          gnet.Engine
+	primary         listenAddr
+	primarySocket   *privateSocket
+	listenAddr      net.Addr
+	addrs           []net.Addr
+	tlsAddr         net.Addr
+	certs           *certLoader
+	shuttingDown    bool
+	booted          chan struct{}
+	done            chan struct{}
+	paused          clientPause
+	clientMux       *Mux
+	info            info
+	slowlog         slowlog
+	monitors        monitors
 	tickFreq        time.Duration
 	reclaimMemAfter time.Duration
+
+	// listeners are the listeners served outside of gnet, and netConns
+	// counts the goroutines serving them and their connections.
+	listeners []net.Listener
+	netConns  sync.WaitGroup
+
+	// clients is a copy of conns for handlers, which read it while their
+	// connection's buffer is locked and so must not wait on connSync.
+	muClients sync.RWMutex
+	clients   map[*conn]struct{}
+}
+
+// Use installs middleware around the handler passed to NewRedHub. Middleware
+// and plugins see commands in the order they were installed, so the first one
+// installed runs outermost. Middleware must be installed before the server
+// starts.
+func (rs *RedHub) Use(middleware ...Middleware) {
+	rs.middleware = append(rs.middleware, middleware...)
+}
+
+// Plug installs plugins. Their Wrap method is installed like middleware
+// passed to Use, and plugins that implement Tracer are installed as tracers
+// too.
+func (rs *RedHub) Plug(plugins ...Plugin) {
+	rs.plugins = append(rs.plugins, plugins...)
+	for _, p := range plugins {
+		rs.middleware = append(rs.middleware, p.Wrap)
+		if t, ok := p.(Tracer); ok {
+			rs.tracers = append(rs.tracers, t)
+		}
+	}
+}
+
+// chain builds the handler that serves commands, with the installed
+// middleware wrapped around the user handler.
+func (rs *RedHub) chain() HandlerFunc {
+	h := HandlerFunc(rs.handler)
+	for i := len(rs.middleware) - 1; i >= 0; i-- {
+		h = rs.middleware[i](h)
+	}
+	return h
+}
+
+// panicked reports a panic recovered while serving cmd.
+func (rs *RedHub) panicked(c Conn, cmd resp.Command, v interface{}, stack []byte) {
+	if rs.options.PanicHandler != nil {
+		rs.options.PanicHandler(c, cmd, v, stack)
+		return
+	}
+	log.Printf("redhub: panic serving %s: %v\n%s", c.RemoteAddr(), v, stack)
 }
 
 func (rs *RedHub) OnTick() (delay time.Duration, action gnet.Action) {
 	rs.connSync.Lock()
 	defer rs.connSync.Unlock()
 
-	for _, rsc := range rs.conns {
+	var reclaimed int
+	for rsc := range rs.conns {
+		if rsc.isClosed() {
+			continue
+		}
+
 		// test if already locked, if it is (TryLock fails) then we skip since conn is active
 		if !rsc.cb.mu.TryLock() {
 			continue
@@ -123,6 +292,12 @@ func (rs *RedHub) OnTick() (delay time.Duration, action gnet.Action) {
 		// Reset the buffer
 		rsc.cb.reallocate()
 		rsc.cb.mu.Unlock()
+		reclaimed++
+	}
+	if reclaimed > 0 {
+		for _, o := range rs.observers {
+			o.BuffersReclaimed(reclaimed)
+		}
 	}
 
 	return rs.tickFreq, gnet.None
@@ -139,6 +314,11 @@ type connBuffer struct {
 	pb         *pool.BytePool
 	ip         *pool.IntPool
 	lastAccess time.Time
+
+	// pbSize and ipSize are the sizes of pb and ip, read atomically by
+	// INFO while the buffer is in use.
+	pbSize int64
+	ipSize int64
 }
 
 func newConnBuffer() *connBuffer {
@@ -161,6 +341,7 @@ func (cb *connBuffer) reallocate() {
 	if len(cb.command) == 0 {
 		cb.command = []resp.Command{}
 	}
+	cb.measure()
 }
 
 // rest rests for safe reuse
@@ -169,58 +350,123 @@ func (cb *connBuffer) reset() {
 	cb.pb.Reset()
 	cb.ip.Reset()
 	cb.buf.Reset()
+	cb.measure()
 }
 
-func (rs *RedHub) OnOpen(c gnet.Conn) (out []byte, action gnet.Action) {
-	rs.connSync.Lock()
-	defer rs.connSync.Unlock()
+// measure records the sizes of the pools. The caller must hold mu.
+func (cb *connBuffer) measure() {
+	atomic.StoreInt64(&cb.pbSize, int64(cb.pb.Size()))
+	atomic.StoreInt64(&cb.ipSize, int64(cb.ip.Size()))
+}
 
-	newConn := NewConn(c)
-	rs.conns[c] = newConn
+func (rs *RedHub) OnOpen(gc gnet.Conn) (out []byte, action gnet.Action) {
+	// gnet reports the configured listen address, which has port 0 when
+	// the port was picked by the system.
+	laddr := rs.listenAddr
+	if laddr == nil {
+		laddr = gc.LocalAddr()
+	}
+	c := rs.open(gnetTransport{gc}, rs.primary.name, laddr, gc.RemoteAddr())
+	if c == nil {
+		return nil, gnet.Close
+	}
+	gc.SetContext(c)
+	return
+}
 
-	go newConn.process(rs.handler)
+func (rs *RedHub) OnClose(gc gnet.Conn, err error) (action gnet.Action) {
+	if c, ok := gc.Context().(*conn); ok {
+		rs.closed(c, err)
+	}
+	return
+}
 
-	rs.onOpened(newConn)
+func (rs *RedHub) OnTraffic(gc gnet.Conn) (action gnet.Action) {
+	c, ok := gc.Context().(*conn)
+	if !ok {
+		return
+	}
+	buf, _ := gc.Next(-1)
+	rs.received(c, buf)
 	return
 }
 
-func (rs *RedHub) OnClose(gc gnet.Conn, err error) (action gnet.Action) {
+// open registers a connection accepted on the listener named listener, with
+// the given local and remote addresses, and starts serving it. It returns
+// nil when the server is shutting down.
+func (rs *RedHub) open(t transport, listener string, laddr, raddr net.Addr) *conn {
 	rs.connSync.Lock()
 	defer rs.connSync.Unlock()
 
-	c := rs.conns[gc]
-	if c == nil {
-		return
+	if rs.shuttingDown {
+		return nil
 	}
-	delete(rs.conns, gc)
-	rs.onClosed(c, err)
 
-	c.cb.mu.Lock()
-	_ = c.close()
-	c.cb.mu.Unlock()
-	return
+	c := newConn(t)
+	c.hub = rs
+	c.listener = listener
+	var socket string
+	if laddr != nil && laddr.Network() == "unix" {
+		socket = laddr.String() + ":0"
+	}
+	c.laddr = connAddr(laddr, socket)
+	c.raddr = connAddr(raddr, socket)
+	rs.conns[c] = struct{}{}
+	rs.muClients.Lock()
+	rs.clients[c] = struct{}{}
+	rs.muClients.Unlock()
+
+	go c.process(rs.dispatch)
+
+	rs.onOpened(c)
+	for _, o := range rs.observers {
+		o.ConnOpened(c)
+	}
+	return c
 }
 
-func (rs *RedHub) OnTraffic(gc gnet.Conn) (action gnet.Action) {
-	rs.connSync.RLock()
-	defer rs.connSync.RUnlock()
-	c, ok := rs.conns[gc]
-	if !ok {
+// closed unregisters a connection once its transport has closed.
+func (rs *RedHub) closed(c *conn, err error) {
+	rs.connSync.Lock()
+	if _, ok := rs.conns[c]; !ok {
+		rs.connSync.Unlock()
 		return
 	}
+	delete(rs.conns, c)
+	rs.muClients.Lock()
+	delete(rs.clients, c)
+	rs.muClients.Unlock()
+	rs.unmonitor(c)
+	rs.onClosed(c, err)
+	for _, p := range rs.plugins {
+		p.Closed(c)
+	}
+	for _, o := range rs.observers {
+		o.ConnClosed(c, err)
+	}
+	rs.connSync.Unlock()
+
+	// close only needs muClosed. c.cb is not touched: once the connection
+	// is closed, its processing goroutine may already have returned the
+	// buffer to the pool.
+	_ = c.close()
+}
 
+// received parses the data read from a connection and queues the commands
+// for its processing goroutine.
+func (rs *RedHub) received(c *conn, buf []byte) {
 	c.muClosed.Lock()
 	defer c.muClosed.Unlock()
 
 	if c.closed {
 		return
 	}
+	for _, o := range rs.observers {
+		o.Read(c, len(buf))
+	}
 
 	c.cb.mu.Lock()
 
-	// Read data from client
-	buf, _ := gc.Next(-1)
-
 	// Write data to buffer
 	c.cb.buf.Write(buf)
 
@@ -243,8 +489,12 @@ func (rs *RedHub) OnTraffic(gc gnet.Conn) (action gnet.Action) {
 	cmds, lastbyte, err := resp.ReadCommands(c.cb.ip, raw)
 
 	if err != nil {
-		_, _ = gc.Write(resp.AppendError([]byte{}, "ERR "+err.Error()))
+		for _, o := range rs.observers {
+			o.ParseError(c, err)
+		}
+		c.conn.write(resp.AppendError([]byte{}, "ERR "+err.Error()), nil)
 		c.cb.ip.Reset()
+		c.cb.measure()
 		c.cb.mu.Unlock()
 		return
 	}
@@ -252,9 +502,11 @@ func (rs *RedHub) OnTraffic(gc gnet.Conn) (action gnet.Action) {
 	// Appends parsed commands
 	c.cb.command = append(c.cb.command, cmds...)
 	c.cb.buf.Reset()
+	atomic.StoreInt64(&c.qbuf, int64(len(lastbyte)))
 	if len(lastbyte) == 0 {
 		// If nothing else to be read then notify handler to read commnads
 		c.cb.ip.Reset()
+		c.cb.measure()
 		c.cb.mu.Unlock()
 		c.notify()
 	} else {
@@ -262,43 +514,129 @@ func (rs *RedHub) OnTraffic(gc gnet.Conn) (action gnet.Action) {
 		// on loop which will attempt to read more.
 		c.cb.buf.Write(lastbyte)
 		c.cb.ip.Reset()
+		c.cb.measure()
 		c.cb.mu.Unlock()
 	}
+}
 
+func (rs *RedHub) OnBoot(eng gnet.Engine) (action gnet.Action) {
+	rs.connSync.RLock()
+	ps := rs.primarySocket
+	rs.connSync.RUnlock()
+	addr := listenerAddr(eng)
+	if ps != nil {
+		if err := ps.publish(); err != nil {
+			// serve returns the error.
+			return gnet.Shutdown
+		}
+		addr = &net.UnixAddr{Name: ps.address, Net: "unix"}
+	}
+
+	rs.connSync.Lock()
+	rs.engine = eng
+	rs.listenAddr = addr
+	close(rs.booted)
+	rs.connSync.Unlock()
+	rs.info.listening(addr)
 	return
 }
 
-func (rs *RedHub) OnBoot(srv gnet.Engine) (action gnet.Action) {
-	rs.signal <- nil
-	return
+// prepare readies rh to serve with options on e. It must be called before
+// the engine starts.
+func (rs *RedHub) prepare(options Options, e engine) {
+	rs.connSync.Lock()
+	defer rs.connSync.Unlock()
+
+	rs.options = options
+	rs.eng = e
+	rs.addrs = nil
+	rs.dispatch = rs.chain()
+	rs.shuttingDown = false
+	rs.info.start(options, e)
+	if rs.slowlog.ring != nil {
+		rs.slowlog.configure(options)
+	}
+	rs.booted = make(chan struct{})
+	rs.done = make(chan struct{})
 }
 
-func ListendAndServe(signal chan error, addr string, options Options, rh *RedHub) error {
-	serveOptions := gnet.Options{
-		Multicore:        options.Multicore,
-		LockOSThread:     options.LockOSThread,
-		ReadBufferCap:    options.ReadBufferCap,
-		LB:               options.LB,
-		NumEventLoop:     options.NumEventLoop,
-		ReusePort:        options.ReusePort,
-		Ticker:           options.Ticker,
-		TCPKeepAlive:     options.TCPKeepAlive,
-		TCPNoDelay:       gnet.TCPDelay,
-		SocketRecvBuffer: options.SocketRecvBuffer,
-		SocketSendBuffer: options.SocketSendBuffer,
-		EdgeTriggeredIO:  options.EdgeTriggeredIO,
-		ReuseAddr:        false,
-	}
-	rh.signal = signal
-
-	err := gnet.Run(rh, addr, gnet.WithOptions(serveOptions))
+// run serves with e until it stops, along with the listeners of
+// Options.Addrs and Options.TLS.
+func (rs *RedHub) run(e engine) error {
+	defer close(rs.done)
 
-	if err != nil {
-		signal <- err
+	defer rs.closeNetConns()
+	if err := rs.listenAddrs(); err != nil {
+		return err
+	}
+	return e.serve()
+}
+
+// Shutdown gracefully shuts the server down. It stops accepting connections,
+// lets running pipelines finish and flush their replies, and closes each
+// connection once it is idle, sending it Options.ShutdownNotice first when
+// set. It then stops the engine and returns once it has exited.
+//
+// If ctx is done before that, the remaining connections are closed without
+// waiting and Shutdown returns the context's error.
+func (rs *RedHub) Shutdown(ctx context.Context) error {
+	rs.connSync.Lock()
+	rs.shuttingDown = true
+	booted, done := rs.booted, rs.done
+	rs.connSync.Unlock()
+	rs.closeListeners()
+
+	if done == nil {
+		return ErrNotServing
+	}
+	select {
+	case <-booted:
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for !rs.drain() {
+		select {
+		case <-ctx.Done():
+			_ = rs.eng.stop(ctx)
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	if err := rs.eng.stop(ctx); err != nil {
+		return err
 	}
-	defer close(signal)
-	if err == nil {
-		return errors.New("context done")
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	return err
+}
+
+// shutdownPollInterval is how often Shutdown checks for idle connections.
+const shutdownPollInterval = 10 * time.Millisecond
+
+// drain closes the idle connections and reports whether all connections
+// have been released.
+func (rs *RedHub) drain() bool {
+	rs.connSync.RLock()
+	conns := make([]*conn, 0, len(rs.conns))
+	for c := range rs.conns {
+		conns = append(conns, c)
+	}
+	rs.connSync.RUnlock()
+
+	for _, c := range conns {
+		c.drain(rs.options.ShutdownNotice)
+	}
+
+	rs.connSync.RLock()
+	defer rs.connSync.RUnlock()
+	return len(rs.conns) == 0
 }
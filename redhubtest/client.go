@@ -0,0 +1,261 @@
+package redhubtest
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/IceFireDB/redhub/pkg/resp"
+)
+
+// DefaultTimeout bounds each exchange of a Client, so a handler that never
+// replies fails the test rather than hanging it.
+const DefaultTimeout = 5 * time.Second
+
+// Client is a minimal RESP client. It speaks RESP2 and RESP3, and is not
+// safe for concurrent use.
+type Client struct {
+	// Timeout bounds each Do, Send and Receive. Zero means DefaultTimeout.
+	Timeout time.Duration
+
+	conn net.Conn
+	r    *bufio.Reader
+	buf  []byte
+}
+
+// NewClient returns a client on an established connection.
+func NewClient(conn net.Conn) *Client {
+	return &Client{conn: conn, r: bufio.NewReader(conn)}
+}
+
+// Conn returns the connection of the client.
+func (c *Client) Conn() net.Conn { return c.conn }
+
+// Close closes the connection.
+func (c *Client) Close() error { return c.conn.Close() }
+
+// Do sends a command and returns the next reply. With RESP3, that may be a
+// push message rather than the reply to the command.
+func (c *Client) Do(args ...interface{}) (Reply, error) {
+	if err := c.Send(args...); err != nil {
+		return Reply{}, err
+	}
+	return c.Receive()
+}
+
+// Send sends a command without waiting for its reply, to pipeline
+// commands. Arguments are strings, byte slices, integers, floats, or values
+// formatted with fmt.Sprint.
+func (c *Client) Send(args ...interface{}) error {
+	c.buf = appendCommand(c.buf[:0], args)
+	_ = c.conn.SetWriteDeadline(time.Now().Add(c.timeout()))
+	_, err := c.conn.Write(c.buf)
+	return err
+}
+
+// appendCommand appends args to dst as a RESP array of bulk strings.
+func appendCommand(dst []byte, args []interface{}) []byte {
+	dst = resp.AppendArray(dst, len(args))
+	for _, arg := range args {
+		dst = resp.AppendBulk(dst, argBytes(arg))
+	}
+	return dst
+}
+
+// argBytes returns the text of a command argument.
+func argBytes(arg interface{}) []byte {
+	switch v := arg.(type) {
+	case string:
+		return []byte(v)
+	case []byte:
+		return v
+	case int:
+		return strconv.AppendInt(nil, int64(v), 10)
+	case int64:
+		return strconv.AppendInt(nil, v, 10)
+	case float64:
+		return strconv.AppendFloat(nil, v, 'f', -1, 64)
+	default:
+		return []byte(fmt.Sprint(v))
+	}
+}
+
+// Receive reads the next reply.
+func (c *Client) Receive() (Reply, error) {
+	_ = c.conn.SetReadDeadline(time.Now().Add(c.timeout()))
+	return readReply(c.r)
+}
+
+func (c *Client) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return DefaultTimeout
+}
+
+// Reply is a decoded reply. Type is one of the kinds of the resp package;
+// nulls of RESP2 and RESP3 alike have Type resp.Null.
+type Reply struct {
+	Type resp.Type
+
+	// Str is the text of simple strings, errors, bulk strings, verbatim
+	// strings (without their format), big numbers, doubles and integers.
+	Str string
+
+	// Int is the value of integers.
+	Int int64
+
+	// Float is the value of doubles.
+	Float float64
+
+	// Bool is the value of booleans.
+	Bool bool
+
+	// Elems are the elements of arrays, sets and pushes, and the keys and
+	// values of maps, in turn.
+	Elems []Reply
+}
+
+// Err returns the error of an error reply, or nil.
+func (r Reply) Err() error {
+	if r.Type == resp.Error || r.Type == resp.BlobError {
+		return errors.New(r.Str)
+	}
+	return nil
+}
+
+// Strings returns the text of the elements of an aggregate reply.
+func (r Reply) Strings() []string {
+	out := make([]string, len(r.Elems))
+	for i, e := range r.Elems {
+		out[i] = e.Str
+	}
+	return out
+}
+
+// String formats the reply on a line, much as redis-cli does.
+func (r Reply) String() string {
+	var sb strings.Builder
+	r.format(&sb)
+	return sb.String()
+}
+
+func (r Reply) format(sb *strings.Builder) {
+	switch r.Type {
+	case resp.Null:
+		sb.WriteString("(nil)")
+	case resp.Integer:
+		sb.WriteString("(integer) " + r.Str)
+	case resp.Double:
+		sb.WriteString("(double) " + r.Str)
+	case resp.Boolean:
+		sb.WriteString("(boolean) " + strconv.FormatBool(r.Bool))
+	case resp.BigNumber:
+		sb.WriteString("(big number) " + r.Str)
+	case resp.Error, resp.BlobError:
+		sb.WriteString("(error) " + r.Str)
+	case resp.String:
+		sb.WriteString(r.Str)
+	case resp.Bulk, resp.Verbatim:
+		sb.WriteString(strconv.Quote(r.Str))
+	case resp.Array, resp.Set, resp.Push, resp.Map:
+		start, end := "[", "]"
+		switch r.Type {
+		case resp.Set:
+			start, end = "(set) [", "]"
+		case resp.Push:
+			start, end = "(push) [", "]"
+		case resp.Map:
+			start, end = "{", "}"
+		}
+		sb.WriteString(start)
+		for i, e := range r.Elems {
+			if i > 0 {
+				switch {
+				case r.Type != resp.Map:
+					sb.WriteString(" ")
+				case i%2 == 1:
+					sb.WriteString(": ")
+				default:
+					sb.WriteString(", ")
+				}
+			}
+			e.format(sb)
+		}
+		sb.WriteString(end)
+	default:
+		sb.WriteString("(unknown) " + r.Str)
+	}
+}
+
+// readReply reads a reply. Attributes are read and dropped.
+func readReply(r *bufio.Reader) (Reply, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return Reply{}, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return Reply{}, fmt.Errorf("redhubtest: malformed reply line %q", line)
+	}
+	reply := Reply{Type: resp.Type(line[0]), Str: line[1 : len(line)-2]}
+	switch reply.Type {
+	case resp.String, resp.Error, resp.BigNumber:
+		return reply, nil
+	case resp.Null:
+		reply.Str = ""
+		return reply, nil
+	case resp.Integer:
+		reply.Int, err = strconv.ParseInt(reply.Str, 10, 64)
+		return reply, err
+	case resp.Double:
+		reply.Float, err = strconv.ParseFloat(strings.Replace(reply.Str, "inf", "Inf", 1), 64)
+		return reply, err
+	case resp.Boolean:
+		reply.Bool = reply.Str == "t"
+		return reply, nil
+	}
+
+	n, err := strconv.Atoi(reply.Str)
+	if err != nil {
+		return Reply{}, fmt.Errorf("redhubtest: malformed reply line %q", line)
+	}
+	switch reply.Type {
+	case resp.Bulk, resp.BlobError, resp.Verbatim:
+		if n < 0 {
+			return Reply{Type: resp.Null}, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return Reply{}, err
+		}
+		reply.Str = string(data[:n])
+		if reply.Type == resp.Verbatim && len(reply.Str) >= 4 {
+			reply.Str = reply.Str[4:]
+		}
+		return reply, nil
+	case resp.Array, resp.Set, resp.Push, resp.Map, resp.Attribute:
+		if n < 0 {
+			return Reply{Type: resp.Null}, nil
+		}
+		if reply.Type == resp.Map || reply.Type == resp.Attribute {
+			n *= 2
+		}
+		reply.Str = ""
+		reply.Elems = make([]Reply, n)
+		for i := range reply.Elems {
+			if reply.Elems[i], err = readReply(r); err != nil {
+				return Reply{}, err
+			}
+		}
+		if reply.Type == resp.Attribute {
+			return readReply(r)
+		}
+		return reply, nil
+	}
+	return Reply{}, fmt.Errorf("redhubtest: unknown reply type %q", line[0])
+}
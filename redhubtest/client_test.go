@@ -0,0 +1,130 @@
+package redhubtest
+
+import (
+	"bufio"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/IceFireDB/redhub/pkg/resp"
+)
+
+func TestReadReply(t *testing.T) {
+	bulk := func(s string) Reply { return Reply{Type: resp.Bulk, Str: s} }
+	integer := func(n int64, s string) Reply { return Reply{Type: resp.Integer, Str: s, Int: n} }
+	null := Reply{Type: resp.Null}
+
+	tests := []struct {
+		raw  string
+		want Reply
+		str  string // as formatted by Reply.String
+	}{
+		// RESP2.
+		{"+OK\r\n", Reply{Type: resp.String, Str: "OK"}, "OK"},
+		{"-ERR bad\r\n", Reply{Type: resp.Error, Str: "ERR bad"}, "(error) ERR bad"},
+		{":42\r\n", integer(42, "42"), "(integer) 42"},
+		{":-7\r\n", integer(-7, "-7"), "(integer) -7"},
+		{"$5\r\nhello\r\n", bulk("hello"), `"hello"`},
+		{"$0\r\n\r\n", bulk(""), `""`},
+		{"$4\r\na\r\nb\r\n", bulk("a\r\nb"), `"a\r\nb"`},
+		{"$-1\r\n", null, "(nil)"},
+		{"*-1\r\n", null, "(nil)"},
+		{"*0\r\n", Reply{Type: resp.Array, Elems: []Reply{}}, "[]"},
+		{"*2\r\n$1\r\na\r\n:1\r\n", Reply{Type: resp.Array, Elems: []Reply{bulk("a"), integer(1, "1")}}, `["a" (integer) 1]`},
+		{"*2\r\n*1\r\n+x\r\n$-1\r\n", Reply{Type: resp.Array, Elems: []Reply{
+			{Type: resp.Array, Elems: []Reply{{Type: resp.String, Str: "x"}}},
+			null,
+		}}, "[[x] (nil)]"},
+
+		// RESP3.
+		{"_\r\n", null, "(nil)"},
+		{",1.5\r\n", Reply{Type: resp.Double, Str: "1.5", Float: 1.5}, "(double) 1.5"},
+		{",inf\r\n", Reply{Type: resp.Double, Str: "inf", Float: math.Inf(1)}, "(double) inf"},
+		{",-inf\r\n", Reply{Type: resp.Double, Str: "-inf", Float: math.Inf(-1)}, "(double) -inf"},
+		{"#t\r\n", Reply{Type: resp.Boolean, Str: "t", Bool: true}, "(boolean) true"},
+		{"#f\r\n", Reply{Type: resp.Boolean, Str: "f"}, "(boolean) false"},
+		{"(12345678901234567890\r\n", Reply{Type: resp.BigNumber, Str: "12345678901234567890"},
+			"(big number) 12345678901234567890"},
+		{"!9\r\nERR wrong\r\n", Reply{Type: resp.BlobError, Str: "ERR wrong"}, "(error) ERR wrong"},
+		{"=8\r\ntxt:text\r\n", Reply{Type: resp.Verbatim, Str: "text"}, `"text"`},
+		{"%1\r\n$1\r\nk\r\n$1\r\nv\r\n", Reply{Type: resp.Map, Elems: []Reply{bulk("k"), bulk("v")}}, `{"k": "v"}`},
+		{"%2\r\n+a\r\n:1\r\n+b\r\n:2\r\n", Reply{Type: resp.Map, Elems: []Reply{
+			{Type: resp.String, Str: "a"}, integer(1, "1"), {Type: resp.String, Str: "b"}, integer(2, "2"),
+		}}, "{a: (integer) 1, b: (integer) 2}"},
+		{"~2\r\n$1\r\na\r\n$1\r\nb\r\n", Reply{Type: resp.Set, Elems: []Reply{bulk("a"), bulk("b")}}, `(set) ["a" "b"]`},
+		{">3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$2\r\nhi\r\n", Reply{Type: resp.Push, Elems: []Reply{
+			bulk("message"), bulk("ch"), bulk("hi"),
+		}}, `(push) ["message" "ch" "hi"]`},
+		{"%1\r\n$1\r\nm\r\n*2\r\n~1\r\n#t\r\n_\r\n", Reply{Type: resp.Map, Elems: []Reply{
+			bulk("m"),
+			{Type: resp.Array, Elems: []Reply{
+				{Type: resp.Set, Elems: []Reply{{Type: resp.Boolean, Str: "t", Bool: true}}},
+				null,
+			}},
+		}}, `{"m": [(set) [(boolean) true] (nil)]}`},
+
+		// Attributes are dropped, at the top level and inside aggregates.
+		{"|1\r\n$3\r\nttl\r\n:10\r\n+OK\r\n", Reply{Type: resp.String, Str: "OK"}, "OK"},
+		{"*2\r\n|1\r\n+a\r\n+b\r\n:1\r\n:2\r\n", Reply{Type: resp.Array, Elems: []Reply{
+			integer(1, "1"), integer(2, "2"),
+		}}, "[(integer) 1 (integer) 2]"},
+	}
+	for _, tt := range tests {
+		r := bufio.NewReader(strings.NewReader(tt.raw))
+		got, err := readReply(r)
+		if err != nil {
+			t.Errorf("%q: %v", tt.raw, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %#v, want %#v", tt.raw, got, tt.want)
+		}
+		if s := got.String(); s != tt.str {
+			t.Errorf("%q: formatted as %s, want %s", tt.raw, s, tt.str)
+		}
+		if r.Buffered() != 0 {
+			t.Errorf("%q: %d bytes left unread", tt.raw, r.Buffered())
+		}
+	}
+}
+
+func TestReadReplyErrors(t *testing.T) {
+	for _, raw := range []string{
+		"",
+		"+OK",
+		"+OK\n",
+		"\r\n",
+		"?what\r\n",
+		":abc\r\n",
+		",x\r\n",
+		"$abc\r\n",
+		"$5\r\nhi\r\n",
+		"*2\r\n:1\r\n",
+		"%1\r\n+k\r\n",
+		"|1\r\n+a\r\n+b\r\n",
+	} {
+		if got, err := readReply(bufio.NewReader(strings.NewReader(raw))); err == nil {
+			t.Errorf("%q: got %s, want an error", raw, got)
+		}
+	}
+}
+
+func TestAppendCommand(t *testing.T) {
+	got := string(appendCommand(nil, []interface{}{"SET", []byte("k"), 1, int64(-2), 1.5, true}))
+	want := "*6\r\n$3\r\nSET\r\n$1\r\nk\r\n$1\r\n1\r\n$2\r\n-2\r\n$3\r\n1.5\r\n$4\r\ntrue\r\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestReplyErr(t *testing.T) {
+	for _, r := range []Reply{{Type: resp.Error, Str: "ERR x"}, {Type: resp.BlobError, Str: "ERR x"}} {
+		if err := r.Err(); err == nil || err.Error() != "ERR x" {
+			t.Errorf("%s: Err() = %v", r, err)
+		}
+	}
+	if err := (Reply{Type: resp.String, Str: "ERR x"}).Err(); err != nil {
+		t.Errorf("a simple string has the error %v", err)
+	}
+}
@@ -0,0 +1,144 @@
+package redhubtest
+
+import (
+	"testing"
+
+	"github.com/IceFireDB/redhub/pkg/glob"
+	"github.com/IceFireDB/redhub/pkg/resp"
+)
+
+// Check reports, through tb, whether a reply is the expected one. Checks
+// are values, so tests can list commands and their expected replies in a
+// table:
+//
+//	tests := []struct {
+//		args  []interface{}
+//		check redhubtest.Check
+//	}{
+//		{[]interface{}{"SET", "k", "v"}, redhubtest.ExpectString("OK")},
+//		{[]interface{}{"GET", "k"}, redhubtest.ExpectBulk("v")},
+//		{[]interface{}{"LLEN", "k"}, redhubtest.ExpectError("WRONGTYPE*")},
+//	}
+//	for _, tt := range tests {
+//		c.Expect(t, tt.check, tt.args...)
+//	}
+type Check func(tb testing.TB, r Reply)
+
+// Expect sends a command and checks its reply, failing tb at once if the
+// exchange fails.
+func (c *Client) Expect(tb testing.TB, check Check, args ...interface{}) Reply {
+	tb.Helper()
+	r, err := c.Do(args...)
+	if err != nil {
+		tb.Fatalf("redhubtest: %v: %v", args, err)
+	}
+	check(tb, r)
+	return r
+}
+
+// ExpectString expects the simple string want, such as "OK".
+func ExpectString(want string) Check {
+	return func(tb testing.TB, r Reply) {
+		tb.Helper()
+		if r.Type != resp.String || r.Str != want {
+			tb.Errorf("got %s, want %s", r, want)
+		}
+	}
+}
+
+// ExpectBulk expects the bulk string want. Verbatim strings are accepted
+// too, as RESP3 servers send some bulk strings as verbatim strings.
+func ExpectBulk(want string) Check {
+	return func(tb testing.TB, r Reply) {
+		tb.Helper()
+		if (r.Type != resp.Bulk && r.Type != resp.Verbatim) || r.Str != want {
+			tb.Errorf("got %s, want %q", r, want)
+		}
+	}
+}
+
+// ExpectInt expects the integer want.
+func ExpectInt(want int64) Check {
+	return func(tb testing.TB, r Reply) {
+		tb.Helper()
+		if r.Type != resp.Integer || r.Int != want {
+			tb.Errorf("got %s, want (integer) %d", r, want)
+		}
+	}
+}
+
+// ExpectNull expects a null reply.
+func ExpectNull() Check {
+	return func(tb testing.TB, r Reply) {
+		tb.Helper()
+		if r.Type != resp.Null {
+			tb.Errorf("got %s, want (nil)", r)
+		}
+	}
+}
+
+// ExpectError expects an error whose message matches the glob-style
+// pattern, for example "WRONGTYPE*" or "ERR unknown command*".
+func ExpectError(pattern string) Check {
+	return func(tb testing.TB, r Reply) {
+		tb.Helper()
+		if r.Err() == nil || !glob.Match(pattern, r.Str) {
+			tb.Errorf("got %s, want an error matching %q", r, pattern)
+		}
+	}
+}
+
+// ExpectArrayLen expects an array, set or push reply of n elements, or a
+// map of n entries.
+func ExpectArrayLen(n int) Check {
+	return func(tb testing.TB, r Reply) {
+		tb.Helper()
+		got := len(r.Elems)
+		switch r.Type {
+		case resp.Array, resp.Set, resp.Push:
+		case resp.Map:
+			got /= 2
+		default:
+			tb.Errorf("got %s, want an array of %d elements", r, n)
+			return
+		}
+		if got != n {
+			tb.Errorf("got %d elements in %s, want %d", got, r, n)
+		}
+	}
+}
+
+// ExpectStrings expects an aggregate reply whose elements have the text of
+// want, in order.
+func ExpectStrings(want ...string) Check {
+	return func(tb testing.TB, r Reply) {
+		tb.Helper()
+		got := r.Strings()
+		switch r.Type {
+		case resp.Array, resp.Set, resp.Push, resp.Map:
+		default:
+			tb.Errorf("got %s, want %q", r, want)
+			return
+		}
+		if len(got) != len(want) {
+			tb.Errorf("got %s, want %q", r, want)
+			return
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				tb.Errorf("got %s, want %q", r, want)
+				return
+			}
+		}
+	}
+}
+
+// All runs each of checks on the reply.
+func All(checks ...Check) Check {
+	return func(tb testing.TB, r Reply) {
+		tb.Helper()
+		for _, check := range checks {
+			check(tb, r)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package redhubtest_test
+
+import (
+	"testing"
+
+	"github.com/IceFireDB/redhub/pkg/resp"
+	"github.com/IceFireDB/redhub/redhubtest"
+)
+
+// failTB records whether a check failed.
+type failTB struct {
+	testing.TB
+	failed bool
+}
+
+func (tb *failTB) Helper()                                   {}
+func (tb *failTB) Errorf(format string, args ...interface{}) { tb.failed = true }
+
+func TestChecks(t *testing.T) {
+	var (
+		ok    = redhubtest.Reply{Type: resp.String, Str: "OK"}
+		bulk  = redhubtest.Reply{Type: resp.Bulk, Str: "OK"}
+		verb  = redhubtest.Reply{Type: resp.Verbatim, Str: "OK"}
+		one   = redhubtest.Reply{Type: resp.Integer, Str: "1", Int: 1}
+		null  = redhubtest.Reply{Type: resp.Null}
+		err   = redhubtest.Reply{Type: resp.Error, Str: "WRONGTYPE Operation against a key"}
+		blob  = redhubtest.Reply{Type: resp.BlobError, Str: "ERR blob"}
+		array = redhubtest.Reply{Type: resp.Array, Elems: []redhubtest.Reply{bulk, one}}
+		set   = redhubtest.Reply{Type: resp.Set, Elems: []redhubtest.Reply{bulk, one}}
+		dict  = redhubtest.Reply{Type: resp.Map, Elems: []redhubtest.Reply{bulk, one}}
+	)
+	tests := []struct {
+		name  string
+		check redhubtest.Check
+		pass  []redhubtest.Reply
+		fail  []redhubtest.Reply
+	}{
+		{"ExpectString", redhubtest.ExpectString("OK"), []redhubtest.Reply{ok}, []redhubtest.Reply{bulk, err, null}},
+		{"ExpectBulk", redhubtest.ExpectBulk("OK"), []redhubtest.Reply{bulk, verb}, []redhubtest.Reply{ok, null}},
+		{"ExpectInt", redhubtest.ExpectInt(1), []redhubtest.Reply{one},
+			[]redhubtest.Reply{{Type: resp.Integer, Str: "2", Int: 2}, {Type: resp.Bulk, Str: "1"}}},
+		{"ExpectNull", redhubtest.ExpectNull(), []redhubtest.Reply{null},
+			[]redhubtest.Reply{{Type: resp.Bulk}, {Type: resp.Array}}},
+		{"ExpectError", redhubtest.ExpectError("WRONGTYPE*"), []redhubtest.Reply{err},
+			[]redhubtest.Reply{blob, {Type: resp.String, Str: "WRONGTYPE"}}},
+		{"ExpectError blob", redhubtest.ExpectError("ERR blob"), []redhubtest.Reply{blob}, []redhubtest.Reply{err}},
+		{"ExpectArrayLen", redhubtest.ExpectArrayLen(2), []redhubtest.Reply{array, set},
+			[]redhubtest.Reply{dict, ok, {Type: resp.Array}}},
+		{"ExpectArrayLen map", redhubtest.ExpectArrayLen(1), []redhubtest.Reply{dict}, []redhubtest.Reply{array}},
+		{"ExpectStrings", redhubtest.ExpectStrings("OK", "1"), []redhubtest.Reply{array, set, dict},
+			[]redhubtest.Reply{ok, {Type: resp.Array, Elems: []redhubtest.Reply{bulk}},
+				{Type: resp.Array, Elems: []redhubtest.Reply{one, bulk}}}},
+		{"All", redhubtest.All(redhubtest.ExpectArrayLen(2), redhubtest.ExpectStrings("OK", "1")),
+			[]redhubtest.Reply{array}, []redhubtest.Reply{dict}},
+	}
+	for _, tt := range tests {
+		for _, r := range tt.pass {
+			tb := &failTB{TB: t}
+			if tt.check(tb, r); tb.failed {
+				t.Errorf("%s failed on %s", tt.name, r)
+			}
+		}
+		for _, r := range tt.fail {
+			tb := &failTB{TB: t}
+			if tt.check(tb, r); !tb.failed {
+				t.Errorf("%s passed on %s", tt.name, r)
+			}
+		}
+	}
+}
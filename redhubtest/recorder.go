@@ -0,0 +1,342 @@
+package redhubtest
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/IceFireDB/redhub"
+	"github.com/IceFireDB/redhub/pkg/resp"
+)
+
+// Recorder is a redhub.Conn that records what a handler writes, to unit
+// test handlers without a server or a network:
+//
+//	rec := redhubtest.NewRecorder()
+//	handler(rec, redhubtest.Command("GET", "k"))
+//	rec.Expect(t, redhubtest.ExpectBulk("v"))
+//
+// Replies are encoded as a connection would encode them, for the protocol
+// set with SetProtocol, and decoded into Reply values by Replies. The
+// exported fields set what the Recorder reports as a Conn; set them before
+// the handler runs.
+type Recorder struct {
+	// ConnID is returned by ID.
+	ConnID uint64
+	// Addr is returned by RemoteAddr.
+	Addr string
+	// ListenerAddr is returned by Listener.
+	ListenerAddr string
+	// TLSState is returned by TLS, and Subject by ClientSubject.
+	TLSState *tls.ConnectionState
+	Subject  string
+	// ClientNoEvict and ClientNoTouch are returned by NoEvict and NoTouch.
+	ClientNoEvict bool
+	ClientNoTouch bool
+	// ReplyOff drops the replies written, as CLIENT REPLY OFF does, and
+	// makes Replying return false.
+	ReplyOff bool
+	// Pipeline holds the commands queued after the one being served,
+	// returned by PeekPipeline and ReadPipeline.
+	Pipeline []resp.Command
+
+	mu       sync.Mutex
+	wr       *resp.Writer
+	pushed   []byte
+	user     string
+	ctx      context.Context
+	deferred *Deferred
+}
+
+var nextRecorderID uint64
+
+// NewRecorder returns a Recorder speaking RESP2, with a fresh ConnID.
+func NewRecorder() *Recorder {
+	return &Recorder{
+		ConnID:       atomic.AddUint64(&nextRecorderID, 1),
+		Addr:         "127.0.0.1:50000",
+		ListenerAddr: "tcp://127.0.0.1:6379",
+		wr:           resp.NewWriter(),
+		user:         "default",
+		ctx:          context.Background(),
+	}
+}
+
+// Command returns the command made of args, formatted as Client.Send
+// formats them, to pass to a handler.
+func Command(args ...interface{}) resp.Command {
+	cmd := resp.Command{
+		Raw:  appendCommand(nil, args),
+		Args: make([][]byte, len(args)),
+	}
+	for i, arg := range args {
+		cmd.Args[i] = argBytes(arg)
+	}
+	return cmd
+}
+
+// Serve runs handler for the command made of args, with r as its Conn.
+func (r *Recorder) Serve(handler func(c redhub.Conn, cmd resp.Command) redhub.Action, args ...interface{}) redhub.Action {
+	return handler(r, Command(args...))
+}
+
+// Bytes returns the replies written so far, encoded.
+func (r *Recorder) Bytes() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]byte(nil), r.wr.Buffer()...)
+}
+
+// Replies decodes the replies written so far. It fails when the last reply
+// is incomplete, for example when an array has fewer elements written than
+// its header announced.
+func (r *Recorder) Replies() ([]Reply, error) {
+	return decodeAll(r.Bytes())
+}
+
+// Pushes decodes the messages sent with Push and AsyncWrite so far.
+func (r *Recorder) Pushes() ([]Reply, error) {
+	r.mu.Lock()
+	data := append([]byte(nil), r.pushed...)
+	r.mu.Unlock()
+	return decodeAll(data)
+}
+
+// Expect checks that exactly one reply was written, and runs check on it.
+func (r *Recorder) Expect(tb testing.TB, check Check) Reply {
+	tb.Helper()
+	replies, err := r.Replies()
+	if err != nil {
+		tb.Fatalf("redhubtest: decoding replies: %v", err)
+	}
+	if len(replies) != 1 {
+		tb.Fatalf("redhubtest: got %d replies, want 1: %v", len(replies), replies)
+	}
+	check(tb, replies[0])
+	return replies[0]
+}
+
+// Reset discards the replies and messages recorded, and any deferred
+// reply, so r can serve another command.
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.wr.Flush()
+	r.pushed = nil
+	r.deferred = nil
+}
+
+// Deferred returns the reply the handler parked with Defer, or nil.
+func (r *Recorder) Deferred() *Deferred {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.deferred
+}
+
+func decodeAll(data []byte) ([]Reply, error) {
+	var replies []Reply
+	br := bufio.NewReader(bytes.NewReader(data))
+	for {
+		if _, err := br.Peek(1); err == io.EOF {
+			return replies, nil
+		}
+		reply, err := readReply(br)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return replies, err
+		}
+		replies = append(replies, reply)
+	}
+}
+
+// write runs fn on the writer, muted when ReplyOff is set.
+func (r *Recorder) write(fn func(w *resp.Writer)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.wr.Mute(r.ReplyOff)
+	fn(r.wr)
+}
+
+func (r *Recorder) WriteError(msg string)  { r.write(func(w *resp.Writer) { w.WriteError(msg) }) }
+func (r *Recorder) WriteString(str string) { r.write(func(w *resp.Writer) { w.WriteString(str) }) }
+func (r *Recorder) WriteBulk(bulk []byte)  { r.write(func(w *resp.Writer) { w.WriteBulk(bulk) }) }
+func (r *Recorder) WriteBulkString(bulk string) {
+	r.write(func(w *resp.Writer) { w.WriteBulkString(bulk) })
+}
+func (r *Recorder) WriteInt(num int)       { r.write(func(w *resp.Writer) { w.WriteInt(num) }) }
+func (r *Recorder) WriteInt64(num int64)   { r.write(func(w *resp.Writer) { w.WriteInt64(num) }) }
+func (r *Recorder) WriteUint64(num uint64) { r.write(func(w *resp.Writer) { w.WriteUint64(num) }) }
+func (r *Recorder) WriteArray(count int)   { r.write(func(w *resp.Writer) { w.WriteArray(count) }) }
+func (r *Recorder) WriteNull()             { r.write(func(w *resp.Writer) { w.WriteNull() }) }
+func (r *Recorder) WriteNullArray()        { r.write(func(w *resp.Writer) { w.WriteNullArray() }) }
+func (r *Recorder) WriteMap(count int)     { r.write(func(w *resp.Writer) { w.WriteMap(count) }) }
+func (r *Recorder) WriteSet(count int)     { r.write(func(w *resp.Writer) { w.WriteSet(count) }) }
+func (r *Recorder) WritePush(count int)    { r.write(func(w *resp.Writer) { w.WritePush(count) }) }
+func (r *Recorder) WriteAttribute(count int) {
+	r.write(func(w *resp.Writer) { w.WriteAttribute(count) })
+}
+func (r *Recorder) WriteDouble(f float64) { r.write(func(w *resp.Writer) { w.WriteDouble(f) }) }
+func (r *Recorder) WriteBool(t bool)      { r.write(func(w *resp.Writer) { w.WriteBool(t) }) }
+func (r *Recorder) WriteBigNumber(num string) {
+	r.write(func(w *resp.Writer) { w.WriteBigNumber(num) })
+}
+func (r *Recorder) WriteVerbatim(format, str string) {
+	r.write(func(w *resp.Writer) { w.WriteVerbatim(format, str) })
+}
+func (r *Recorder) WriteRaw(data []byte)   { r.write(func(w *resp.Writer) { w.WriteRaw(data) }) }
+func (r *Recorder) WriteAny(v interface{}) { r.write(func(w *resp.Writer) { w.WriteAny(v) }) }
+
+func (r *Recorder) Protocol() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.wr.Protocol()
+}
+
+func (r *Recorder) SetProtocol(proto int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.wr.SetProtocol(proto)
+}
+
+func (r *Recorder) Push(values ...interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.wr.Protocol() == resp.RESP3 {
+		r.pushed = resp.AppendPush(r.pushed, len(values))
+		for _, v := range values {
+			r.pushed = resp.AppendAnyRESP3(r.pushed, v)
+		}
+		return
+	}
+	r.pushed = resp.AppendArray(r.pushed, len(values))
+	for _, v := range values {
+		r.pushed = resp.AppendAny(r.pushed, v)
+	}
+}
+
+func (r *Recorder) AsyncWrite(data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pushed = append(r.pushed, data...)
+}
+
+func (r *Recorder) RemoteAddr() string             { return r.Addr }
+func (r *Recorder) Listener() string               { return r.ListenerAddr }
+func (r *Recorder) ID() uint64                     { return r.ConnID }
+func (r *Recorder) Replying() bool                 { return !r.ReplyOff }
+func (r *Recorder) NoEvict() bool                  { return r.ClientNoEvict }
+func (r *Recorder) NoTouch() bool                  { return r.ClientNoTouch }
+func (r *Recorder) TLS() *tls.ConnectionState      { return r.TLSState }
+func (r *Recorder) ClientSubject() string          { return r.Subject }
+func (r *Recorder) GetContext() context.Context    { return r.ctx }
+func (r *Recorder) SetContext(ctx context.Context) { r.ctx = ctx }
+
+func (r *Recorder) User() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.user
+}
+
+func (r *Recorder) SetUser(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.user = name
+}
+
+func (r *Recorder) ReadPipeline() []resp.Command {
+	cmds := r.Pipeline
+	r.Pipeline = nil
+	return cmds
+}
+
+func (r *Recorder) PeekPipeline() []resp.Command {
+	return r.Pipeline
+}
+
+// Defer parks the command being served. The returned reply is also
+// available from Deferred, for the test to resolve, expire or cancel.
+func (r *Recorder) Defer(timeout time.Duration, onTimeout func(c redhub.Conn)) redhub.Reply {
+	d := &Deferred{
+		Timeout:   timeout,
+		rec:       r,
+		onTimeout: onTimeout,
+		done:      make(chan struct{}),
+	}
+	r.mu.Lock()
+	r.deferred = d
+	r.mu.Unlock()
+	return d
+}
+
+// Deferred is a reply parked with Recorder.Defer. Its reply is written to
+// the Recorder when it is resolved or expires, as the connection would
+// write it.
+type Deferred struct {
+	// Timeout is the timeout the handler passed to Defer. It never elapses
+	// on its own; call Expire instead.
+	Timeout time.Duration
+
+	rec       *Recorder
+	onTimeout func(c redhub.Conn)
+	state     int32
+	done      chan struct{}
+}
+
+const (
+	deferredPending int32 = iota
+	deferredFinished
+)
+
+// Resolve writes the reply with fn, unless the reply has already been
+// resolved, expired or cancelled.
+func (d *Deferred) Resolve(fn func(c redhub.Conn)) bool {
+	if !d.finish() {
+		return false
+	}
+	fn(d.rec)
+	return true
+}
+
+// Done returns a channel that is closed once the reply is resolved,
+// expires or is cancelled.
+func (d *Deferred) Done() <-chan struct{} {
+	return d.done
+}
+
+// Expire makes the reply time out, writing it with the onTimeout function
+// passed to Defer, or as a null array when that was nil. It reports false
+// when the reply was no longer pending.
+func (d *Deferred) Expire() bool {
+	if !d.finish() {
+		return false
+	}
+	if d.onTimeout != nil {
+		d.onTimeout(d.rec)
+	} else {
+		d.rec.WriteNullArray()
+	}
+	return true
+}
+
+// Cancel cancels the reply without writing it, as closing the connection
+// does. It reports false when the reply was no longer pending.
+func (d *Deferred) Cancel() bool {
+	return d.finish()
+}
+
+func (d *Deferred) finish() bool {
+	if !atomic.CompareAndSwapInt32(&d.state, deferredPending, deferredFinished) {
+		return false
+	}
+	close(d.done)
+	return true
+}
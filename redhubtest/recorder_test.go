@@ -0,0 +1,136 @@
+package redhubtest_test
+
+import (
+	"testing"
+
+	"github.com/IceFireDB/redhub"
+	"github.com/IceFireDB/redhub/pkg/resp"
+	"github.com/IceFireDB/redhub/redhubtest"
+)
+
+func newMux() *redhub.Mux {
+	m := redhub.NewMux()
+	m.HandleFunc("ping", -1, func(c redhub.Conn, cmd resp.Command) redhub.Action {
+		if len(cmd.Args) > 1 {
+			c.WriteBulk(cmd.Args[1])
+		} else {
+			c.WriteString("PONG")
+		}
+		return redhub.None
+	})
+	m.Handle(redhub.CommandSpec{
+		Name: "config", Arity: -2,
+		Subcommands: []redhub.CommandSpec{
+			{Name: "get", Arity: 3, Handler: func(c redhub.Conn, cmd resp.Command) redhub.Action {
+				c.WriteMap(1)
+				c.WriteBulk(cmd.Args[2])
+				c.WriteBulkString("yes")
+				return redhub.None
+			}},
+		},
+	})
+	return m
+}
+
+func TestRecorderMux(t *testing.T) {
+	m := newMux()
+	tests := []struct {
+		args  []interface{}
+		check redhubtest.Check
+	}{
+		{[]interface{}{"PING"}, redhubtest.ExpectString("PONG")},
+		{[]interface{}{"ping", "hello"}, redhubtest.ExpectBulk("hello")},
+		{[]interface{}{"nosuch", "a"},
+			redhubtest.ExpectError("ERR unknown command 'nosuch', with args beginning with: 'a' ")},
+		{[]interface{}{"CONFIG", "GET", "appendonly"}, redhubtest.ExpectStrings("appendonly", "yes")},
+		{[]interface{}{"config", "get"},
+			redhubtest.ExpectError("ERR wrong number of arguments for 'config|get' command")},
+		{[]interface{}{"config", "nosuch"},
+			redhubtest.ExpectError("ERR unknown subcommand 'nosuch'. Try CONFIG HELP.")},
+		{[]interface{}{"config"},
+			redhubtest.ExpectError("ERR wrong number of arguments for 'config' command")},
+	}
+	for _, tt := range tests {
+		rec := redhubtest.NewRecorder()
+		rec.Serve(m.ServeRESP, tt.args...)
+		rec.Expect(t, tt.check)
+	}
+}
+
+// writeAll writes one of each kind of reply, as a handler would.
+func writeAll(c redhub.Conn, cmd resp.Command) redhub.Action {
+	c.WriteMap(1)
+	c.WriteBulkString("k")
+	c.WriteBulkString("v")
+	c.WriteSet(1)
+	c.WriteBulkString("m")
+	c.WriteDouble(1.5)
+	c.WriteBool(true)
+	c.WriteBigNumber("12345678901234567890")
+	c.WriteVerbatim("txt", "text")
+	c.WriteNull()
+	c.WriteAttribute(1)
+	c.WriteBulkString("ttl")
+	c.WriteInt(10)
+	c.WriteString("OK")
+	return redhub.None
+}
+
+func TestRecorderProtocol(t *testing.T) {
+	tests := []struct {
+		proto int
+		types []resp.Type
+		strs  []string
+	}{
+		{
+			proto: resp.RESP2,
+			types: []resp.Type{resp.Array, resp.Array, resp.Bulk, resp.Integer, resp.Bulk, resp.Bulk, resp.Null, resp.String},
+			strs:  []string{"", "", "1.5", "1", "12345678901234567890", "text", "", "OK"},
+		},
+		{
+			proto: resp.RESP3,
+			types: []resp.Type{resp.Map, resp.Set, resp.Double, resp.Boolean, resp.BigNumber, resp.Verbatim, resp.Null, resp.String},
+			strs:  []string{"", "", "1.5", "t", "12345678901234567890", "text", "", "OK"},
+		},
+	}
+	for _, tt := range tests {
+		rec := redhubtest.NewRecorder()
+		rec.SetProtocol(tt.proto)
+		rec.Serve(writeAll, "writeall")
+		replies, err := rec.Replies()
+		if err != nil {
+			t.Fatalf("RESP%d: %v", tt.proto, err)
+		}
+		if len(replies) != len(tt.types) {
+			t.Fatalf("RESP%d: got %d replies, want %d: %v", tt.proto, len(replies), len(tt.types), replies)
+		}
+		for i, r := range replies {
+			if r.Type != tt.types[i] || r.Str != tt.strs[i] {
+				t.Errorf("RESP%d: reply %d is %s, want type %q and %q", tt.proto, i, r, tt.types[i], tt.strs[i])
+			}
+		}
+		if got := replies[0].Strings(); len(got) != 2 || got[0] != "k" || got[1] != "v" {
+			t.Errorf("RESP%d: map is %v, want [k v]", tt.proto, got)
+		}
+	}
+}
+
+func TestRecorderPush(t *testing.T) {
+	for _, proto := range []int{resp.RESP2, resp.RESP3} {
+		rec := redhubtest.NewRecorder()
+		rec.SetProtocol(proto)
+		rec.Push("message", "ch", "hi")
+		pushes, err := rec.Pushes()
+		if err != nil {
+			t.Fatalf("RESP%d: %v", proto, err)
+		}
+		want := resp.Type(resp.Array)
+		if proto == resp.RESP3 {
+			want = resp.Push
+		}
+		if len(pushes) != 1 || pushes[0].Type != want {
+			t.Fatalf("RESP%d: got %v, want one message of type %q", proto, pushes, want)
+		}
+		redhubtest.ExpectStrings("message", "ch", "hi")(t, pushes[0])
+	}
+}
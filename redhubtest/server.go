@@ -0,0 +1,146 @@
+// Package redhubtest provides utilities for testing RedHub handlers: an
+// in-process server, a minimal RESP client and assertions on its replies.
+//
+//	srv := redhubtest.NewPipeServer(redhubtest.NewHub(mux.ServeRESP), redhub.Options{})
+//	defer srv.Close()
+//	c := srv.Client(t)
+//	c.Expect(t, redhubtest.ExpectString("OK"), "SET", "k", "v")
+//	c.Expect(t, redhubtest.ExpectBulk("v"), "GET", "k")
+//	c.Expect(t, redhubtest.ExpectError("WRONGTYPE*"), "LPUSH", "k", "x")
+package redhubtest
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/IceFireDB/redhub"
+	"github.com/IceFireDB/redhub/pkg/resp"
+)
+
+// Server is a RedHub server for tests, listening on a loopback port or on
+// an in-memory pipe.
+type Server struct {
+	// Addr is the address of the server, "tcp://127.0.0.1:<port>" or "pipe".
+	Addr string
+
+	// Hub is the RedHub the server serves.
+	Hub *redhub.RedHub
+
+	srv  *redhub.Server
+	pipe *pipeListener
+	once sync.Once
+}
+
+// NewHub returns a RedHub that serves handler, for the servers of this
+// package. Middleware and plugins can be added to it before the server
+// starts.
+func NewHub(handler func(c redhub.Conn, cmd resp.Command) redhub.Action) *redhub.RedHub {
+	return redhub.NewRedHub(
+		func(c redhub.Conn) redhub.Action { return redhub.None },
+		func(c redhub.Conn, err error) redhub.Action { return redhub.None },
+		handler, time.Second, time.Minute,
+	)
+}
+
+// NewServer starts a server that serves rh on a free loopback port with the
+// gnet engine. It panics if the server fails to start. The caller should
+// call Close when finished, to shut it down.
+func NewServer(rh *redhub.RedHub, options redhub.Options) *Server {
+	srv := redhub.NewServer("tcp://127.0.0.1:0", options, rh)
+	if err := srv.Start(); err != nil {
+		panic("redhubtest: failed to start server: " + err.Error())
+	}
+	return &Server{Addr: "tcp://" + srv.Addr().String(), Hub: rh, srv: srv}
+}
+
+// NewPipeServer starts a server that serves rh on an in-memory listener,
+// whose connections are net.Pipe pairs, so tests open no sockets. It uses
+// the net.Listener engine of redhub.NewListenerServer, which ignores the
+// options that configure gnet. It panics if the server fails to start.
+func NewPipeServer(rh *redhub.RedHub, options redhub.Options) *Server {
+	ln := &pipeListener{conns: make(chan net.Conn), done: make(chan struct{})}
+	srv := redhub.NewListenerServer(ln, options, rh)
+	if err := srv.Start(); err != nil {
+		panic("redhubtest: failed to start server: " + err.Error())
+	}
+	return &Server{Addr: "pipe", Hub: rh, srv: srv, pipe: ln}
+}
+
+// Dial opens a client connection to the server.
+func (s *Server) Dial() (*Client, error) {
+	if s.pipe != nil {
+		nc, err := s.pipe.dial()
+		if err != nil {
+			return nil, err
+		}
+		return NewClient(nc), nil
+	}
+	nc, err := net.Dial("tcp", s.srv.Addr().String())
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(nc), nil
+}
+
+// Client opens a client connection to the server, failing tb if it
+// cannot. The connection is closed when the test finishes.
+func (s *Server) Client(tb testing.TB) *Client {
+	tb.Helper()
+	c, err := s.Dial()
+	if err != nil {
+		tb.Fatalf("redhubtest: dial %s: %v", s.Addr, err)
+	}
+	tb.Cleanup(func() { _ = c.Close() })
+	return c
+}
+
+// Close shuts the server down and waits for it to exit.
+func (s *Server) Close() {
+	s.once.Do(func() {
+		_ = s.srv.Stop()
+	})
+}
+
+// pipeListener is a net.Listener whose connections are the server ends of
+// net.Pipe pairs.
+type pipeListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+var errListenerClosed = errors.New("redhubtest: listener closed")
+
+func (l *pipeListener) dial() (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		return nil, errListenerClosed
+	}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case nc := <-l.conns:
+		return nc, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr { return pipeAddr{} }
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
@@ -0,0 +1,199 @@
+package redhubtest_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/IceFireDB/redhub"
+	"github.com/IceFireDB/redhub/pkg/resp"
+	"github.com/IceFireDB/redhub/redhubtest"
+)
+
+// newServerMux extends newMux with commands that write each kind of reply
+// and push messages.
+func newServerMux() *redhub.Mux {
+	m := newMux()
+	m.HandleFunc("hello", -1, redhub.Hello)
+	m.HandleFunc("writeall", 1, writeAll)
+	m.HandleFunc("reply", 2, func(c redhub.Conn, cmd resp.Command) redhub.Action {
+		switch string(cmd.Args[1]) {
+		case "int":
+			c.WriteInt(42)
+		case "null":
+			c.WriteNull()
+		case "array":
+			c.WriteArray(3)
+			c.WriteBulkString("a")
+			c.WriteBulkString("b")
+			c.WriteBulkString("c")
+		default:
+			c.WriteError("ERR unknown reply '" + string(cmd.Args[1]) + "'")
+		}
+		return redhub.None
+	})
+	m.HandleFunc("push", 2, func(c redhub.Conn, cmd resp.Command) redhub.Action {
+		c.Push("message", cmd.Args[1], "hi")
+		c.WriteString("OK")
+		return redhub.None
+	})
+	return m
+}
+
+// servers start a server of each kind.
+var servers = []struct {
+	name   string
+	prefix string // of Server.Addr
+	start  func(rh *redhub.RedHub, options redhub.Options) *redhubtest.Server
+}{
+	{"pipe", "pipe", redhubtest.NewPipeServer},
+	{"tcp", "tcp://127.0.0.1:", redhubtest.NewServer},
+}
+
+func TestServers(t *testing.T) {
+	tests := []struct {
+		args  []interface{}
+		check redhubtest.Check
+	}{
+		{[]interface{}{"PING"}, redhubtest.ExpectString("PONG")},
+		{[]interface{}{"ping", "hello"}, redhubtest.ExpectBulk("hello")},
+		{[]interface{}{"ping", []byte("a\r\nb")}, redhubtest.ExpectBulk("a\r\nb")},
+		{[]interface{}{"ping", 12}, redhubtest.ExpectBulk("12")},
+		{[]interface{}{"nosuch", "a"}, redhubtest.ExpectError("ERR unknown command 'nosuch'*")},
+		{[]interface{}{"CONFIG", "GET", "appendonly"}, redhubtest.ExpectStrings("appendonly", "yes")},
+		{[]interface{}{"config", "get"}, redhubtest.ExpectError("ERR wrong number of arguments*")},
+		{[]interface{}{"reply", "int"}, redhubtest.ExpectInt(42)},
+		{[]interface{}{"reply", "null"}, redhubtest.ExpectNull()},
+		{[]interface{}{"reply", "array"},
+			redhubtest.All(redhubtest.ExpectArrayLen(3), redhubtest.ExpectStrings("a", "b", "c"))},
+	}
+	for _, s := range servers {
+		t.Run(s.name, func(t *testing.T) {
+			srv := s.start(redhubtest.NewHub(newServerMux().ServeRESP), redhub.Options{})
+			defer srv.Close()
+			if !strings.HasPrefix(srv.Addr, s.prefix) {
+				t.Errorf("Addr is %q, want it to start with %q", srv.Addr, s.prefix)
+			}
+			c := srv.Client(t)
+			for _, tt := range tests {
+				c.Expect(t, tt.check, tt.args...)
+			}
+
+			// Pipelined commands are answered in order.
+			for _, arg := range []string{"1", "2", "3"} {
+				if err := c.Send("ping", arg); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, want := range []string{"1", "2", "3"} {
+				r, err := c.Receive()
+				if err != nil {
+					t.Fatal(err)
+				}
+				redhubtest.ExpectBulk(want)(t, r)
+			}
+
+			// Clients are independent.
+			other, err := srv.Dial()
+			if err != nil {
+				t.Fatal(err)
+			}
+			other.Expect(t, redhubtest.ExpectString("PONG"), "PING")
+			if err := other.Close(); err != nil {
+				t.Error(err)
+			}
+			c.Expect(t, redhubtest.ExpectString("PONG"), "PING")
+
+			srv.Close()
+			srv.Close()
+			if _, err := c.Do("PING"); err == nil {
+				t.Error("PING succeeded after Close")
+			}
+			if c, err := srv.Dial(); err == nil {
+				c.Close()
+				t.Error("Dial succeeded after Close")
+			}
+		})
+	}
+}
+
+// pushAndReply sends PUSH, checks the push message and the reply, which
+// may arrive in either order, and returns the push message.
+func pushAndReply(t *testing.T, c *redhubtest.Client) redhubtest.Reply {
+	t.Helper()
+	if err := c.Send("push", "ch"); err != nil {
+		t.Fatal(err)
+	}
+	var push redhubtest.Reply
+	for i := 0; i < 2; i++ {
+		r, err := c.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Type == resp.String {
+			redhubtest.ExpectString("OK")(t, r)
+		} else {
+			redhubtest.All(redhubtest.ExpectArrayLen(3), redhubtest.ExpectStrings("message", "ch", "hi"))(t, r)
+			push = r
+		}
+	}
+	return push
+}
+
+func TestServersRESP3(t *testing.T) {
+	for _, s := range servers {
+		t.Run(s.name, func(t *testing.T) {
+			srv := s.start(redhubtest.NewHub(newServerMux().ServeRESP), redhub.Options{})
+			defer srv.Close()
+			c := srv.Client(t)
+
+			// RESP2 pushes are arrays.
+			if push := pushAndReply(t, c); push.Type != resp.Array {
+				t.Errorf("push is %s, want a RESP2 array", push)
+			}
+
+			r := c.Expect(t, redhubtest.ExpectArrayLen(7), "HELLO", "3")
+			if r.Type != resp.Map {
+				t.Fatalf("HELLO 3 replied %s, want a map", r)
+			}
+
+			c.Expect(t, redhubtest.ExpectStrings("appendonly", "yes"), "CONFIG", "GET", "appendonly")
+			if push := pushAndReply(t, c); push.Type != resp.Push {
+				t.Errorf("push is %s, want a RESP3 push", push)
+			}
+
+			// writeall writes eight replies: the attribute is dropped.
+			if err := c.Send("writeall"); err != nil {
+				t.Fatal(err)
+			}
+			checks := []redhubtest.Check{
+				redhubtest.ExpectStrings("k", "v"),
+				redhubtest.ExpectStrings("m"),
+				func(tb testing.TB, r redhubtest.Reply) {
+					if r.Type != resp.Double || r.Float != 1.5 {
+						tb.Errorf("got %s, want (double) 1.5", r)
+					}
+				},
+				func(tb testing.TB, r redhubtest.Reply) {
+					if r.Type != resp.Boolean || !r.Bool {
+						tb.Errorf("got %s, want (boolean) true", r)
+					}
+				},
+				func(tb testing.TB, r redhubtest.Reply) {
+					if r.Type != resp.BigNumber || r.Str != "12345678901234567890" {
+						tb.Errorf("got %s, want (big number) 12345678901234567890", r)
+					}
+				},
+				redhubtest.ExpectBulk("text"),
+				redhubtest.ExpectNull(),
+				redhubtest.ExpectString("OK"),
+			}
+			for _, check := range checks {
+				r, err := c.Receive()
+				if err != nil {
+					t.Fatal(err)
+				}
+				check(t, r)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package redhub
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/IceFireDB/redhub/pkg/resp"
+)
+
+// Reply is the pending reply of a command parked with Conn.Defer.
+type Reply interface {
+	// Resolve completes the reply. fn is called on the connection's
+	// processing goroutine to write the reply, after which the connection
+	// goes on with its queued commands. Resolve may be called from any
+	// goroutine. It returns false, without calling fn, when the reply has
+	// already been resolved, has timed out or the connection has closed, so
+	// that the caller can hand its value to another waiter.
+	Resolve(fn func(c Conn)) bool
+	// Done returns a channel that is closed once the reply is resolved, has
+	// timed out or is cancelled because the connection closed.
+	Done() <-chan struct{}
+}
+
+const (
+	replyPending int32 = iota
+	replyResolved
+	replyTimedOut
+	replyCancelled
+)
+
+type reply struct {
+	state     int32
+	fn        func(c Conn)
+	onTimeout func(c Conn)
+	timeout   time.Duration
+	done      chan struct{}
+}
+
+func (r *reply) Resolve(fn func(c Conn)) bool {
+	if !atomic.CompareAndSwapInt32(&r.state, replyPending, replyResolved) {
+		return false
+	}
+	r.fn = fn
+	close(r.done)
+	return true
+}
+
+func (r *reply) Done() <-chan struct{} {
+	return r.done
+}
+
+// finish moves a pending reply to state. It reports false when the reply was
+// no longer pending.
+func (r *reply) finish(state int32) bool {
+	if !atomic.CompareAndSwapInt32(&r.state, replyPending, state) {
+		return false
+	}
+	close(r.done)
+	return true
+}
+
+func (c *conn) Defer(timeout time.Duration, onTimeout func(c Conn)) Reply {
+	r := &reply{
+		onTimeout: onTimeout,
+		timeout:   timeout,
+		done:      make(chan struct{}),
+	}
+	c.muParked.Lock()
+	c.parked = r
+	c.muParked.Unlock()
+	return r
+}
+
+// wait blocks until the parked reply r completes, then writes it with the
+// panic handling of serve. The caller must not hold cb.mu, which wait holds
+// again when it returns true. wait returns false when the connection closed.
+func (c *conn) wait(r *reply, cmd resp.Command) (bool, Action) {
+	if r.timeout > 0 {
+		timer := time.NewTimer(r.timeout)
+		select {
+		case <-r.done:
+		case <-timer.C:
+			r.finish(replyTimedOut)
+			<-r.done
+		}
+		timer.Stop()
+	} else {
+		<-r.done
+	}
+
+	if atomic.LoadInt32(&r.state) == replyCancelled {
+		return false, Close
+	}
+	c.cb.mu.Lock()
+	if c.isClosed() {
+		c.cb.mu.Unlock()
+		return false, Close
+	}
+
+	c.muParked.Lock()
+	c.parked = nil
+	c.muParked.Unlock()
+
+	c.muOut.Lock()
+	c.busy = true
+	c.muOut.Unlock()
+
+	write := r.fn
+	if atomic.LoadInt32(&r.state) == replyTimedOut {
+		write = r.onTimeout
+		if write == nil {
+			write = func(c Conn) { c.WriteNullArray() }
+		}
+	}
+	return true, c.serve(func(c Conn, _ resp.Command) Action {
+		write(c)
+		return None
+	}, cmd)
+}
+
+// cancelParked cancels the parked reply, if any.
+func (c *conn) cancelParked() {
+	c.muParked.Lock()
+	r := c.parked
+	c.parked = nil
+	c.muParked.Unlock()
+	if r != nil {
+		r.finish(replyCancelled)
+	}
+}
+
+// parkedReply returns the reply the last handler call parked, if any.
+func (c *conn) parkedReply() *reply {
+	c.muParked.Lock()
+	defer c.muParked.Unlock()
+	return c.parked
+}
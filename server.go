@@ -0,0 +1,230 @@
+package redhub
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync"
+
+	gnet "github.com/panjf2000/gnet/v2"
+)
+
+// ErrServerStarted is returned by Server.Start when the server has already
+// been started.
+var ErrServerStarted = errors.New("redhub: server already started")
+
+// Server runs a RedHub on an address and exposes its lifecycle:
+//
+//	srv := redhub.NewServer("tcp://127.0.0.1:0", redhub.Options{Multicore: true}, rh)
+//	if err := srv.Start(); err != nil {
+//		log.Fatal(err)
+//	}
+//	log.Printf("listening on %s", srv.Addr())
+//	...
+//	err := srv.Stop()
+type Server struct {
+	hub     *RedHub
+	eng     engine
+	options Options
+
+	mu      sync.Mutex
+	started bool
+	err     error
+	ready   chan struct{}
+	done    chan struct{}
+}
+
+// NewServer creates a Server that serves rh on addr, for example
+// "tcp://127.0.0.1:6380". Use port 0 to listen on a free port and find it
+// with Addr once the server is ready.
+func NewServer(addr string, options Options, rh *RedHub) *Server {
+	return &Server{
+		hub:     rh,
+		eng:     &gnetEngine{rs: rh, addr: addr},
+		options: options,
+		ready:   make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// NewListenerServer creates a Server that serves rh on ln, a listener the
+// process already owns, such as a socket-activated, test-harness or
+// in-memory listener. Connections are served by a goroutine each, using
+// only the net package, rather than by gnet event loops, and get the same
+// Conn and handler API. Options that configure gnet, such as Multicore or
+// ReusePort, are ignored; Ticker still runs the ticker. Stopping the server
+// closes ln.
+func NewListenerServer(ln net.Listener, options Options, rh *RedHub) *Server {
+	return &Server{
+		hub:     rh,
+		eng:     &netEngine{rs: rh, ln: ln},
+		options: options,
+		ready:   make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// Start starts serving in the background. It returns once the server is
+// listening, or with the error that kept it from starting.
+func (s *Server) Start() error {
+	s.mu.Lock()
+	if s.started {
+		s.mu.Unlock()
+		return ErrServerStarted
+	}
+	s.started = true
+	s.mu.Unlock()
+
+	s.hub.prepare(s.options, s.eng)
+	booted := s.hub.booted
+	go func() {
+		err := s.hub.run(s.eng)
+		s.mu.Lock()
+		s.err = err
+		s.mu.Unlock()
+		close(s.done)
+	}()
+
+	select {
+	case <-booted:
+		close(s.ready)
+		return nil
+	case <-s.done:
+		return s.Err()
+	}
+}
+
+// Ready returns a channel that is closed once the server is listening.
+func (s *Server) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// Addr returns the address the server listens on, or nil before it is
+// ready.
+func (s *Server) Addr() net.Addr {
+	s.hub.connSync.RLock()
+	defer s.hub.connSync.RUnlock()
+	return s.hub.listenAddr
+}
+
+// Addrs returns the addresses the server listens on for plaintext clients,
+// the main address followed by Options.Addrs, or nil before it is ready.
+func (s *Server) Addrs() []net.Addr {
+	s.hub.connSync.RLock()
+	defer s.hub.connSync.RUnlock()
+	if s.hub.listenAddr == nil {
+		return nil
+	}
+	return append([]net.Addr{s.hub.listenAddr}, s.hub.addrs...)
+}
+
+// TLSAddr returns the address of the TLS listener, or nil before the
+// server is ready or when TLS isn't configured.
+func (s *Server) TLSAddr() net.Addr {
+	s.hub.connSync.RLock()
+	defer s.hub.connSync.RUnlock()
+	return s.hub.tlsAddr
+}
+
+// Done returns a channel that is closed once the server has stopped.
+func (s *Server) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns the error that stopped the server. It is nil while the server
+// is running and after a clean Stop.
+func (s *Server) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Stop shuts the server down gracefully, as RedHub.Shutdown does, giving
+// connections up to Options.ShutdownTimeout to drain, and waits for it to
+// stop.
+func (s *Server) Stop() error {
+	s.mu.Lock()
+	started := s.started
+	s.mu.Unlock()
+	if !started {
+		return nil
+	}
+
+	ctx := context.Background()
+	if s.options.ShutdownTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.options.ShutdownTimeout)
+		defer cancel()
+	}
+	if err := s.hub.Shutdown(ctx); err != nil {
+		return err
+	}
+	<-s.done
+	return s.Err()
+}
+
+// Serve serves clients on addr until ctx is done, then stops the server as
+// Server.Stop does. It returns nil once the server has shut down, or the
+// error that stopped it from serving.
+func Serve(ctx context.Context, addr string, options Options, rh *RedHub) error {
+	return NewServer(addr, options, rh).serve(ctx)
+}
+
+// ServeListener serves clients on ln until ctx is done, as Serve does, with
+// the engine of NewListenerServer.
+func ServeListener(ctx context.Context, ln net.Listener, options Options, rh *RedHub) error {
+	return NewListenerServer(ln, options, rh).serve(ctx)
+}
+
+func (s *Server) serve(ctx context.Context) error {
+	if err := s.Start(); err != nil {
+		return err
+	}
+	select {
+	case <-s.Done():
+		return s.Err()
+	case <-ctx.Done():
+	}
+	return s.Stop()
+}
+
+// ListendAndServe serves clients on addr until the engine stops. A nil is
+// sent on signal once the server is listening, or the error that kept it
+// from starting, and signal is closed when ListendAndServe returns.
+//
+// Deprecated: use Server or Serve.
+func ListendAndServe(signal chan error, addr string, options Options, rh *RedHub) error {
+	defer close(signal)
+
+	s := NewServer(addr, options, rh)
+	if err := s.Start(); err != nil {
+		signal <- err
+		return err
+	}
+	signal <- nil
+
+	<-s.Done()
+	if err := s.Err(); err != nil {
+		signal <- err
+		return err
+	}
+	return errors.New("context done")
+}
+
+// listenerAddr returns the address eng listens on, or nil when it can't be
+// determined, for example when the engine has several listeners.
+func listenerAddr(eng gnet.Engine) net.Addr {
+	fd, err := eng.Dup()
+	if err != nil {
+		return nil
+	}
+	f := os.NewFile(uintptr(fd), "listener")
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil
+	}
+	defer ln.Close()
+	return ln.Addr()
+}
@@ -0,0 +1,315 @@
+package redhub
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IceFireDB/redhub/pkg/resp"
+)
+
+// The limits of the arguments of a SLOWLOG entry, as in Redis.
+const (
+	slowlogMaxArgs   = 32
+	slowlogMaxString = 128
+)
+
+// SlowlogEntry is a command recorded by SLOWLOG.
+type SlowlogEntry struct {
+	// ID is the unique, increasing ID of the entry.
+	ID uint64
+	// Time is when the command was served, and Duration the time its
+	// handler took.
+	Time     time.Time
+	Duration time.Duration
+	// Args are the command and its arguments. Commands with more than 32
+	// arguments keep the first 31, followed by "... (N more arguments)",
+	// and arguments longer than 128 bytes are cut to their first 128
+	// bytes, followed by "... (N more bytes)".
+	Args []string
+	// Addr is the address of the client, and Name the name it set with
+	// CLIENT SETNAME.
+	Addr string
+	Name string
+}
+
+// slowlog is the Observer recording the commands of SLOWLOG in a ring
+// buffer.
+type slowlog struct {
+	mux       *Mux
+	monitors  *monitors // for their redactors
+	threshold int64     // time.Duration, accessed atomically
+
+	mu     sync.Mutex
+	ring   []SlowlogEntry
+	next   int
+	count  int
+	lastID uint64
+}
+
+// configure applies the slowlog options, keeping the newest entries that
+// fit.
+func (s *slowlog) configure(options Options) {
+	threshold := 10 * time.Millisecond
+	if options.SlowlogThreshold != nil {
+		threshold = *options.SlowlogThreshold
+	}
+	atomic.StoreInt64(&s.threshold, int64(threshold))
+
+	maxLen := options.SlowlogMaxLen
+	if maxLen <= 0 {
+		maxLen = 128
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if maxLen == len(s.ring) {
+		return
+	}
+	kept := s.entries(maxLen)
+	s.ring = make([]SlowlogEntry, maxLen)
+	s.next, s.count = 0, 0
+	for i := len(kept) - 1; i >= 0; i-- {
+		s.add(kept[i])
+	}
+}
+
+// add adds an entry, replacing the oldest when the ring is full. The caller
+// must hold mu.
+func (s *slowlog) add(e SlowlogEntry) {
+	s.ring[s.next] = e
+	s.next = (s.next + 1) % len(s.ring)
+	if s.count < len(s.ring) {
+		s.count++
+	}
+}
+
+// entries returns the n newest entries, newest first, or all of them when
+// n is negative. The caller must hold mu.
+func (s *slowlog) entries(n int) []SlowlogEntry {
+	if n < 0 || n > s.count {
+		n = s.count
+	}
+	out := make([]SlowlogEntry, n)
+	for i := range out {
+		out[i] = s.ring[(s.next-1-i+2*len(s.ring))%len(s.ring)]
+	}
+	return out
+}
+
+func (s *slowlog) ConnOpened(c Conn)            {}
+func (s *slowlog) ConnClosed(c Conn, err error) {}
+func (s *slowlog) Read(c Conn, n int)           {}
+func (s *slowlog) Written(c Conn, n int)        {}
+func (s *slowlog) ParseError(c Conn, err error) {}
+func (s *slowlog) Pipeline(c Conn, n int)       {}
+func (s *slowlog) BuffersReclaimed(n int)       {}
+
+func (s *slowlog) CommandServed(c Conn, cmd resp.Command, d time.Duration, errPrefix string) {
+	threshold := time.Duration(atomic.LoadInt64(&s.threshold))
+	if threshold < 0 || d < threshold {
+		return
+	}
+	if s.mux != nil && s.mux.flagged(cmd.Args, FlagSkipSlowlog) {
+		return
+	}
+	e := SlowlogEntry{
+		Time:     time.Now(),
+		Duration: d,
+		Args:     s.args(cmd.Args),
+		Addr:     c.RemoteAddr(),
+	}
+	if cc, ok := c.(*conn); ok {
+		cc.muInfo.Lock()
+		e.Name = cc.name
+		cc.muInfo.Unlock()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.ring) == 0 {
+		return
+	}
+	s.lastID++
+	e.ID = s.lastID
+	s.add(e)
+}
+
+// args copies args for an entry, redacted as MONITOR shows them.
+func (s *slowlog) args(args [][]byte) []string {
+	var redacted []string
+	if s.monitors != nil {
+		s.monitors.mu.RLock()
+		redacted = s.monitors.redacted(args)
+		s.monitors.mu.RUnlock()
+	}
+	return slowlogArgs(args, redacted)
+}
+
+// slowlogArgs copies args, or their redacted copy when it is not nil, within
+// the limits of a SLOWLOG entry.
+func slowlogArgs(args [][]byte, redacted []string) []string {
+	n := len(args)
+	if n > slowlogMaxArgs {
+		n = slowlogMaxArgs - 1
+	}
+	out := make([]string, n, n+1)
+	for i, arg := range args[:n] {
+		size := len(arg)
+		var str string
+		switch {
+		case redacted != nil:
+			str, size = redacted[i], len(redacted[i])
+		case size > slowlogMaxString:
+			str = string(arg[:slowlogMaxString])
+		default:
+			str = string(arg)
+		}
+		if size > slowlogMaxString {
+			str = str[:slowlogMaxString] + "... (" + strconv.Itoa(size-slowlogMaxString) + " more bytes)"
+		}
+		out[i] = str
+	}
+	if n < len(args) {
+		out = append(out, "... ("+strconv.Itoa(len(args)-n)+" more arguments)")
+	}
+	return out
+}
+
+// Slowlog returns the n newest commands recorded by SLOWLOG, newest first,
+// or all of them when n is negative.
+func (rs *RedHub) Slowlog(n int) []SlowlogEntry {
+	rs.slowlog.mu.Lock()
+	defer rs.slowlog.mu.Unlock()
+	return rs.slowlog.entries(n)
+}
+
+// ResetSlowlog drops the commands recorded by SLOWLOG.
+func (rs *RedHub) ResetSlowlog() {
+	s := &rs.slowlog
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.ring {
+		s.ring[i] = SlowlogEntry{}
+	}
+	s.next, s.count = 0, 0
+}
+
+// SlowlogCommand returns the spec of the SLOWLOG command, serving GET, LEN,
+// RESET and HELP. Register it on the Mux:
+//
+//	mux.Handle(rh.SlowlogCommand(mux))
+//
+// Registering it installs the Observer that records the commands whose
+// handler took longer than Options.SlowlogThreshold, so it must be done
+// before the server starts. Commands m flags with FlagSkipSlowlog are not
+// recorded, and arguments are redacted as MONITOR shows them; see
+// RedactMonitor.
+func (rs *RedHub) SlowlogCommand(m *Mux) CommandSpec {
+	s := &rs.slowlog
+	if s.ring == nil {
+		s.mux = m
+		s.monitors = &rs.monitors
+		rs.monitors.mu.Lock()
+		if rs.monitors.mux == nil {
+			rs.monitors.mux = m
+		}
+		rs.monitors.redactors()
+		rs.monitors.mu.Unlock()
+		s.configure(rs.options)
+		rs.Observe(s)
+	}
+	const flags = FlagAdmin | FlagLoading | FlagStale
+	categories := []string{"admin", "slow", "dangerous"}
+	return CommandSpec{
+		Name: "slowlog", Arity: -2, Group: "server", Categories: []string{"slow"},
+		Summary: "A container for slow log commands.", Since: "2.2.12",
+		Complexity: "Depends on subcommand.",
+		Subcommands: []CommandSpec{
+			{Name: "get", Arity: -2, Flags: flags, Handler: rs.slowlogGet, Categories: categories,
+				Summary: "Returns the slow log's entries.", Since: "2.2.12", Group: "server",
+				Complexity: "O(N) where N is the number of entries returned"},
+			{Name: "len", Arity: 2, Flags: flags, Handler: rs.slowlogLen, Categories: categories,
+				Summary: "Returns the number of entries in the slow log.", Since: "2.2.12", Group: "server",
+				Complexity: "O(1)"},
+			{Name: "reset", Arity: 2, Flags: flags, Handler: rs.slowlogReset, Categories: categories,
+				Summary: "Clears all entries from the slow log.", Since: "2.2.12", Group: "server",
+				Complexity: "O(N) where N is the number of entries in the slowlog"},
+			{Name: "help", Arity: 2, Flags: FlagLoading | FlagStale, Handler: rs.slowlogHelp,
+				Categories: []string{"slow"}, Summary: "Show helpful text about the different subcommands",
+				Since: "6.2.0", Group: "server", Complexity: "O(1)"},
+		},
+	}
+}
+
+func (rs *RedHub) slowlogGet(c Conn, cmd resp.Command) Action {
+	if len(cmd.Args) > 3 {
+		c.WriteError("ERR unknown subcommand or wrong number of arguments for '" + string(cmd.Args[1]) +
+			"'. Try SLOWLOG HELP.")
+		return None
+	}
+	n := 10
+	if len(cmd.Args) == 3 {
+		v, err := strconv.ParseInt(string(cmd.Args[2]), 10, 64)
+		if err != nil || v < -1 {
+			c.WriteError("ERR count should be greater than or equal to -1")
+			return None
+		}
+		n = -1
+		if v >= 0 && v <= int64(^uint(0)>>1) {
+			n = int(v)
+		}
+	}
+
+	entries := rs.Slowlog(n)
+	c.WriteArray(len(entries))
+	for _, e := range entries {
+		c.WriteArray(6)
+		c.WriteUint64(e.ID)
+		c.WriteInt64(e.Time.Unix())
+		c.WriteInt64(int64(e.Duration / time.Microsecond))
+		c.WriteArray(len(e.Args))
+		for _, arg := range e.Args {
+			c.WriteBulkString(arg)
+		}
+		c.WriteBulkString(e.Addr)
+		c.WriteBulkString(e.Name)
+	}
+	return None
+}
+
+func (rs *RedHub) slowlogLen(c Conn, cmd resp.Command) Action {
+	rs.slowlog.mu.Lock()
+	n := rs.slowlog.count
+	rs.slowlog.mu.Unlock()
+	c.WriteInt(n)
+	return None
+}
+
+func (rs *RedHub) slowlogReset(c Conn, cmd resp.Command) Action {
+	rs.ResetSlowlog()
+	c.WriteString("OK")
+	return None
+}
+
+func (rs *RedHub) slowlogHelp(c Conn, cmd resp.Command) Action {
+	lines := []string{
+		"SLOWLOG <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+		"GET [<count>]",
+		"    Return top <count> entries from the slowlog (default: 10, -1 mean all).",
+		"    Entries are made of:",
+		"    id, timestamp, time in microseconds, arguments array, client IP and port,",
+		"    client name",
+		"LEN",
+		"    Return the length of the slowlog.",
+		"RESET",
+		"    Reset the slowlog.",
+		"HELP",
+		"    Print this help.",
+	}
+	c.WriteArray(len(lines))
+	for _, line := range lines {
+		c.WriteString(line)
+	}
+	return None
+}
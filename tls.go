@@ -0,0 +1,205 @@
+package redhub
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// TLSOptions configures the TLS listener of a server. TLS clients are
+// served on their own address, next to the plaintext address the server
+// is started with, by goroutines of their own rather than by the gnet event
+// loops, and get the same Conn and handler API.
+type TLSOptions struct {
+	// Addr is the address of the TLS listener, for example
+	// "tcp://0.0.0.0:6380".
+	Addr string
+
+	// CertFile and KeyFile hold the PEM encoded certificate chain and
+	// private key of the server.
+	CertFile string
+	KeyFile  string
+
+	// CAFile holds the PEM encoded certificates of the CAs that sign client
+	// certificates. When set, clients must present a certificate signed by
+	// one of them (mutual TLS), unless ClientAuth says otherwise.
+	CAFile string
+
+	// ClientAuth overrides the client certificate policy, which defaults to
+	// tls.RequireAndVerifyClientCert when CAFile is set and to
+	// tls.NoClientCert otherwise.
+	ClientAuth tls.ClientAuthType
+
+	// MinVersion is the minimum TLS version accepted. The default is TLS
+	// 1.2.
+	MinVersion uint16
+
+	// HandshakeTimeout bounds the TLS handshake of new connections. The
+	// default is 10 seconds.
+	HandshakeTimeout time.Duration
+
+	// ReloadInterval, when positive, reloads the certificate files at that
+	// interval, so renewed certificates are used by new connections.
+	ReloadInterval time.Duration
+
+	// ReloadOnSIGHUP reloads the certificate files when the process
+	// receives SIGHUP.
+	ReloadOnSIGHUP bool
+
+	// OnReloadError is called when reloading the certificate files fails.
+	// The previous certificates stay in use. When nil, the error is
+	// reported through the standard log package.
+	OnReloadError func(err error)
+}
+
+// ErrNoTLS is returned by RedHub.ReloadCertificates when the server has no
+// TLS listener.
+var ErrNoTLS = errors.New("redhub: TLS is not configured")
+
+// certLoader loads the certificates of the TLS listener, and loads them
+// again on request. Handshakes use the certificates loaded last.
+type certLoader struct {
+	opts    *TLSOptions
+	current atomic.Value // *tls.Config
+}
+
+func newCertLoader(opts *TLSOptions) (*certLoader, error) {
+	l := &certLoader{opts: opts}
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// load reads the certificate files.
+func (l *certLoader) load() error {
+	cert, err := tls.LoadX509KeyPair(l.opts.CertFile, l.opts.KeyFile)
+	if err != nil {
+		return err
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   l.opts.MinVersion,
+		ClientAuth:   l.opts.ClientAuth,
+	}
+	if cfg.MinVersion == 0 {
+		cfg.MinVersion = tls.VersionTLS12
+	}
+	if l.opts.CAFile != "" {
+		pem, err := os.ReadFile(l.opts.CAFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("redhub: no certificates found in " + l.opts.CAFile)
+		}
+		cfg.ClientCAs = pool
+		if cfg.ClientAuth == tls.NoClientCert {
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	l.current.Store(cfg)
+	return nil
+}
+
+// config returns the configuration of the listener, which hands each
+// handshake the certificates loaded last.
+func (l *certLoader) config() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return l.current.Load().(*tls.Config), nil
+		},
+	}
+}
+
+// watch reloads the certificates on the reload timer and on SIGHUP, as
+// configured, until done is closed.
+func (l *certLoader) watch(done <-chan struct{}) {
+	var tick <-chan time.Time
+	if l.opts.ReloadInterval > 0 {
+		ticker := time.NewTicker(l.opts.ReloadInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	var hup chan os.Signal
+	if l.opts.ReloadOnSIGHUP {
+		hup = make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+	}
+	if tick == nil && hup == nil {
+		return
+	}
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-tick:
+		case <-hup:
+		}
+		if err := l.load(); err != nil {
+			if l.opts.OnReloadError != nil {
+				l.opts.OnReloadError(err)
+			} else {
+				log.Printf("redhub: reloading TLS certificates: %v", err)
+			}
+		}
+	}
+}
+
+// ReloadCertificates reads the certificate files of the TLS listener again.
+// New connections use the new certificates; established ones are not
+// affected. On error the previous certificates stay in use.
+func (rs *RedHub) ReloadCertificates() error {
+	rs.connSync.RLock()
+	certs := rs.certs
+	rs.connSync.RUnlock()
+	if certs == nil {
+		return ErrNoTLS
+	}
+	return certs.load()
+}
+
+// listenTLS starts the TLS listener, when configured.
+func (rs *RedHub) listenTLS() error {
+	opts := rs.options.TLS
+	if opts == nil {
+		return nil
+	}
+	certs, err := newCertLoader(opts)
+	if err != nil {
+		return err
+	}
+	la, err := parseAddr(opts.Addr)
+	if err != nil {
+		return err
+	}
+	ln, err := la.listen()
+	if err != nil {
+		return err
+	}
+
+	timeout := opts.HandshakeTimeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	rs.connSync.Lock()
+	rs.certs = certs
+	rs.tlsAddr = ln.Addr()
+	rs.listeners = append(rs.listeners, ln)
+	done := rs.done
+	rs.connSync.Unlock()
+
+	rs.netConns.Add(1)
+	go rs.serveListener(tls.NewListener(ln, certs.config()), la.name, timeout)
+	go certs.watch(done)
+	return nil
+}
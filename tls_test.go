@@ -0,0 +1,352 @@
+package redhub
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IceFireDB/redhub/pkg/resp"
+)
+
+// testCA is a certificate authority that issues certificates for the
+// tests.
+type testCA struct {
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	pool   *x509.CertPool
+	serial int64
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "redhub test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &testCA{cert: cert, key: key, pool: x509.NewCertPool(), serial: 1}
+	ca.pool.AddCert(cert)
+	return ca
+}
+
+// issue returns a PEM encoded certificate for subject and its private key,
+// for a server on the loopback address or for a client.
+func (ca *testCA) issue(t *testing.T, subject pkix.Name, server bool) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.serial++
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if server {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		tmpl.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1)}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// writeServerCert issues a server certificate named cn and writes it and
+// its key to opts.CertFile and opts.KeyFile.
+func (ca *testCA) writeServerCert(t *testing.T, opts *TLSOptions, cn string) {
+	t.Helper()
+	certPEM, keyPEM := ca.issue(t, pkix.Name{CommonName: cn}, true)
+	if err := os.WriteFile(opts.CertFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(opts.KeyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// clientCert issues a client certificate for subject.
+func (ca *testCA) clientCert(t *testing.T, subject pkix.Name) tls.Certificate {
+	t.Helper()
+	cert, err := tls.X509KeyPair(ca.issue(t, subject, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// tlsOptions returns options for a TLS listener on a free loopback port,
+// with a certificate named cn.
+func (ca *testCA) tlsOptions(t *testing.T, cn string) *TLSOptions {
+	dir := t.TempDir()
+	opts := &TLSOptions{
+		Addr:     "tcp://127.0.0.1:0",
+		CertFile: filepath.Join(dir, "server.crt"),
+		KeyFile:  filepath.Join(dir, "server.key"),
+	}
+	ca.writeServerCert(t, opts, cn)
+	return opts
+}
+
+// startTLSServer starts a server whose handler replies with whether the
+// connection uses TLS and the subject of the client certificate.
+func startTLSServer(t *testing.T, opts *TLSOptions) *Server {
+	t.Helper()
+	rh := NewRedHub(
+		func(c Conn) Action { return None },
+		func(c Conn, err error) Action { return None },
+		func(c Conn, cmd resp.Command) Action {
+			c.WriteString(fmt.Sprintf("tls=%v subject=%s", c.TLS() != nil, c.ClientSubject()))
+			return None
+		},
+		time.Second, time.Minute,
+	)
+	srv := NewServer("tcp://127.0.0.1:0", Options{TLS: opts}, rh)
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = srv.Stop() })
+	return srv
+}
+
+// ping sends a command on conn and returns the simple string reply.
+func ping(conn net.Conn) (string, error) {
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("*1\r\n$4\r\nPING\r\n")); err != nil {
+		return "", err
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(line, "+") {
+		return "", fmt.Errorf("unexpected reply %q", line)
+	}
+	return strings.TrimSuffix(line[1:], "\r\n"), nil
+}
+
+// dialTLS connects to the TLS listener of srv, presenting certs.
+func dialTLS(srv *Server, ca *testCA, certs ...tls.Certificate) (*tls.Conn, error) {
+	return tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", srv.TLSAddr().String(), &tls.Config{
+		RootCAs:      ca.pool,
+		Certificates: certs,
+	})
+}
+
+func TestTLSNextToPlaintext(t *testing.T) {
+	ca := newTestCA(t)
+	srv := startTLSServer(t, ca.tlsOptions(t, "server"))
+	if srv.TLSAddr() == nil || srv.TLSAddr().String() == srv.Addr().String() {
+		t.Fatalf("TLS address is %v, plaintext address %v", srv.TLSAddr(), srv.Addr())
+	}
+
+	plain, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	secure, err := dialTLS(srv, ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer secure.Close()
+
+	// Both clients are served at the same time.
+	for i := 0; i < 2; i++ {
+		if got, err := ping(plain); err != nil || got != "tls=false subject=" {
+			t.Errorf("plaintext client got %q, %v", got, err)
+		}
+		if got, err := ping(secure); err != nil || got != "tls=true subject=" {
+			t.Errorf("TLS client got %q, %v", got, err)
+		}
+	}
+
+	// The TLS listener doesn't speak plaintext.
+	conn, err := net.Dial("tcp", srv.TLSAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got, err := ping(conn); err == nil {
+		t.Errorf("plaintext client of the TLS listener got %q", got)
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	opts := ca.tlsOptions(t, "server")
+	opts.CAFile = filepath.Join(filepath.Dir(opts.CertFile), "ca.crt")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+	if err := os.WriteFile(opts.CAFile, caPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	srv := startTLSServer(t, opts)
+
+	// With TLS 1.3 the client finishes its handshake before the server
+	// checks its certificate, so the refusal may only surface on the
+	// first read.
+	if conn, err := dialTLS(srv, ca); err == nil {
+		got, err := ping(conn)
+		conn.Close()
+		if err == nil {
+			t.Errorf("client without a certificate got %q", got)
+		}
+	}
+
+	other := newTestCA(t)
+	if conn, err := dialTLS(srv, ca, other.clientCert(t, pkix.Name{CommonName: "mallory"})); err == nil {
+		got, err := ping(conn)
+		conn.Close()
+		if err == nil {
+			t.Errorf("client with a certificate of another CA got %q", got)
+		}
+	}
+
+	cert := ca.clientCert(t, pkix.Name{CommonName: "alice", Organization: []string{"Example Corp"}})
+	conn, err := dialTLS(srv, ca, cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got, err := ping(conn); err != nil || got != "tls=true subject=CN=alice,O=Example Corp" {
+		t.Errorf("client with a certificate got %q, %v", got, err)
+	}
+}
+
+// serverName returns the common name of the certificate srv presents.
+func serverName(t *testing.T, srv *Server, ca *testCA) string {
+	t.Helper()
+	conn, err := dialTLS(srv, ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestReloadCertificates(t *testing.T) {
+	ca := newTestCA(t)
+	opts := ca.tlsOptions(t, "first")
+	srv := startTLSServer(t, opts)
+	if got := serverName(t, srv, ca); got != "first" {
+		t.Fatalf("server presents %q, want first", got)
+	}
+
+	ca.writeServerCert(t, opts, "second")
+	if got := serverName(t, srv, ca); got != "first" {
+		t.Fatalf("server presents %q before the reload, want first", got)
+	}
+	if err := srv.hub.ReloadCertificates(); err != nil {
+		t.Fatal(err)
+	}
+	if got := serverName(t, srv, ca); got != "second" {
+		t.Fatalf("server presents %q after the reload, want second", got)
+	}
+
+	// A failed reload keeps the previous certificate.
+	if err := os.WriteFile(opts.KeyFile, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.hub.ReloadCertificates(); err == nil {
+		t.Fatal("reloading a broken key succeeded")
+	}
+	if got := serverName(t, srv, ca); got != "second" {
+		t.Fatalf("server presents %q after a failed reload, want second", got)
+	}
+}
+
+func TestCertLoaderWatch(t *testing.T) {
+	ca := newTestCA(t)
+	opts := ca.tlsOptions(t, "first")
+	opts.ReloadInterval = 10 * time.Millisecond
+	errs := make(chan error, 1)
+	opts.OnReloadError = func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	}
+	l, err := newCertLoader(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go l.watch(done)
+
+	name := func() string {
+		cert := l.current.Load().(*tls.Config).Certificates[0]
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.Subject.CommonName
+	}
+	ca.writeServerCert(t, opts, "second")
+	for deadline := time.Now().Add(5 * time.Second); name() != "second"; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the rotated certificate was not loaded")
+		}
+	}
+
+	if err := os.Remove(opts.CertFile); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-errs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnReloadError was not called for a missing certificate")
+	}
+	if got := name(); got != "second" {
+		t.Errorf("loader uses %q after a failed reload, want second", got)
+	}
+}
+
+func TestReloadCertificatesWithoutTLS(t *testing.T) {
+	rh := NewRedHub(nil, nil, nil, 0, 0)
+	if err := rh.ReloadCertificates(); err != ErrNoTLS {
+		t.Errorf("got %v, want ErrNoTLS", err)
+	}
+}
@@ -0,0 +1,94 @@
+package redhub
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/IceFireDB/redhub/pkg/resp"
+)
+
+// Tracer opens a span for each command served, for tracing systems such as
+// OpenTelemetry. Tracers are installed with RedHub.Trace, or by RedHub.Plug
+// for plugins that implement Tracer.
+type Tracer interface {
+	// StartCommand is called before cmd is served, on the connection's
+	// processing goroutine, and returns the span of the command. It may
+	// store a context carrying the span with c.SetContext, so handlers
+	// nest their own spans under it. Unless the handler sets a context of
+	// its own, the previous context is restored once the command is
+	// served.
+	StartCommand(c Conn, cmd resp.Command) CommandSpan
+}
+
+// CommandSpan is the span of a command, opened by a Tracer.
+type CommandSpan interface {
+	// End is called once the command has been served, with its reply. For
+	// a command parked with Conn.Defer, that is once the reply has been
+	// written.
+	End(reply ReplyInfo)
+}
+
+// ReplyInfo describes the reply of a command.
+type ReplyInfo struct {
+	// Type is the RESP type of the reply, such as resp.Bulk or resp.Error,
+	// or 0 when no reply was sent, for example after CLIENT REPLY OFF.
+	Type resp.Type
+	// Bytes is the size of the encoded reply.
+	Bytes int
+	// Err is the message of an error reply, such as "WRONGTYPE Operation
+	// against a key holding the wrong kind of value".
+	Err string
+}
+
+// Trace installs tracers. They must be installed before the server starts.
+func (rs *RedHub) Trace(tracers ...Tracer) {
+	rs.tracers = append(rs.tracers, tracers...)
+}
+
+// tracers returns the tracers of the connection's hub.
+func (c *conn) tracers() []Tracer {
+	if c.hub == nil {
+		return nil
+	}
+	return c.hub.tracers
+}
+
+// startSpans opens the spans of cmd. It returns the context to restore once
+// the command is served.
+func (c *conn) startSpans(cmd resp.Command) context.Context {
+	prev := c.ctx
+	c.spans = c.spans[:0]
+	for _, t := range c.tracers() {
+		c.spans = append(c.spans, t.StartCommand(c, cmd))
+	}
+	c.spanCtx = c.ctx
+	return prev
+}
+
+// endSpans ends the spans of the command served, with its reply written to
+// the writer from mark on, and restores prev unless the handler set a
+// context of its own.
+func (c *conn) endSpans(prev context.Context, mark int) {
+	var info ReplyInfo
+	if out := c.wr.OrigBuffer(); mark < len(out) {
+		out = out[mark:]
+		info.Type = resp.Type(out[0])
+		info.Bytes = len(out)
+		if info.Type == resp.Error {
+			if i := bytes.IndexByte(out, '\r'); i > 0 {
+				info.Err = string(out[1:i])
+			}
+		}
+	}
+	for i := len(c.spans) - 1; i >= 0; i-- {
+		if c.spans[i] != nil {
+			c.spans[i].End(info)
+		}
+		c.spans[i] = nil
+	}
+	c.spans = c.spans[:0]
+	if c.ctx == c.spanCtx {
+		c.ctx = prev
+	}
+	c.spanCtx = nil
+}
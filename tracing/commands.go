@@ -0,0 +1,122 @@
+package tracing
+
+import (
+	"strings"
+
+	"github.com/IceFireDB/redhub"
+	"github.com/IceFireDB/redhub/pkg/resp"
+)
+
+// Commands returns the spec of TRACEPARENT, so it can be registered on a
+// redhub.Mux and reported by COMMAND. The tracer serves it itself and never
+// passes it on to the Mux.
+//
+// TRACEPARENT traceparent [tracestate] sets the W3C trace context the spans
+// of the connection's later commands nest under, until it is set again.
+// TRACEPARENT without arguments clears it. Clients that share connections
+// between requests should set it before each traced pipeline and clear it
+// after.
+func (t *Tracer) Commands() []redhub.CommandSpec {
+	return []redhub.CommandSpec{
+		{Name: "traceparent", Arity: -1, Handler: t.traceparent,
+			Flags:      redhub.FlagFast | redhub.FlagNoScript | redhub.FlagLoading | redhub.FlagStale,
+			Categories: []string{"connection"}, Group: "connection",
+			Summary:    "Sets the trace context of the spans of later commands.",
+			Complexity: "O(1)"},
+	}
+}
+
+// Wrap serves TRACEPARENT, and CLIENT SETINFO TRACEPARENT and TRACESTATE,
+// which set the same trace context, and passes every other command on to
+// next.
+func (t *Tracer) Wrap(next redhub.HandlerFunc) redhub.HandlerFunc {
+	return func(c redhub.Conn, cmd resp.Command) redhub.Action {
+		var buf [16]byte
+		switch string(resp.AppendLower(buf[:0], cmd.Args[0])) {
+		case "traceparent":
+			return t.traceparent(c, cmd)
+		case "client":
+			switch setInfoField(cmd) {
+			case "traceparent":
+				return t.setParent(c, string(cmd.Args[3]), "", false)
+			case "tracestate":
+				return t.setState(c, string(cmd.Args[3]))
+			}
+		}
+		return next(c, cmd)
+	}
+}
+
+// setInfoField returns the lower-case field of a CLIENT SETINFO command that
+// sets trace context, or "".
+func setInfoField(cmd resp.Command) string {
+	if len(cmd.Args) != 4 || !strings.EqualFold(string(cmd.Args[1]), "setinfo") {
+		return ""
+	}
+	switch field := strings.ToLower(string(cmd.Args[2])); field {
+	case "traceparent", "tracestate":
+		return field
+	}
+	return ""
+}
+
+// Closed drops the trace context of a closed connection.
+func (t *Tracer) Closed(c redhub.Conn) {
+	t.conns.Delete(c)
+}
+
+func (t *Tracer) traceparent(c redhub.Conn, cmd resp.Command) redhub.Action {
+	switch len(cmd.Args) {
+	case 1:
+		t.conns.Delete(c)
+		c.WriteString("OK")
+		return redhub.None
+	case 2:
+		return t.setParent(c, string(cmd.Args[1]), "", true)
+	case 3:
+		return t.setParent(c, string(cmd.Args[1]), string(cmd.Args[2]), true)
+	}
+	c.WriteError("ERR wrong number of arguments for 'traceparent' command")
+	return redhub.None
+}
+
+// setParent sets the trace context of the connection. An empty traceparent
+// clears it. replaceState is false for CLIENT SETINFO, which sets
+// TRACESTATE separately, so the state set before is kept.
+func (t *Tracer) setParent(c redhub.Conn, traceparent, tracestate string, replaceState bool) redhub.Action {
+	if traceparent == "" {
+		t.conns.Delete(c)
+		c.WriteString("OK")
+		return redhub.None
+	}
+	sc, err := ParseTraceparent(traceparent)
+	if err != nil {
+		c.WriteError("ERR " + err.Error())
+		return redhub.None
+	}
+	s := t.session(c)
+	if replaceState {
+		sc.TraceState = tracestate
+	} else {
+		sc.TraceState = s.parent.TraceState
+	}
+	s.parent = sc
+	c.WriteString("OK")
+	return redhub.None
+}
+
+func (t *Tracer) setState(c redhub.Conn, tracestate string) redhub.Action {
+	t.session(c).parent.TraceState = tracestate
+	c.WriteString("OK")
+	return redhub.None
+}
+
+// session returns the trace context of the connection, creating it if
+// needed.
+func (t *Tracer) session(c redhub.Conn) *session {
+	if s, ok := t.conns.Load(c); ok {
+		return s.(*session)
+	}
+	s, _ := t.conns.LoadOrStore(c, &session{})
+	return s.(*session)
+}
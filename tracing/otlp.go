@@ -0,0 +1,343 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// OTLPOptions configures an OTLPExporter.
+type OTLPOptions struct {
+	// Endpoint is the URL spans are posted to. The default is
+	// "http://localhost:4318/v1/traces".
+	Endpoint string
+
+	// Headers are added to each request, for example for authentication.
+	Headers map[string]string
+
+	// ServiceName is the service.name resource attribute. The default is
+	// "redhub".
+	ServiceName string
+
+	// Client sends the requests. The default is a client with a 10 second
+	// timeout.
+	Client *http.Client
+
+	// BatchSize is the largest number of spans sent in a request. The
+	// default is 512.
+	BatchSize int
+
+	// BatchTimeout is the longest a span waits before it is sent. The
+	// default is 5 seconds.
+	BatchTimeout time.Duration
+
+	// MaxQueueSize is the largest number of spans waiting to be sent.
+	// Spans that end while the queue is full are dropped. The default is
+	// 2048.
+	MaxQueueSize int
+
+	// OnError is called when sending spans fails. When nil, the error is
+	// reported through the standard log package.
+	OnError func(err error)
+}
+
+// OTLPExporter sends spans in batches to an OpenTelemetry collector, over
+// OTLP/HTTP with the JSON encoding.
+type OTLPExporter struct {
+	opts    OTLPOptions
+	dropped uint64
+
+	mu    sync.Mutex
+	queue []*Span
+
+	kick    chan struct{}
+	flush   chan chan error
+	stop    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+}
+
+// NewOTLPExporter returns an exporter configured by opts, and starts its
+// goroutine. Call Shutdown to send the remaining spans and stop it.
+func NewOTLPExporter(opts OTLPOptions) *OTLPExporter {
+	if opts.Endpoint == "" {
+		opts.Endpoint = "http://localhost:4318/v1/traces"
+	}
+	if opts.ServiceName == "" {
+		opts.ServiceName = "redhub"
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 512
+	}
+	if opts.BatchTimeout <= 0 {
+		opts.BatchTimeout = 5 * time.Second
+	}
+	if opts.MaxQueueSize <= 0 {
+		opts.MaxQueueSize = 2048
+	}
+	e := &OTLPExporter{
+		opts:    opts,
+		kick:    make(chan struct{}, 1),
+		flush:   make(chan chan error),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+// ExportSpans queues spans to be sent. It does not block.
+func (e *OTLPExporter) ExportSpans(ctx context.Context, spans []*Span) error {
+	e.mu.Lock()
+	n := len(spans)
+	if room := e.opts.MaxQueueSize - len(e.queue); n > room {
+		atomic.AddUint64(&e.dropped, uint64(n-room))
+		n = room
+	}
+	e.queue = append(e.queue, spans[:n]...)
+	full := len(e.queue) >= e.opts.BatchSize
+	e.mu.Unlock()
+	if full {
+		select {
+		case e.kick <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Dropped returns the number of spans dropped because the queue was full.
+func (e *OTLPExporter) Dropped() uint64 {
+	return atomic.LoadUint64(&e.dropped)
+}
+
+// Flush sends the queued spans.
+func (e *OTLPExporter) Flush(ctx context.Context) error {
+	done := make(chan error, 1)
+	select {
+	case e.flush <- done:
+	case <-e.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shutdown sends the queued spans and stops the exporter. Spans exported
+// later are dropped.
+func (e *OTLPExporter) Shutdown(ctx context.Context) error {
+	e.once.Do(func() { close(e.stop) })
+	select {
+	case <-e.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (e *OTLPExporter) run() {
+	defer close(e.stopped)
+	ticker := time.NewTicker(e.opts.BatchTimeout)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			e.report(e.sendAll())
+		case <-e.kick:
+			e.report(e.sendAll())
+		case done := <-e.flush:
+			done <- e.sendAll()
+		case <-e.stop:
+			e.mu.Lock()
+			e.opts.MaxQueueSize = 0
+			e.mu.Unlock()
+			e.report(e.sendAll())
+			return
+		}
+	}
+}
+
+func (e *OTLPExporter) report(err error) {
+	if err == nil {
+		return
+	}
+	if e.opts.OnError != nil {
+		e.opts.OnError(err)
+	} else {
+		log.Printf("redhub: sending spans: %v", err)
+	}
+}
+
+// sendAll sends the queued spans in batches, and returns the first error.
+func (e *OTLPExporter) sendAll() error {
+	var first error
+	for {
+		e.mu.Lock()
+		n := len(e.queue)
+		if n > e.opts.BatchSize {
+			n = e.opts.BatchSize
+		}
+		batch := append([]*Span(nil), e.queue[:n]...)
+		e.queue = append(e.queue[:0], e.queue[n:]...)
+		e.mu.Unlock()
+		if len(batch) == 0 {
+			return first
+		}
+		if err := e.send(batch); err != nil && first == nil {
+			first = err
+		}
+	}
+}
+
+func (e *OTLPExporter) send(spans []*Span) error {
+	body, err := json.Marshal(e.encode(spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, e.opts.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.opts.Headers {
+		req.Header.Set(k, v)
+	}
+	res, err := e.opts.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s: %s", e.opts.Endpoint, res.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// The types below are the JSON encoding of an OTLP ExportTraceServiceRequest.
+// IDs are hex encoded and 64-bit integers are strings, as the OTLP/JSON
+// mapping requires.
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	TraceState        string         `json:"traceState,omitempty"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+func (e *OTLPExporter) encode(spans []*Span) otlpRequest {
+	out := make([]otlpSpan, len(spans))
+	for i, s := range spans {
+		o := otlpSpan{
+			TraceID:           s.SpanContext.TraceID.String(),
+			SpanID:            s.SpanContext.SpanID.String(),
+			TraceState:        s.SpanContext.TraceState,
+			Name:              s.Name,
+			Kind:              int(s.Kind),
+			StartTimeUnixNano: strconv.FormatInt(s.StartTime.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.EndTime.UnixNano(), 10),
+			Attributes:        encodeAttributes(s.Attributes),
+			Status:            otlpStatus{Code: int(s.Status), Message: s.StatusMessage},
+		}
+		if s.Parent.SpanID.IsValid() {
+			o.ParentSpanID = s.Parent.SpanID.String()
+		}
+		out[i] = o
+	}
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: encodeAttributes([]Attribute{
+			String("service.name", e.opts.ServiceName),
+		})},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "github.com/IceFireDB/redhub/tracing"},
+			Spans: out,
+		}},
+	}}}
+}
+
+func encodeAttributes(attrs []Attribute) []otlpKeyValue {
+	out := make([]otlpKeyValue, 0, len(attrs))
+	for _, a := range attrs {
+		var v otlpValue
+		switch x := a.Value.(type) {
+		case string:
+			v.StringValue = &x
+		case int64:
+			s := strconv.FormatInt(x, 10)
+			v.IntValue = &s
+		case float64:
+			v.DoubleValue = &x
+		case bool:
+			v.BoolValue = &x
+		default:
+			s := fmt.Sprint(x)
+			v.StringValue = &s
+		}
+		out = append(out, otlpKeyValue{Key: a.Key, Value: v})
+	}
+	return out
+}
@@ -0,0 +1,200 @@
+package tracing
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// TraceID and SpanID identify traces and spans, as in W3C Trace Context.
+type (
+	TraceID [16]byte
+	SpanID  [8]byte
+)
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+func (id SpanID) String() string  { return hex.EncodeToString(id[:]) }
+
+// IsValid reports whether the ID is not all zeroes.
+func (id TraceID) IsValid() bool { return id != TraceID{} }
+
+// IsValid reports whether the ID is not all zeroes.
+func (id SpanID) IsValid() bool { return id != SpanID{} }
+
+// SpanContext identifies a span, and carries what is propagated with it.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	// Sampled reports whether the trace is recorded.
+	Sampled bool
+	// TraceState is the vendor-specific tracestate header, passed on as is.
+	TraceState string
+	// Remote reports whether the span context was propagated by a client.
+	Remote bool
+}
+
+// IsValid reports whether the span context has a trace and a span ID.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// Traceparent formats the span context as a W3C traceparent header.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + flags
+}
+
+var errTraceparent = errors.New("invalid traceparent")
+
+// ParseTraceparent parses a W3C traceparent header, such as
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01".
+func ParseTraceparent(s string) (SpanContext, error) {
+	var sc SpanContext
+	// Later versions may append fields, which are ignored.
+	if len(s) < 55 || s[2] != '-' || s[35] != '-' || s[52] != '-' ||
+		(len(s) > 55 && (s[:2] == "00" || s[55] != '-')) {
+		return sc, errTraceparent
+	}
+	var version, flags [1]byte
+	if _, err := hex.Decode(version[:], []byte(s[:2])); err != nil || version[0] == 0xff {
+		return sc, errTraceparent
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(s[3:35])); err != nil {
+		return sc, errTraceparent
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(s[36:52])); err != nil {
+		return sc, errTraceparent
+	}
+	if _, err := hex.Decode(flags[:], []byte(s[53:55])); err != nil {
+		return sc, errTraceparent
+	}
+	if strings.ToLower(s[:55]) != s[:55] || !sc.IsValid() {
+		return sc, errTraceparent
+	}
+	sc.Sampled = flags[0]&1 == 1
+	sc.Remote = true
+	return sc, nil
+}
+
+// SpanKind is the kind of a span, as in OpenTelemetry.
+type SpanKind int
+
+const (
+	// KindInternal is the kind of spans handlers open with Tracer.Start.
+	KindInternal SpanKind = 1
+	// KindServer is the kind of the spans of commands.
+	KindServer SpanKind = 2
+)
+
+// StatusCode is the status of a span, as in OpenTelemetry.
+type StatusCode int
+
+const (
+	StatusUnset StatusCode = 0
+	StatusOK    StatusCode = 1
+	StatusError StatusCode = 2
+)
+
+// Attribute is a key and its value, a string, int64, float64 or bool.
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// String returns a string attribute.
+func String(key, value string) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Int returns an integer attribute.
+func Int(key string, value int) Attribute {
+	return Attribute{Key: key, Value: int64(value)}
+}
+
+// Bool returns a boolean attribute.
+func Bool(key string, value bool) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Span is a timed operation of a trace. A span is not safe for concurrent
+// use, but End may be called more than once. Its fields must not change once
+// it has ended.
+type Span struct {
+	Name        string
+	Kind        SpanKind
+	SpanContext SpanContext
+	// Parent is the span context of the parent span, invalid for the root
+	// span of a trace.
+	Parent        SpanContext
+	StartTime     time.Time
+	EndTime       time.Time
+	Attributes    []Attribute
+	Status        StatusCode
+	StatusMessage string
+
+	tracer *Tracer
+	ended  int32
+}
+
+// SetAttributes adds attributes to the span.
+func (s *Span) SetAttributes(attrs ...Attribute) {
+	s.Attributes = append(s.Attributes, attrs...)
+}
+
+// SetError marks the span as failed with the message msg.
+func (s *Span) SetError(msg string) {
+	s.Status = StatusError
+	s.StatusMessage = msg
+}
+
+// End ends the span and hands it to the exporter, when sampled.
+func (s *Span) End() {
+	if !atomic.CompareAndSwapInt32(&s.ended, 0, 1) {
+		return
+	}
+	s.EndTime = time.Now()
+	if s.SpanContext.Sampled && s.tracer != nil {
+		s.tracer.export(s)
+	}
+}
+
+type spanKey struct{}
+
+// ContextWithSpan returns a copy of ctx carrying span, as the parent of the
+// spans started from it.
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// SpanFromContext returns the span carried by ctx, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	if ctx == nil {
+		return nil
+	}
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// ContextWithSpanContext returns a copy of ctx carrying sc as the parent
+// of the spans started from it, for spans opened by another tracing
+// library. SpanFromContext returns a span that has already ended and only
+// carries sc.
+func ContextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return ContextWithSpan(ctx, &Span{SpanContext: sc, ended: 1})
+}
+
+// SpanContextFromContext returns the span context of the span carried by
+// ctx.
+func SpanContextFromContext(ctx context.Context) (SpanContext, bool) {
+	span := SpanFromContext(ctx)
+	if span == nil || !span.SpanContext.IsValid() {
+		return SpanContext{}, false
+	}
+	return span.SpanContext, true
+}
@@ -0,0 +1,240 @@
+// Package tracing opens a span for each command a redhub server serves, in
+// the model of OpenTelemetry, and exports them over OTLP:
+//
+//	exp := tracing.NewOTLPExporter(tracing.OTLPOptions{Endpoint: "http://collector:4318/v1/traces"})
+//	t := tracing.New(tracing.Options{Exporter: exp, Mux: mux})
+//	rh.Plug(t)
+//	mux.Handle(t.Commands()...)
+//
+// Command spans nest under the span stored with Conn.SetContext, or under
+// the trace context a client propagates with the TRACEPARENT command or
+// CLIENT SETINFO TRACEPARENT. Handlers nest their own spans under the
+// command span with Tracer.Start.
+package tracing
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/binary"
+	"log"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IceFireDB/redhub"
+	"github.com/IceFireDB/redhub/pkg/resp"
+)
+
+// Exporter receives the spans that ended, for example to send them to a
+// collector.
+type Exporter interface {
+	ExportSpans(ctx context.Context, spans []*Span) error
+}
+
+// Options configures a Tracer.
+type Options struct {
+	// Exporter receives the spans that ended. It is required.
+	Exporter Exporter
+
+	// Mux, when set, is used to count the keys of commands, and to name
+	// the spans of commands it doesn't know "UNKNOWN".
+	Mux *redhub.Mux
+
+	// ParentFromContext returns the span context a connection's context
+	// carries, for contexts set by another tracing library. By default
+	// the span context stored with ContextWithSpan or
+	// ContextWithSpanContext is used.
+	ParentFromContext func(ctx context.Context) (SpanContext, bool)
+
+	// OnError is called when the exporter fails. When nil, the error is
+	// reported through the standard log package.
+	OnError func(err error)
+}
+
+// Tracer opens the spans of commands. It implements redhub.Tracer and
+// redhub.Plugin; plugging it also serves the commands that propagate trace
+// context.
+type Tracer struct {
+	opts  Options
+	conns sync.Map // redhub.Conn -> *session
+
+	muRand sync.Mutex
+	rand   *rand.Rand
+}
+
+// session is the trace context a client propagated on its connection.
+type session struct {
+	parent SpanContext
+}
+
+// New returns a tracer configured by opts.
+func New(opts Options) *Tracer {
+	var seed [8]byte
+	_, _ = crand.Read(seed[:])
+	return &Tracer{
+		opts: opts,
+		rand: rand.New(rand.NewSource(int64(binary.LittleEndian.Uint64(seed[:])))),
+	}
+}
+
+// Start opens a span named name, child of the span ctx carries, and
+// returns a context carrying the new span. The span must be ended with
+// End.
+func (t *Tracer) Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, *Span) {
+	parent, _ := t.parentFrom(ctx)
+	span := t.newSpan(name, KindInternal, parent)
+	span.Attributes = append(span.Attributes, attrs...)
+	return ContextWithSpan(ctx, span), span
+}
+
+func (t *Tracer) parentFrom(ctx context.Context) (SpanContext, bool) {
+	if t.opts.ParentFromContext != nil {
+		if sc, ok := t.opts.ParentFromContext(ctx); ok && sc.IsValid() {
+			return sc, true
+		}
+	}
+	return SpanContextFromContext(ctx)
+}
+
+// newSpan opens a span, in the trace of parent when it is valid. Spans of
+// traces that are not sampled are not exported.
+func (t *Tracer) newSpan(name string, kind SpanKind, parent SpanContext) *Span {
+	span := &Span{
+		Name:      name,
+		Kind:      kind,
+		Parent:    parent,
+		StartTime: time.Now(),
+		tracer:    t,
+	}
+	t.muRand.Lock()
+	if parent.IsValid() {
+		span.SpanContext.TraceID = parent.TraceID
+		span.SpanContext.Sampled = parent.Sampled
+		span.SpanContext.TraceState = parent.TraceState
+	} else {
+		_, _ = t.rand.Read(span.SpanContext.TraceID[:])
+		span.SpanContext.Sampled = true
+	}
+	_, _ = t.rand.Read(span.SpanContext.SpanID[:])
+	t.muRand.Unlock()
+	return span
+}
+
+func (t *Tracer) export(span *Span) {
+	if err := t.opts.Exporter.ExportSpans(context.Background(), []*Span{span}); err != nil {
+		if t.opts.OnError != nil {
+			t.opts.OnError(err)
+		} else {
+			log.Printf("redhub: exporting spans: %v", err)
+		}
+	}
+}
+
+// StartCommand opens the span of a command, under the trace context the
+// client propagated, or else under the span of the connection's context,
+// and stores it in the connection's context.
+func (t *Tracer) StartCommand(c redhub.Conn, cmd resp.Command) redhub.CommandSpan {
+	ctx := c.GetContext()
+	var parent SpanContext
+	if s, ok := t.conns.Load(c); ok && s.(*session).parent.IsValid() {
+		parent = s.(*session).parent
+	} else {
+		parent, _ = t.parentFrom(ctx)
+	}
+
+	name := strings.ToUpper(string(cmd.Args[0]))
+	keys := -1
+	if t.opts.Mux != nil && setInfoField(cmd) != "" {
+		// Served by the tracer, whether or not the Mux knows CLIENT SETINFO.
+		keys = 0
+	} else if t.opts.Mux != nil {
+		if spec := t.opts.Mux.Lookup(cmd.Args); spec == nil {
+			name = "UNKNOWN"
+		} else if spec.HasKeys() {
+			keys = len(spec.Keys(cmd.Args))
+		} else {
+			keys = 0
+		}
+	}
+
+	span := t.newSpan(name, KindServer, parent)
+	if span.SpanContext.Sampled {
+		span.Attributes = append(span.Attributes,
+			String("db.system", "redis"),
+			String("db.operation", name),
+			Int("db.redis.client_id", int(c.ID())),
+			String("client.address", c.RemoteAddr()),
+			Int("db.redis.request_bytes", len(cmd.Raw)),
+		)
+		if keys >= 0 {
+			span.Attributes = append(span.Attributes, Int("db.redis.key_count", keys))
+		}
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	c.SetContext(ContextWithSpan(ctx, span))
+	return (*commandSpan)(span)
+}
+
+// commandSpan is the span of a command, ended by the server with its reply.
+type commandSpan Span
+
+func (s *commandSpan) End(reply redhub.ReplyInfo) {
+	span := (*Span)(s)
+	if span.SpanContext.Sampled {
+		span.Attributes = append(span.Attributes,
+			String("db.redis.reply_type", replyType(reply.Type)),
+			Int("db.redis.reply_bytes", reply.Bytes),
+		)
+		if reply.Err != "" {
+			prefix := reply.Err
+			if i := strings.IndexByte(prefix, ' '); i >= 0 {
+				prefix = prefix[:i]
+			}
+			span.Attributes = append(span.Attributes, String("error.type", prefix))
+			span.SetError(reply.Err)
+		}
+	}
+	span.End()
+}
+
+// replyType names the RESP type of a reply.
+func replyType(t resp.Type) string {
+	switch t {
+	case 0:
+		return "none"
+	case resp.String:
+		return "simple_string"
+	case resp.Error:
+		return "error"
+	case resp.Integer:
+		return "integer"
+	case resp.Bulk:
+		return "bulk_string"
+	case resp.Array:
+		return "array"
+	case resp.Null:
+		return "null"
+	case resp.Double:
+		return "double"
+	case resp.Boolean:
+		return "boolean"
+	case resp.BlobError:
+		return "blob_error"
+	case resp.Verbatim:
+		return "verbatim_string"
+	case resp.BigNumber:
+		return "big_number"
+	case resp.Map:
+		return "map"
+	case resp.Set:
+		return "set"
+	case resp.Attribute:
+		return "attribute"
+	case resp.Push:
+		return "push"
+	}
+	return "unknown"
+}
@@ -0,0 +1,234 @@
+package redhub
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	gnet "github.com/panjf2000/gnet/v2"
+)
+
+// transport is the network connection under a conn: a gnet.Conn served by
+// the engine's event loops, or a net.Conn served by goroutines of its own,
+// as for TLS clients.
+type transport interface {
+	RemoteAddr() net.Addr
+	LocalAddr() net.Addr
+	// write sends data without blocking. done, when not nil, is called once
+	// data is no longer used.
+	write(data []byte, done func())
+	// Close closes the connection once the data already written is sent.
+	Close() error
+	// tlsState returns the state of a TLS connection, or nil.
+	tlsState() *tls.ConnectionState
+}
+
+// gnetTransport is the transport of connections accepted by the gnet
+// engine.
+type gnetTransport struct {
+	gnet.Conn
+}
+
+func (t gnetTransport) write(data []byte, done func()) {
+	_ = t.AsyncWrite(data, func(gnet.Conn, error) error {
+		if done != nil {
+			done()
+		}
+		return nil
+	})
+}
+
+func (t gnetTransport) tlsState() *tls.ConnectionState { return nil }
+
+// outputMaxPending bounds the output a connection may fall behind by
+// before it is closed, as Redis does with clients over their output buffer
+// limit: the out-of-band data held while a pipeline runs, and the data a
+// net.Conn transport has queued.
+const outputMaxPending = 64 << 20
+
+// closeFlushTimeout bounds how long a closed net.Conn transport keeps
+// sending the data written before Close.
+const closeFlushTimeout = 5 * time.Second
+
+// netTransport is the transport of a net.Conn. Writes are queued and sent
+// by a goroutine of the transport, so a slow client never blocks the
+// goroutine that writes to it.
+type netTransport struct {
+	net.Conn
+	tls *tls.ConnectionState
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queue  []netWrite
+	queued int // bytes in queue and being sent
+	closed bool
+}
+
+type netWrite struct {
+	data []byte
+	done func()
+}
+
+func newNetTransport(nc net.Conn, state *tls.ConnectionState) *netTransport {
+	t := &netTransport{Conn: nc, tls: state}
+	t.cond = sync.NewCond(&t.mu)
+	go t.writeLoop()
+	return t
+}
+
+func (t *netTransport) write(data []byte, done func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		if done != nil {
+			done()
+		}
+		return
+	}
+	if t.queued > outputMaxPending {
+		// The client doesn't read what it is sent. Closing the net.Conn
+		// fails the write in progress and unblocks the reader, which
+		// reports the connection closed.
+		t.closed = true
+		_ = t.Conn.Close()
+		if done != nil {
+			done()
+		}
+		t.cond.Signal()
+		return
+	}
+	t.queue = append(t.queue, netWrite{data: data, done: done})
+	t.queued += len(data)
+	t.cond.Signal()
+}
+
+func (t *netTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+	_ = t.Conn.SetWriteDeadline(time.Now().Add(closeFlushTimeout))
+	t.cond.Signal()
+	return nil
+}
+
+func (t *netTransport) tlsState() *tls.ConnectionState { return t.tls }
+
+// writeLoop sends the queued writes until the transport is closed and its
+// queue is empty, then closes the connection.
+func (t *netTransport) writeLoop() {
+	var failed bool
+	for {
+		t.mu.Lock()
+		for len(t.queue) == 0 && !t.closed {
+			t.cond.Wait()
+		}
+		queue := t.queue
+		t.queue = nil
+		closed := t.closed
+		t.mu.Unlock()
+
+		for _, w := range queue {
+			if !failed {
+				if _, err := t.Conn.Write(w.data); err != nil {
+					// Unblock the reader, which reports the connection
+					// closed.
+					failed = true
+					_ = t.Conn.Close()
+				}
+			}
+			t.mu.Lock()
+			t.queued -= len(w.data)
+			t.mu.Unlock()
+			if w.done != nil {
+				w.done()
+			}
+		}
+		if closed && len(queue) == 0 {
+			_ = t.Conn.Close()
+			return
+		}
+	}
+}
+
+// serveConn serves a connection accepted on the listener named listener
+// until it is closed. TLS connections complete their handshake before the
+// connection is opened.
+func (rs *RedHub) serveConn(nc net.Conn, listener string, handshakeTimeout time.Duration) {
+	defer rs.netConns.Done()
+
+	var state *tls.ConnectionState
+	if tc, ok := nc.(*tls.Conn); ok {
+		_ = tc.SetDeadline(time.Now().Add(handshakeTimeout))
+		if err := tc.Handshake(); err != nil {
+			_ = nc.Close()
+			return
+		}
+		_ = tc.SetDeadline(time.Time{})
+		cs := tc.ConnectionState()
+		state = &cs
+	}
+
+	t := newNetTransport(nc, state)
+	c := rs.open(t, listener, nc.LocalAddr(), nc.RemoteAddr())
+	if c == nil {
+		_ = t.Close()
+		return
+	}
+
+	buf := make([]byte, netReadBufferSize)
+	for {
+		n, err := nc.Read(buf)
+		if n > 0 {
+			rs.received(c, buf[:n])
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				err = nil
+			}
+			rs.closed(c, err)
+			return
+		}
+	}
+}
+
+// netReadBufferSize is the size of the read buffer of net.Conn transports,
+// the default read buffer of gnet.
+const netReadBufferSize = 64 * 1024
+
+// serveListener accepts connections on ln, named name, until it is closed
+// or fails. Temporary errors, such as running out of file descriptors, are
+// retried with a backoff, as net/http does.
+func (rs *RedHub) serveListener(ln net.Listener, name string, handshakeTimeout time.Duration) error {
+	defer rs.netConns.Done()
+
+	var delay time.Duration
+	for {
+		nc, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			if te, ok := err.(interface{ Temporary() bool }); !ok || !te.Temporary() {
+				return err
+			}
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay *= 2; delay > time.Second {
+				delay = time.Second
+			}
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		rs.netConns.Add(1)
+		go rs.serveConn(nc, name, handshakeTimeout)
+	}
+}
@@ -0,0 +1,335 @@
+// Package tx implements Redis transactions, MULTI, EXEC, DISCARD, WATCH and
+// UNWATCH, on top of redhub. A Tx is installed on a RedHub with Plug:
+//
+//	versions := tx.NewKeyVersions()
+//	t := tx.New(tx.Options{Mux: mux, Exec: exec, Versions: versions})
+//	rh := redhub.NewRedHub(onOpened, onClosed, mux.ServeRESP, tickFreq, reclaimMemAfter)
+//	rh.Plug(t)
+//
+// After MULTI, the commands of a connection are queued until EXEC runs them
+// through the Exec hook, which makes them atomic, and replies with an array
+// of their replies.
+package tx
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/IceFireDB/redhub"
+	"github.com/IceFireDB/redhub/pkg/resp"
+)
+
+// Options configures a Tx.
+type Options struct {
+	// Mux, when set, validates commands as they are queued. Unknown
+	// commands, wrong arities and commands flagged FlagNoMulti are rejected
+	// and make EXEC abort with EXECABORT, as in Redis.
+	Mux *redhub.Mux
+
+	// Exec runs the queued commands of a transaction by calling run, so that
+	// no other client's commands interleave with them, typically by holding
+	// the storage layer's lock while run executes. cmds are the queued
+	// commands, for implementations that lock only the keys involved. Exec
+	// must call run on the calling goroutine, and the handlers run calls
+	// must not take the same lock again. When nil, run is called directly.
+	Exec func(c redhub.Conn, cmds []resp.Command, run func())
+
+	// Versions reports key versions to WATCH. When nil, WATCH and UNWATCH
+	// are passed on to the next handler.
+	Versions Versions
+}
+
+// Versions tracks modifications of watched keys. A key's version must change
+// every time the key is modified, deleted or expires while it is watched.
+type Versions interface {
+	// Watch starts tracking key and returns its current version.
+	Watch(key string) uint64
+	// Version returns the current version of a watched key.
+	Version(key string) uint64
+	// Unwatch stops tracking key. Watch and Unwatch calls are balanced.
+	Unwatch(key string)
+}
+
+// Tx queues and executes the transactions of every connection.
+type Tx struct {
+	opts Options
+
+	// clients holds a *client for every connection in a transaction or
+	// watching keys.
+	clients sync.Map
+}
+
+type client struct {
+	multi bool
+	// dirty is set when a command failed to queue. EXEC then aborts.
+	dirty   bool
+	queue   []resp.Command
+	watched map[string]uint64
+}
+
+// New creates a new Tx.
+func New(opts Options) *Tx {
+	return &Tx{opts: opts}
+}
+
+// Wrap implements redhub.Plugin. It serves the transaction commands and
+// queues every other command while a transaction is open.
+func (t *Tx) Wrap(next redhub.HandlerFunc) redhub.HandlerFunc {
+	return func(c redhub.Conn, cmd resp.Command) redhub.Action {
+		var buf [16]byte
+		name := resp.AppendLower(buf[:0], cmd.Args[0])
+
+		switch string(name) {
+		case "multi":
+			return t.multi(c, cmd)
+		case "exec":
+			return t.exec(c, cmd, next)
+		case "discard":
+			return t.discard(c, cmd)
+		case "watch":
+			if t.opts.Versions != nil {
+				return t.watch(c, cmd)
+			}
+		case "quit":
+			return next(c, cmd)
+		case "reset":
+			t.Closed(c)
+			return next(c, cmd)
+		}
+
+		if cl := t.client(c, false); cl != nil && cl.multi {
+			return t.enqueue(c, cl, cmd)
+		}
+		if string(name) == "unwatch" && t.opts.Versions != nil {
+			return t.unwatch(c, cmd)
+		}
+		return next(c, cmd)
+	}
+}
+
+// Closed implements redhub.Plugin and drops the transaction and the watched
+// keys of c.
+func (t *Tx) Closed(c redhub.Conn) {
+	v, ok := t.clients.Load(c)
+	if !ok {
+		return
+	}
+	t.reset(c, v.(*client))
+}
+
+func (t *Tx) client(c redhub.Conn, create bool) *client {
+	if v, ok := t.clients.Load(c); ok {
+		return v.(*client)
+	}
+	if !create {
+		return nil
+	}
+	cl := &client{}
+	t.clients.Store(c, cl)
+	return cl
+}
+
+// reset discards the transaction of c and unwatches its keys.
+func (t *Tx) reset(c redhub.Conn, cl *client) {
+	for key := range cl.watched {
+		t.opts.Versions.Unwatch(key)
+	}
+	t.clients.Delete(c)
+}
+
+// Reject replies with the error msg to a command of c that can't run and,
+// inside a transaction, makes EXEC abort with EXECABORT, as in Redis.
+// Plugins that refuse commands before they reach the Tx, such as an ACL,
+// reply through it:
+//
+//	a := acl.New(acl.Options{Mux: mux, Reject: t.Reject})
+func (t *Tx) Reject(c redhub.Conn, msg string) {
+	if cl := t.client(c, false); cl != nil && cl.multi {
+		cl.dirty = true
+	}
+	c.WriteError(msg)
+}
+
+func (t *Tx) reject(c redhub.Conn, msg string) redhub.Action {
+	t.Reject(c, msg)
+	return redhub.None
+}
+
+func (t *Tx) multi(c redhub.Conn, cmd resp.Command) redhub.Action {
+	if len(cmd.Args) != 1 {
+		return t.reject(c, "ERR wrong number of arguments for 'multi' command")
+	}
+	cl := t.client(c, true)
+	if cl.multi {
+		c.WriteError("ERR MULTI calls can not be nested")
+		return redhub.None
+	}
+	cl.multi = true
+	c.WriteString("OK")
+	return redhub.None
+}
+
+func (t *Tx) enqueue(c redhub.Conn, cl *client, cmd resp.Command) redhub.Action {
+	if m := t.opts.Mux; m != nil {
+		if err := m.Validate(cmd.Args); err != nil {
+			return t.reject(c, err.Error())
+		}
+		if spec := m.Lookup(cmd.Args); spec != nil && spec.Flags&redhub.FlagNoMulti != 0 {
+			return t.reject(c, "ERR Command not allowed inside a transaction")
+		}
+	}
+	cl.queue = append(cl.queue, clone(cmd))
+	c.WriteString("QUEUED")
+	return redhub.None
+}
+
+func (t *Tx) exec(c redhub.Conn, cmd resp.Command, next redhub.HandlerFunc) (action redhub.Action) {
+	if len(cmd.Args) != 1 {
+		return t.reject(c, "ERR wrong number of arguments for 'exec' command")
+	}
+	cl := t.client(c, false)
+	if cl == nil || !cl.multi {
+		c.WriteError("ERR EXEC without MULTI")
+		return redhub.None
+	}
+	defer t.reset(c, cl)
+
+	if cl.dirty {
+		c.WriteError("EXECABORT Transaction discarded because of previous errors.")
+		return redhub.None
+	}
+
+	run := func() {
+		if t.modified(cl) {
+			c.WriteNullArray()
+			return
+		}
+		c.WriteArray(len(cl.queue))
+		for _, qcmd := range cl.queue {
+			if strings.EqualFold(string(qcmd.Args[0]), "unwatch") && t.opts.Versions != nil {
+				// EXEC unwatches every key anyway.
+				c.WriteString("OK")
+				continue
+			}
+			if next(c, qcmd) == redhub.Close {
+				action = redhub.Close
+			}
+		}
+	}
+	if t.opts.Exec != nil {
+		t.opts.Exec(c, cl.queue, run)
+	} else {
+		run()
+	}
+	return action
+}
+
+func (t *Tx) discard(c redhub.Conn, cmd resp.Command) redhub.Action {
+	if len(cmd.Args) != 1 {
+		return t.reject(c, "ERR wrong number of arguments for 'discard' command")
+	}
+	cl := t.client(c, false)
+	if cl == nil || !cl.multi {
+		c.WriteError("ERR DISCARD without MULTI")
+		return redhub.None
+	}
+	t.reset(c, cl)
+	c.WriteString("OK")
+	return redhub.None
+}
+
+func (t *Tx) watch(c redhub.Conn, cmd resp.Command) redhub.Action {
+	if len(cmd.Args) < 2 {
+		return t.reject(c, "ERR wrong number of arguments for 'watch' command")
+	}
+	cl := t.client(c, true)
+	if cl.multi {
+		c.WriteError("ERR WATCH inside MULTI is not allowed")
+		return redhub.None
+	}
+	if cl.watched == nil {
+		cl.watched = make(map[string]uint64)
+	}
+	for _, arg := range cmd.Args[1:] {
+		key := string(arg)
+		if _, ok := cl.watched[key]; !ok {
+			cl.watched[key] = t.opts.Versions.Watch(key)
+		}
+	}
+	c.WriteString("OK")
+	return redhub.None
+}
+
+func (t *Tx) unwatch(c redhub.Conn, cmd resp.Command) redhub.Action {
+	if len(cmd.Args) != 1 {
+		return t.reject(c, "ERR wrong number of arguments for 'unwatch' command")
+	}
+	if cl := t.client(c, false); cl != nil {
+		t.reset(c, cl)
+	}
+	c.WriteString("OK")
+	return redhub.None
+}
+
+// modified reports whether a key watched by cl has been modified.
+func (t *Tx) modified(cl *client) bool {
+	for key, version := range cl.watched {
+		if t.opts.Versions.Version(key) != version {
+			return true
+		}
+	}
+	return false
+}
+
+// Commands returns the specs of the commands Tx serves, so they can be
+// registered on a redhub.Mux and reported by COMMAND. Tx serves them itself
+// and never passes them on to the Mux.
+func (t *Tx) Commands() []redhub.CommandSpec {
+	const flags = redhub.FlagNoScript | redhub.FlagLoading | redhub.FlagStale | redhub.FlagFast
+	specs := []redhub.CommandSpec{
+		{Name: "multi", Arity: 1, Flags: flags, Handler: t.multi, Group: "transactions",
+			Summary: "Starts a transaction.", Since: "1.2.0", Complexity: "O(1)"},
+		{Name: "exec", Arity: 1, Flags: redhub.FlagNoScript | redhub.FlagLoading | redhub.FlagStale,
+			Handler: t.execHandler, Group: "transactions",
+			Summary: "Executes all commands in a transaction.", Since: "1.2.0",
+			Complexity: "Depends on commands in the transaction"},
+		{Name: "discard", Arity: 1, Flags: flags, Handler: t.discard, Group: "transactions",
+			Summary: "Discards a transaction.", Since: "2.0.0", Complexity: "O(N), when N is the number of queued commands"},
+	}
+	if t.opts.Versions != nil {
+		specs = append(specs,
+			redhub.CommandSpec{Name: "watch", Arity: -2, Flags: flags, FirstKey: 1, LastKey: -1, KeyStep: 1,
+				Handler: t.watch, Group: "transactions",
+				Summary: "Monitors changes to keys to determine the execution of a transaction.",
+				Since:   "2.2.0", Complexity: "O(1) for every key."},
+			redhub.CommandSpec{Name: "unwatch", Arity: 1, Flags: flags, Handler: t.unwatch, Group: "transactions",
+				Summary: "Forgets about watched keys of a transaction.", Since: "2.2.0", Complexity: "O(1)"},
+		)
+	}
+	return specs
+}
+
+// execHandler stands in for EXEC in its spec. Tx serves EXEC itself, as it
+// needs the next handler to run the queued commands.
+func (t *Tx) execHandler(c redhub.Conn, cmd resp.Command) redhub.Action {
+	c.WriteError("ERR EXEC without MULTI")
+	return redhub.None
+}
+
+// clone copies cmd out of the connection's buffers, which are reused once
+// the pipeline has been served.
+func clone(cmd resp.Command) resp.Command {
+	n := len(cmd.Raw)
+	for _, arg := range cmd.Args {
+		n += len(arg)
+	}
+	buf := make([]byte, 0, n)
+	buf = append(buf, cmd.Raw...)
+	out := resp.Command{Raw: buf[:len(cmd.Raw):len(cmd.Raw)], Args: make([][]byte, len(cmd.Args))}
+	for i, arg := range cmd.Args {
+		start := len(buf)
+		buf = append(buf, arg...)
+		out.Args[i] = buf[start:len(buf):len(buf)]
+	}
+	return out
+}
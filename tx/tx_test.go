@@ -0,0 +1,220 @@
+package tx_test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/IceFireDB/redhub"
+	"github.com/IceFireDB/redhub/pkg/resp"
+	"github.com/IceFireDB/redhub/redhubtest"
+	"github.com/IceFireDB/redhub/tx"
+)
+
+// store is a minimal key-value store that reports its modifications to
+// versions, as a storage layer does.
+type store struct {
+	versions *tx.KeyVersions
+
+	mu   sync.Mutex
+	data map[string]string
+}
+
+func (s *store) set(c redhub.Conn, cmd resp.Command) redhub.Action {
+	key := string(cmd.Args[1])
+	s.mu.Lock()
+	s.data[key] = string(cmd.Args[2])
+	s.mu.Unlock()
+	s.versions.Touch(key)
+	c.WriteString("OK")
+	return redhub.None
+}
+
+func (s *store) get(c redhub.Conn, cmd resp.Command) redhub.Action {
+	s.mu.Lock()
+	v, ok := s.data[string(cmd.Args[1])]
+	s.mu.Unlock()
+	if !ok {
+		c.WriteNull()
+	} else {
+		c.WriteBulkString(v)
+	}
+	return redhub.None
+}
+
+// newServer serves a store with transactions, running them through exec.
+func newServer(t *testing.T, exec func(c redhub.Conn, cmds []resp.Command, run func())) *redhubtest.Server {
+	versions := tx.NewKeyVersions()
+	s := &store{versions: versions, data: make(map[string]string)}
+	mux := redhub.NewMux()
+	mux.Handle(
+		redhub.CommandSpec{Name: "set", Arity: 3, Flags: redhub.FlagWrite, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Handler: s.set},
+		redhub.CommandSpec{Name: "get", Arity: 2, Flags: redhub.FlagReadOnly, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Handler: s.get},
+		redhub.CommandSpec{Name: "subscribe", Arity: -2, Flags: redhub.FlagPubSub | redhub.FlagNoMulti,
+			Handler: func(c redhub.Conn, cmd resp.Command) redhub.Action { return redhub.None }},
+	)
+	tr := tx.New(tx.Options{Mux: mux, Exec: exec, Versions: versions})
+	mux.Handle(tr.Commands()...)
+	rh := redhubtest.NewHub(mux.ServeRESP)
+	rh.Plug(tr)
+	srv := redhubtest.NewPipeServer(rh, redhub.Options{})
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// step sends args from the first client, or from a second one when other
+// is set, and checks the reply.
+type step struct {
+	other bool
+	args  []interface{}
+	check redhubtest.Check
+}
+
+func command(args ...interface{}) []interface{} { return args }
+
+var (
+	ok      = redhubtest.ExpectString("OK")
+	queued  = redhubtest.ExpectString("QUEUED")
+	null    = redhubtest.ExpectNull()
+	aborted = redhubtest.ExpectError("EXECABORT Transaction discarded because of previous errors.")
+)
+
+func TestTransactions(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"exec", []step{
+			{args: command("MULTI"), check: ok},
+			{args: command("SET", "k", "v"), check: queued},
+			{args: command("GET", "k"), check: queued},
+			{other: true, args: command("GET", "k"), check: null},
+			{args: command("EXEC"), check: redhubtest.ExpectStrings("OK", "v")},
+			{args: command("GET", "k"), check: redhubtest.ExpectBulk("v")},
+		}},
+		{"empty", []step{
+			{args: command("MULTI"), check: ok},
+			{args: command("EXEC"), check: redhubtest.ExpectArrayLen(0)},
+		}},
+		{"unknown command aborts", []step{
+			{args: command("MULTI"), check: ok},
+			{args: command("SET", "k", "v"), check: queued},
+			{args: command("NOSUCH", "a"), check: redhubtest.ExpectError("ERR unknown command 'NOSUCH'*")},
+			{args: command("EXEC"), check: aborted},
+			{args: command("GET", "k"), check: null},
+		}},
+		{"wrong arity aborts", []step{
+			{args: command("MULTI"), check: ok},
+			{args: command("SET", "k", "v"), check: queued},
+			{args: command("GET"), check: redhubtest.ExpectError("ERR wrong number of arguments for 'get' command")},
+			{args: command("EXEC"), check: aborted},
+			{args: command("GET", "k"), check: null},
+		}},
+		{"no-multi command aborts", []step{
+			{args: command("MULTI"), check: ok},
+			{args: command("SUBSCRIBE", "ch"), check: redhubtest.ExpectError("ERR Command not allowed inside a transaction")},
+			{args: command("EXEC"), check: aborted},
+		}},
+		{"nested multi doesn't abort", []step{
+			{args: command("MULTI"), check: ok},
+			{args: command("MULTI"), check: redhubtest.ExpectError("ERR MULTI calls can not be nested")},
+			{args: command("SET", "k", "v"), check: queued},
+			{args: command("EXEC"), check: redhubtest.ExpectStrings("OK")},
+		}},
+		{"discard", []step{
+			{args: command("MULTI"), check: ok},
+			{args: command("SET", "k", "v"), check: queued},
+			{args: command("DISCARD"), check: ok},
+			{args: command("GET", "k"), check: null},
+			{args: command("EXEC"), check: redhubtest.ExpectError("ERR EXEC without MULTI")},
+		}},
+		{"without multi", []step{
+			{args: command("EXEC"), check: redhubtest.ExpectError("ERR EXEC without MULTI")},
+			{args: command("DISCARD"), check: redhubtest.ExpectError("ERR DISCARD without MULTI")},
+		}},
+		{"watched key touched", []step{
+			{args: command("WATCH", "k"), check: ok},
+			{other: true, args: command("SET", "k", "theirs"), check: ok},
+			{args: command("MULTI"), check: ok},
+			{args: command("SET", "k", "mine"), check: queued},
+			{args: command("EXEC"), check: null},
+			{args: command("GET", "k"), check: redhubtest.ExpectBulk("theirs")},
+		}},
+		{"other key touched", []step{
+			{args: command("WATCH", "k"), check: ok},
+			{other: true, args: command("SET", "other", "theirs"), check: ok},
+			{args: command("MULTI"), check: ok},
+			{args: command("SET", "k", "mine"), check: queued},
+			{args: command("EXEC"), check: redhubtest.ExpectStrings("OK")},
+		}},
+		{"unwatch", []step{
+			{args: command("WATCH", "k"), check: ok},
+			{args: command("UNWATCH"), check: ok},
+			{other: true, args: command("SET", "k", "theirs"), check: ok},
+			{args: command("MULTI"), check: ok},
+			{args: command("SET", "k", "mine"), check: queued},
+			{args: command("EXEC"), check: redhubtest.ExpectStrings("OK")},
+			{args: command("GET", "k"), check: redhubtest.ExpectBulk("mine")},
+		}},
+		{"exec unwatches", []step{
+			{args: command("WATCH", "k"), check: ok},
+			{args: command("MULTI"), check: ok},
+			{args: command("EXEC"), check: redhubtest.ExpectArrayLen(0)},
+			{other: true, args: command("SET", "k", "theirs"), check: ok},
+			{args: command("MULTI"), check: ok},
+			{args: command("SET", "k", "mine"), check: queued},
+			{args: command("EXEC"), check: redhubtest.ExpectStrings("OK")},
+		}},
+		{"watch inside multi", []step{
+			{args: command("MULTI"), check: ok},
+			{args: command("WATCH", "k"), check: redhubtest.ExpectError("ERR WATCH inside MULTI is not allowed")},
+			{args: command("EXEC"), check: redhubtest.ExpectArrayLen(0)},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newServer(t, nil)
+			c, other := srv.Client(t), srv.Client(t)
+			for _, s := range tt.steps {
+				if s.other {
+					other.Expect(t, s.check, s.args...)
+				} else {
+					c.Expect(t, s.check, s.args...)
+				}
+			}
+		})
+	}
+}
+
+func TestExecHook(t *testing.T) {
+	var mu sync.Mutex
+	var calls [][]string
+	srv := newServer(t, func(c redhub.Conn, cmds []resp.Command, run func()) {
+		var names []string
+		for _, cmd := range cmds {
+			names = append(names, string(cmd.Args[0]))
+		}
+		mu.Lock()
+		calls = append(calls, names)
+		mu.Unlock()
+		run()
+	})
+	c := srv.Client(t)
+
+	c.Expect(t, ok, "MULTI")
+	c.Expect(t, queued, "SET", "k", "v")
+	c.Expect(t, queued, "GET", "k")
+	c.Expect(t, redhubtest.ExpectStrings("OK", "v"), "EXEC")
+
+	// An aborted transaction doesn't reach the hook.
+	c.Expect(t, ok, "MULTI")
+	c.Expect(t, redhubtest.ExpectError("ERR unknown command*"), "NOSUCH")
+	c.Expect(t, aborted, "EXEC")
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(calls) != 1 || len(calls[0]) != 2 || calls[0][0] != "SET" || calls[0][1] != "GET" {
+		t.Errorf("Exec was called with %q, want [[SET GET]]", calls)
+	}
+}
@@ -0,0 +1,85 @@
+package tx
+
+import "sync"
+
+// KeyVersions is a Versions for storage layers that don't version their
+// keys. The storage layer reports every modification with Touch, and
+// KeyVersions keeps versions only for the keys that are being watched.
+type KeyVersions struct {
+	mu   sync.Mutex
+	keys map[string]*keyVersion
+}
+
+type keyVersion struct {
+	version  uint64
+	watchers int
+}
+
+// NewKeyVersions creates a new KeyVersions.
+func NewKeyVersions() *KeyVersions {
+	return &KeyVersions{
+		keys: make(map[string]*keyVersion),
+	}
+}
+
+// Watch implements Versions.
+func (v *KeyVersions) Watch(key string) uint64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	kv := v.keys[key]
+	if kv == nil {
+		kv = &keyVersion{}
+		v.keys[key] = kv
+	}
+	kv.watchers++
+	return kv.version
+}
+
+// Version implements Versions.
+func (v *KeyVersions) Version(key string) uint64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if kv := v.keys[key]; kv != nil {
+		return kv.version
+	}
+	return 0
+}
+
+// Unwatch implements Versions.
+func (v *KeyVersions) Unwatch(key string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	kv := v.keys[key]
+	if kv == nil {
+		return
+	}
+	if kv.watchers--; kv.watchers == 0 {
+		delete(v.keys, key)
+	}
+}
+
+// Touch reports that keys were modified, deleted or expired, aborting the
+// transactions watching them.
+func (v *KeyVersions) Touch(keys ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for _, key := range keys {
+		if kv := v.keys[key]; kv != nil {
+			kv.version++
+		}
+	}
+}
+
+// TouchAll reports that every key was modified, for example by FLUSHALL.
+func (v *KeyVersions) TouchAll() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for _, kv := range v.keys {
+		kv.version++
+	}
+}